@@ -2,6 +2,7 @@ package config
 
 import (
 	"io/ioutil"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -11,11 +12,32 @@ type Config struct {
 }
 
 type Mapping struct {
-	Table                string            `yaml:"table"`
-	Columns              map[string]string `yaml:"columns"`
-	PrimaryKey           string            `yaml:"primaryKey"`
-	HasConflictDetection bool              `yaml:"hasConflictDetection"`
-	Response             ResponseMapping   `yaml:"response"`
+	Table   string            `yaml:"table"`
+	Columns map[string]string `yaml:"columns"`
+	// ColumnTypes are the SQL types of the columns in generated migrations, which default to varchar(255),
+	// or mediumtext for the document column
+	ColumnTypes                 map[string]string `yaml:"columnTypes"`
+	PrimaryKey                  string            `yaml:"primaryKey"`
+	HasConflictDetection        bool              `yaml:"hasConflictDetection"`
+	UpdateMetadataWhenUnchanged bool              `yaml:"updateMetadataWhenUnchanged"`
+	Compression                 string            `yaml:"compression"`
+	HashMode                    string            `yaml:"hashMode"`
+	StoreCanonical              bool              `yaml:"storeCanonical"`
+	CacheTTL                    time.Duration     `yaml:"cacheTTL"`
+	Retry                       RetryMapping      `yaml:"retry"`
+	Topic                       string            `yaml:"topic"`
+	ChangeFeed                  bool              `yaml:"changeFeed"`
+	Response                    ResponseMapping   `yaml:"response"`
+	// SchemaCheckSeverity is the severity of the health check of the table's columns, 2 by default.
+	// A critical (1) check also fails the GTG endpoint.
+	SchemaCheckSeverity uint8 `yaml:"schemaCheckSeverity"`
+}
+
+// RetryMapping configures the retries of writes that fail with a transient database error.
+type RetryMapping struct {
+	MaxAttempts    int           `yaml:"maxAttempts"`
+	InitialBackoff time.Duration `yaml:"initialBackoff"`
+	MaxBackoff     time.Duration `yaml:"maxBackoff"`
 }
 
 type ResponseMapping struct {
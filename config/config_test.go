@@ -2,6 +2,7 @@ package config
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -11,6 +12,14 @@ func TestReadConfig(t *testing.T) {
 
 	assert.NoError(t, err)
 	assert.NotNil(t, cfg)
+	assert.Equal(t, 30*time.Second, cfg.Paths["/published/content/:id/annotations"].CacheTTL)
+	assert.Zero(t, cfg.Paths["/drafts/content/:id/annotations"].CacheTTL)
+	assert.Equal(t, "DraftAnnotationsChanged", cfg.Paths["/drafts/content/:id/annotations"].Topic)
+	assert.True(t, cfg.Paths["/published/content/:id/annotations"].ChangeFeed)
+	assert.False(t, cfg.Paths["/drafts/content/:id/annotations"].ChangeFeed)
+	assert.True(t, cfg.Paths["/drafts/content/:id"].ChangeFeed)
+	assert.Equal(t, "varchar(128)", cfg.Paths["/drafts/content/:id"].ColumnTypes["content_type"])
+	assert.Empty(t, cfg.Paths["/drafts/content/:id"].ColumnTypes["body"])
 }
 
 func TestReadConfigNotFound(t *testing.T) {
@@ -0,0 +1,384 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/oliveagle/jsonpath"
+	log "github.com/sirupsen/logrus"
+)
+
+const backfillCheckpointTable = "backfill_checkpoint"
+
+// backfillLease is how long an instance holds its claim on the checkpoint of a backfill after each batch, on top of the
+// batch delay. Another instance can resume the backfill once the claim of an instance that stopped has expired.
+var backfillLease = 5 * time.Minute
+
+var (
+	// ErrBackfillRunning is returned when a backfill of the table is already running, in this or another instance.
+	ErrBackfillRunning = errors.New("a backfill of the table is already running")
+	// ErrBackfillCheckpoint is returned when the checkpoint of a backfill cannot be read or claimed.
+	ErrBackfillCheckpoint = errors.New("unable to claim the backfill checkpoint")
+)
+
+// BackfillOptions configure a backfill of the columns of a table that are derived from the document by a JSONPath expression.
+type BackfillOptions struct {
+	// Columns are the columns to backfill, or every JSONPath column of the table if empty
+	Columns   []string
+	BatchSize int
+	// BatchDelay is the pause between batches, which throttles the backfill to leave capacity for live traffic
+	BatchDelay time.Duration
+	// Restart discards the checkpoint of an interrupted backfill, rather than resuming after its last key
+	Restart bool
+}
+
+// BackfillProgress is the progress of a backfill, which is checkpointed after each batch.
+type BackfillProgress struct {
+	Table   string   `json:"table"`
+	Columns []string `json:"columns,omitempty"`
+	// LastKey is the primary key of the last row that was scanned, after which an interrupted backfill resumes
+	LastKey string `json:"lastKey"`
+	Scanned int64  `json:"scanned"`
+	Updated int64  `json:"updated"`
+	// Running is true while the backfill runs, in this or another instance
+	Running  bool   `json:"running"`
+	Complete bool   `json:"complete"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Backfiller re-evaluates the JSONPath columns of the stored documents of a table in the background,
+// e.g. after a column has been added to its mapping.
+type Backfiller interface {
+	// StartBackfill starts a backfill of the table, resuming an interrupted backfill unless it is restarted.
+	StartBackfill(table string, options BackfillOptions) error
+	// BackfillProgress returns the progress of the latest backfill of the table in this instance,
+	// or of an interrupted backfill from its checkpoint.
+	BackfillProgress(ctx context.Context, table string) (BackfillProgress, error)
+}
+
+// Backfill re-evaluates the JSONPath columns of every stored document of a table, in primary key batches,
+// and updates the columns whose values have changed. The progress is checkpointed after each batch,
+// so an interrupted backfill resumes after the last checkpointed key.
+// A row that is written concurrently is left alone, since the write has already evaluated its columns.
+func (service *AuroraRWService) Backfill(ctx context.Context, tableName string, options BackfillOptions) (BackfillProgress, error) {
+	t, columns, err := service.backfillColumns(tableName, options)
+	if err != nil {
+		return BackfillProgress{Table: tableName}, err
+	}
+
+	progress, err := service.claimBackfillCheckpoint(ctx, t.name, columns, options)
+	if err != nil {
+		return progress, err
+	}
+	return service.backfill(ctx, t, columns, progress, options, func(BackfillProgress) {})
+}
+
+// StartBackfill claims the checkpoint of the backfill, then runs Backfill in the background,
+// until it completes or the service is closed.
+func (service *AuroraRWService) StartBackfill(tableName string, options BackfillOptions) error {
+	t, columns, err := service.backfillColumns(tableName, options)
+	if err != nil {
+		return err
+	}
+
+	service.backfillLock.Lock()
+	defer service.backfillLock.Unlock()
+	if service.backfills[t.name].Running {
+		return ErrBackfillRunning
+	}
+
+	claimCtx, cancelClaim := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancelClaim()
+	progress, err := service.claimBackfillCheckpoint(claimCtx, t.name, columns, options)
+	if err != nil {
+		return err
+	}
+
+	if service.backfills == nil {
+		service.backfills = make(map[string]BackfillProgress)
+	}
+	running := progress
+	running.Running = true
+	service.backfills[t.name] = running
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-service.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	go func() {
+		defer cancel()
+		progress, err := service.backfill(ctx, t, columns, progress, options, func(progress BackfillProgress) {
+			progress.Running = true
+			service.setBackfillProgress(progress)
+		})
+		if err != nil {
+			log.WithError(err).WithField("table", t.name).Error("backfill failed")
+			progress.Error = err.Error()
+		}
+		service.setBackfillProgress(progress)
+	}()
+	return nil
+}
+
+func (service *AuroraRWService) BackfillProgress(ctx context.Context, tableName string) (BackfillProgress, error) {
+	t, found := service.rwConfig[tableName]
+	if !found {
+		return BackfillProgress{Table: tableName}, fmt.Errorf("table %s is not configured", tableName)
+	}
+
+	service.backfillLock.Lock()
+	progress, found := service.backfills[t.name]
+	service.backfillLock.Unlock()
+	if found {
+		return progress, nil
+	}
+
+	progress, _, err := service.readBackfillCheckpoint(ctx, t.name)
+	return progress, err
+}
+
+func (service *AuroraRWService) setBackfillProgress(progress BackfillProgress) {
+	service.backfillLock.Lock()
+	defer service.backfillLock.Unlock()
+	service.backfills[progress.Table] = progress
+}
+
+// backfillColumns returns the table and its sorted JSONPath columns to backfill
+func (service *AuroraRWService) backfillColumns(tableName string, options BackfillOptions) (table, []string, error) {
+	t, found := service.rwConfig[tableName]
+	if !found {
+		return t, nil, fmt.Errorf("table %s is not configured", tableName)
+	}
+	if t.documentColumn() == "" {
+		return t, nil, fmt.Errorf("document column is not configured for table %s", tableName)
+	}
+	if options.BatchSize <= 0 {
+		return t, nil, fmt.Errorf("invalid batch size %d", options.BatchSize)
+	}
+
+	columns := append([]string(nil), options.Columns...)
+	if len(columns) == 0 {
+		for col, expr := range t.columns {
+			if isJSONPath(expr) {
+				columns = append(columns, col)
+			}
+		}
+		if len(columns) == 0 {
+			return t, nil, fmt.Errorf("table %s has no columns derived from the document by a JSONPath expression", tableName)
+		}
+	}
+	for _, col := range columns {
+		if !isJSONPath(t.columns[col]) {
+			return t, nil, fmt.Errorf("column %s of table %s is not derived from the document by a JSONPath expression", col, tableName)
+		}
+	}
+	sort.Strings(columns)
+	return t, columns, nil
+}
+
+// isJSONPath is true for an expression that extracts a value from the document, rather than the whole document
+func isJSONPath(expr string) bool {
+	return strings.HasPrefix(expr, "$") && expr != "$"
+}
+
+// backfill runs a backfill from the checkpoint that this instance has claimed, renewing the claim after each batch.
+// The claim is released if the backfill stops before it completes, so that another instance can resume it.
+func (service *AuroraRWService) backfill(ctx context.Context, t table, columns []string, progress BackfillProgress, options BackfillOptions, report func(BackfillProgress)) (BackfillProgress, error) {
+	backfillLog := log.WithFields(log.Fields{"table": t.name, "columns": columns})
+	if progress.LastKey != "" {
+		backfillLog.WithField("lastKey", progress.LastKey).Info("resuming backfill after the checkpoint")
+	}
+	report(progress)
+
+	// a column that cannot be scanned as a string is compared as empty
+	selectColumns := []string{t.documentColumn(), hashColumn}
+	for _, col := range columns {
+		selectColumns = append(selectColumns, fmt.Sprintf("COALESCE(%s, '')", col))
+	}
+	update := service.dialect.rebind(fmt.Sprintf("UPDATE %s SET %s = ? WHERE %s = ? AND %s = ?", t.name, strings.Join(columns, " = ?, "), t.primaryKey, hashColumn))
+	checkpoint := service.dialect.rebind(fmt.Sprintf("UPDATE %s SET last_key = ?, scanned = ?, updated = ?, claimed_until = ? WHERE table_name = ? AND claimed_by = ?", backfillCheckpointTable))
+
+	err := service.walkTable(ctx, t, selectColumns, progress.LastKey, options.BatchSize, func(rows [][]string) error {
+		for _, row := range rows {
+			key, stored, storedHash, current := row[0], row[1], row[2], row[3:]
+			progress.Scanned++
+
+			values, changed, err := backfillValues(t, columns, stored, current)
+			if err != nil {
+				backfillLog.WithError(err).WithField("key", key).Warn("unable to read document, skipping it")
+				continue
+			}
+			if !changed {
+				continue
+			}
+
+			res, err := service.writer.db().ExecContext(ctx, update, append(values, key, storedHash)...)
+			if err != nil {
+				backfillLog.WithError(err).WithField("key", key).Error("unable to update backfilled columns")
+				return err
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				progress.Updated++
+				service.invalidateCache(t, key, storedHash)
+			}
+		}
+
+		progress.LastKey = rows[len(rows)-1][0]
+		res, err := service.writer.db().ExecContext(ctx, checkpoint, progress.LastKey, progress.Scanned, progress.Updated, backfillClaimedUntil(options), t.name, service.instanceID)
+		if err != nil {
+			backfillLog.WithError(err).Error("unable to checkpoint backfill")
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return fmt.Errorf("the claim on the backfill of table %s has been taken by another instance", t.name)
+		}
+		report(progress)
+		backfillLog.WithFields(log.Fields{"lastKey": progress.LastKey, "scanned": progress.Scanned, "updated": progress.Updated}).Info("backfilled batch of documents")
+
+		if len(rows) < options.BatchSize {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(options.BatchDelay):
+			return nil
+		}
+	})
+	if err != nil {
+		// the checkpoint is kept, so that the backfill resumes
+		service.releaseBackfillCheckpoint(t.name)
+		return progress, err
+	}
+
+	if _, err := service.writer.db().ExecContext(ctx, service.dialect.rebind(fmt.Sprintf("DELETE FROM %s WHERE table_name = ? AND claimed_by = ?", backfillCheckpointTable)), t.name, service.instanceID); err != nil {
+		backfillLog.WithError(err).Error("unable to remove backfill checkpoint")
+		return progress, err
+	}
+	progress.Complete = true
+	backfillLog.WithFields(log.Fields{"scanned": progress.Scanned, "updated": progress.Updated}).Info("backfill complete")
+	return progress, nil
+}
+
+// backfillValues evaluates the JSONPath expressions of the columns against the stored document, and reports whether
+// any value differs from the current values. A value that cannot be extracted leaves the current value in place.
+func backfillValues(t table, columns []string, stored string, current []string) ([]interface{}, bool, error) {
+	body, err := decompressBody(stored)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var jsondoc interface{}
+	if err := json.Unmarshal(body, &jsondoc); err != nil {
+		return nil, false, err
+	}
+
+	values := make([]interface{}, len(columns))
+	changed := false
+	for i, col := range columns {
+		val, err := jsonpath.JsonPathLookup(jsondoc, t.columns[col])
+		if err != nil || val == nil {
+			values[i] = current[i]
+			continue
+		}
+		if fmt.Sprint(val) != current[i] {
+			changed = true
+		}
+		values[i] = val
+	}
+	return values, changed, nil
+}
+
+// backfillClaimedUntil is the expiry of a claim on the checkpoint of a backfill that is renewed now
+func backfillClaimedUntil(options BackfillOptions) int64 {
+	return time.Now().Add(backfillLease + options.BatchDelay).UnixMilli()
+}
+
+// claimBackfillCheckpoint claims the checkpoint of an interrupted backfill of the same columns for this instance,
+// to resume it, or records a new checkpoint. It returns ErrBackfillRunning while another instance holds an unexpired
+// claim on the checkpoint, so that a table is backfilled by one instance at a time.
+func (service *AuroraRWService) claimBackfillCheckpoint(ctx context.Context, tableName string, columns []string, options BackfillOptions) (BackfillProgress, error) {
+	progress, found, err := service.readBackfillCheckpoint(ctx, tableName)
+	if err != nil {
+		return progress, fmt.Errorf("%w of table %s: %v", ErrBackfillCheckpoint, tableName, err)
+	}
+	if progress.Running {
+		return progress, ErrBackfillRunning
+	}
+
+	conn := service.writer.db()
+	now := time.Now().UnixMilli()
+	if found && !options.Restart {
+		if strings.Join(progress.Columns, ",") != strings.Join(columns, ",") {
+			return progress, fmt.Errorf("an interrupted backfill of table %s has columns %s, restart it to backfill columns %s",
+				tableName, strings.Join(progress.Columns, ","), strings.Join(columns, ","))
+		}
+
+		claim := service.dialect.rebind(fmt.Sprintf("UPDATE %s SET claimed_by = ?, claimed_until = ? WHERE table_name = ? AND claimed_until < ?", backfillCheckpointTable))
+		res, err := conn.ExecContext(ctx, claim, service.instanceID, backfillClaimedUntil(options), tableName, now)
+		if err != nil {
+			return progress, fmt.Errorf("%w of table %s: %v", ErrBackfillCheckpoint, tableName, err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			// another instance has claimed it since it was read
+			return progress, ErrBackfillRunning
+		}
+		return progress, nil
+	}
+
+	if _, err := conn.ExecContext(ctx, service.dialect.rebind(fmt.Sprintf("DELETE FROM %s WHERE table_name = ? AND claimed_until < ?", backfillCheckpointTable)), tableName, now); err != nil {
+		return progress, fmt.Errorf("%w of table %s: %v", ErrBackfillCheckpoint, tableName, err)
+	}
+	insert := service.dialect.rebind(fmt.Sprintf("INSERT INTO %s (table_name, column_names, last_key, scanned, updated, claimed_by, claimed_until) VALUES (?, ?, '', 0, 0, ?, ?)", backfillCheckpointTable))
+	if _, err := conn.ExecContext(ctx, insert, tableName, strings.Join(columns, ","), service.instanceID, backfillClaimedUntil(options)); err != nil {
+		if service.dialect.isUniqueViolation(err) {
+			// another instance has claimed the checkpoint since it was read
+			return progress, ErrBackfillRunning
+		}
+		return progress, fmt.Errorf("%w of table %s: %v", ErrBackfillCheckpoint, tableName, err)
+	}
+	return BackfillProgress{Table: tableName, Columns: columns}, nil
+}
+
+// releaseBackfillCheckpoint releases the claim of this instance on the checkpoint of a backfill that has stopped,
+// so that it can be resumed by another instance without waiting for the claim to expire.
+func (service *AuroraRWService) releaseBackfillCheckpoint(tableName string) {
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+
+	release := service.dialect.rebind(fmt.Sprintf("UPDATE %s SET claimed_until = 0 WHERE table_name = ? AND claimed_by = ?", backfillCheckpointTable))
+	if _, err := service.writer.db().ExecContext(ctx, release, tableName, service.instanceID); err != nil {
+		log.WithError(err).WithField("table", tableName).Warn("unable to release the claim on the backfill checkpoint, it can be resumed when the claim expires")
+	}
+}
+
+// readBackfillCheckpoint returns the progress of an interrupted backfill of the table, if there is one,
+// which is running while an instance holds an unexpired claim on it
+func (service *AuroraRWService) readBackfillCheckpoint(ctx context.Context, tableName string) (BackfillProgress, bool, error) {
+	progress := BackfillProgress{Table: tableName}
+	query := service.dialect.rebind(fmt.Sprintf("SELECT column_names, last_key, scanned, updated, claimed_until FROM %s WHERE table_name = ?", backfillCheckpointTable))
+
+	var columns string
+	var claimedUntil int64
+	err := service.writer.db().QueryRowContext(ctx, query, tableName).Scan(&columns, &progress.LastKey, &progress.Scanned, &progress.Updated, &claimedUntil)
+	if err == sql.ErrNoRows {
+		return progress, false, nil
+	}
+	if err != nil {
+		return progress, false, err
+	}
+	progress.Columns = strings.Split(columns, ",")
+	progress.Running = claimedUntil > time.Now().UnixMilli()
+	return progress, true, nil
+}
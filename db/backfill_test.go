@@ -0,0 +1,238 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Financial-Times/generic-rw-aurora/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestBackfillService has a things table with title and kind columns derived from the document,
+// whose rows 1 to 5 were written before the columns were backfilled
+func newTestBackfillService(t *testing.T) *AuroraRWService {
+	service := newTestSQLiteService(t, &config.Config{Paths: map[string]config.Mapping{
+		"/things/:id": {
+			Table:      "things",
+			Columns:    map[string]string{"id": ":id", "body": "$", "title": "$.title", "kind": "$.kind", "origin": "@.x-origin-system-id"},
+			PrimaryKey: "id",
+		},
+	}})
+
+	for i := 1; i <= 5; i++ {
+		key := fmt.Sprintf("%d", i)
+		body := fmt.Sprintf(`{"title":"thing %d","kind":"test"}`, i)
+		_, _, err := service.Write(context.Background(), "things", key, NewDocument([]byte(body)), map[string]string{"id": key}, "")
+		require.NoError(t, err)
+	}
+	_, err := service.writer.db().Exec("UPDATE things SET title = '', kind = ''")
+	require.NoError(t, err)
+	return service
+}
+
+func thingTitles(t *testing.T, service *AuroraRWService) map[string]string {
+	rows, err := service.writer.db().Query("SELECT id, title FROM things")
+	require.NoError(t, err)
+	defer rows.Close()
+
+	titles := make(map[string]string)
+	for rows.Next() {
+		var id, title string
+		require.NoError(t, rows.Scan(&id, &title))
+		titles[id] = title
+	}
+	return titles
+}
+
+func TestBackfill(t *testing.T) {
+	service := newTestBackfillService(t)
+
+	progress, err := service.Backfill(context.Background(), "things", BackfillOptions{BatchSize: 2})
+	require.NoError(t, err)
+	assert.Equal(t, BackfillProgress{Table: "things", Columns: []string{"kind", "title"}, LastKey: "5", Scanned: 5, Updated: 5, Complete: true}, progress)
+	assert.Equal(t, map[string]string{"1": "thing 1", "2": "thing 2", "3": "thing 3", "4": "thing 4", "5": "thing 5"}, thingTitles(t, service))
+
+	_, found, err := service.readBackfillCheckpoint(context.Background(), "things")
+	require.NoError(t, err)
+	assert.False(t, found, "the checkpoint of a complete backfill is removed")
+
+	progress, err = service.Backfill(context.Background(), "things", BackfillOptions{BatchSize: 2})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), progress.Scanned)
+	assert.Equal(t, int64(0), progress.Updated, "only changed columns are updated")
+}
+
+func TestBackfillColumns(t *testing.T) {
+	service := newTestBackfillService(t)
+
+	progress, err := service.Backfill(context.Background(), "things", BackfillOptions{Columns: []string{"title"}, BatchSize: 10})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"title"}, progress.Columns)
+
+	var kind string
+	require.NoError(t, service.writer.db().QueryRow("SELECT kind FROM things WHERE id = '1'").Scan(&kind))
+	assert.Empty(t, kind, "only the requested columns are backfilled")
+}
+
+func TestBackfillKeepsValuesThatCannotBeExtracted(t *testing.T) {
+	service := newTestBackfillService(t)
+	_, err := service.writer.db().Exec(`UPDATE things SET body = '{"kind":"test"}', title = 'kept' WHERE id = '1'`)
+	require.NoError(t, err)
+	_, err = service.writer.db().Exec(`UPDATE things SET body = 'not json', title = 'kept' WHERE id = '2'`)
+	require.NoError(t, err)
+
+	progress, err := service.Backfill(context.Background(), "things", BackfillOptions{BatchSize: 10})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), progress.Scanned)
+	assert.Equal(t, int64(4), progress.Updated, "a document that is not JSON is skipped")
+	assert.Equal(t, "kept", thingTitles(t, service)["1"])
+	assert.Equal(t, "kept", thingTitles(t, service)["2"])
+}
+
+func TestBackfillResumesFromCheckpoint(t *testing.T) {
+	service := newTestBackfillService(t)
+	_, err := service.writer.db().Exec("INSERT INTO backfill_checkpoint (table_name, column_names, last_key, scanned, updated) VALUES ('things', 'kind,title', '3', 3, 1)")
+	require.NoError(t, err)
+
+	progress, err := service.Backfill(context.Background(), "things", BackfillOptions{BatchSize: 10})
+	require.NoError(t, err)
+	assert.Equal(t, BackfillProgress{Table: "things", Columns: []string{"kind", "title"}, LastKey: "5", Scanned: 5, Updated: 3, Complete: true}, progress)
+	assert.Equal(t, map[string]string{"1": "", "2": "", "3": "", "4": "thing 4", "5": "thing 5"}, thingTitles(t, service), "the rows up to the checkpoint are not scanned again")
+}
+
+func TestBackfillCheckpointOfOtherColumns(t *testing.T) {
+	service := newTestBackfillService(t)
+	_, err := service.writer.db().Exec("INSERT INTO backfill_checkpoint (table_name, column_names, last_key, scanned, updated) VALUES ('things', 'title', '3', 3, 1)")
+	require.NoError(t, err)
+
+	_, err = service.Backfill(context.Background(), "things", BackfillOptions{BatchSize: 10})
+	assert.EqualError(t, err, "an interrupted backfill of table things has columns title, restart it to backfill columns kind,title")
+
+	progress, err := service.Backfill(context.Background(), "things", BackfillOptions{BatchSize: 10, Restart: true})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), progress.Scanned, "a restarted backfill scans every row")
+}
+
+func TestBackfillInvalid(t *testing.T) {
+	service := newTestBackfillService(t)
+
+	for name, test := range map[string]struct {
+		table   string
+		options BackfillOptions
+		err     string
+	}{
+		"not configured":  {"unknown", BackfillOptions{BatchSize: 10}, "table unknown is not configured"},
+		"batch size":      {"things", BackfillOptions{}, "invalid batch size 0"},
+		"metadata column": {"things", BackfillOptions{Columns: []string{"origin"}, BatchSize: 10}, "column origin of table things is not derived from the document by a JSONPath expression"},
+		"unknown column":  {"things", BackfillOptions{Columns: []string{"colour"}, BatchSize: 10}, "column colour of table things is not derived from the document by a JSONPath expression"},
+	} {
+		_, err := service.Backfill(context.Background(), test.table, test.options)
+		assert.EqualError(t, err, test.err, name)
+		assert.EqualError(t, service.StartBackfill(test.table, test.options), test.err, name)
+	}
+}
+
+func TestBackfillNoJSONPathColumns(t *testing.T) {
+	service := newTestChangeFeedService(t)
+
+	_, err := service.Backfill(context.Background(), testTable, BackfillOptions{BatchSize: 10})
+	assert.EqualError(t, err, "table published_annotations has no columns derived from the document by a JSONPath expression")
+}
+
+func TestStartBackfill(t *testing.T) {
+	service := newTestBackfillService(t)
+
+	require.NoError(t, service.StartBackfill("things", BackfillOptions{BatchSize: 2}))
+
+	var progress BackfillProgress
+	require.Eventually(t, func() bool {
+		var err error
+		progress, err = service.BackfillProgress(context.Background(), "things")
+		require.NoError(t, err)
+		return progress.Complete
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, BackfillProgress{Table: "things", Columns: []string{"kind", "title"}, LastKey: "5", Scanned: 5, Updated: 5, Complete: true}, progress)
+}
+
+func TestStartBackfillWhilstRunning(t *testing.T) {
+	service := newTestBackfillService(t)
+
+	// the backfill is throttled after the first batch until the service is closed
+	require.NoError(t, service.StartBackfill("things", BackfillOptions{BatchSize: 1, BatchDelay: time.Minute}))
+	require.Eventually(t, func() bool {
+		progress, _ := service.BackfillProgress(context.Background(), "things")
+		return progress.Scanned == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, ErrBackfillRunning, service.StartBackfill("things", BackfillOptions{BatchSize: 1}))
+
+	service.Close()
+	var progress BackfillProgress
+	require.Eventually(t, func() bool {
+		progress, _ = service.BackfillProgress(context.Background(), "things")
+		return !progress.Running
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "context canceled", progress.Error)
+	assert.False(t, progress.Complete)
+
+	checkpoint, found, err := service.readBackfillCheckpoint(context.Background(), "things")
+	require.NoError(t, err)
+	assert.True(t, found, "the checkpoint is kept for the backfill to resume")
+	assert.Equal(t, "1", checkpoint.LastKey)
+	assert.False(t, checkpoint.Running, "the claim is released for another instance to resume the backfill")
+}
+
+func TestBackfillClaimedByAnotherInstance(t *testing.T) {
+	service := newTestBackfillService(t)
+	_, err := service.writer.db().Exec("INSERT INTO backfill_checkpoint (table_name, column_names, last_key, scanned, updated, claimed_by, claimed_until) VALUES ('things', 'kind,title', '3', 3, 1, 'other', ?)",
+		time.Now().Add(time.Minute).UnixMilli())
+	require.NoError(t, err)
+
+	_, err = service.Backfill(context.Background(), "things", BackfillOptions{BatchSize: 10})
+	assert.Equal(t, ErrBackfillRunning, err)
+	assert.Equal(t, ErrBackfillRunning, service.StartBackfill("things", BackfillOptions{BatchSize: 10}))
+	_, err = service.Backfill(context.Background(), "things", BackfillOptions{BatchSize: 10, Restart: true})
+	assert.Equal(t, ErrBackfillRunning, err, "a running backfill cannot be restarted")
+
+	progress, err := service.BackfillProgress(context.Background(), "things")
+	require.NoError(t, err)
+	assert.True(t, progress.Running, "the backfill is running in the other instance")
+
+	_, err = service.writer.db().Exec("UPDATE backfill_checkpoint SET claimed_until = ?", time.Now().Add(-time.Second).UnixMilli())
+	require.NoError(t, err)
+	progress, err = service.Backfill(context.Background(), "things", BackfillOptions{BatchSize: 10})
+	require.NoError(t, err)
+	assert.Equal(t, BackfillProgress{Table: "things", Columns: []string{"kind", "title"}, LastKey: "5", Scanned: 5, Updated: 3, Complete: true}, progress, "an expired claim is resumed")
+}
+
+func TestBackfillLosesClaim(t *testing.T) {
+	service := newTestBackfillService(t)
+
+	progress, err := service.claimBackfillCheckpoint(context.Background(), "things", []string{"kind", "title"}, BackfillOptions{BatchSize: 2})
+	require.NoError(t, err)
+	_, err = service.writer.db().Exec("UPDATE backfill_checkpoint SET claimed_by = 'other'")
+	require.NoError(t, err)
+
+	tbl, columns, err := service.backfillColumns("things", BackfillOptions{BatchSize: 2})
+	require.NoError(t, err)
+	progress, err = service.backfill(context.Background(), tbl, columns, progress, BackfillOptions{BatchSize: 2}, func(BackfillProgress) {})
+	assert.EqualError(t, err, "the claim on the backfill of table things has been taken by another instance")
+	assert.Equal(t, int64(2), progress.Scanned, "the backfill stops at the first checkpoint")
+}
+
+func TestBackfillProgressFromCheckpoint(t *testing.T) {
+	service := newTestBackfillService(t)
+
+	progress, err := service.BackfillProgress(context.Background(), "things")
+	require.NoError(t, err)
+	assert.Equal(t, BackfillProgress{Table: "things"}, progress, "no backfill")
+
+	_, err = service.writer.db().Exec("INSERT INTO backfill_checkpoint (table_name, column_names, last_key, scanned, updated) VALUES ('things', 'title', '3', 3, 1)")
+	require.NoError(t, err)
+	progress, err = service.BackfillProgress(context.Background(), "things")
+	require.NoError(t, err)
+	assert.Equal(t, BackfillProgress{Table: "things", Columns: []string{"title"}, LastKey: "3", Scanned: 3, Updated: 1}, progress, "an interrupted backfill")
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/simplelru"
+	"github.com/rcrowley/go-metrics"
+)
+
+const (
+	cacheHitsMetric   = "db.read-cache.hits"
+	cacheMissesMetric = "db.read-cache.misses"
+)
+
+// readCache is a bounded LRU cache of documents read from the database, keyed by table and key.
+// A local write replaces the entry with the hash that was written, so that a read which started before
+// the write cannot put the previous document back into the cache.
+type readCache struct {
+	sync.Mutex
+	entries *simplelru.LRU[cacheKey, cacheEntry]
+	hits    metrics.Counter
+	misses  metrics.Counter
+	now     func() time.Time
+}
+
+type cacheKey struct {
+	table string
+	key   string
+}
+
+type cacheEntry struct {
+	hash    string
+	doc     *Document // nil if the document was written locally and has not been read since
+	expires time.Time
+}
+
+func newReadCache(size int, registry metrics.Registry) (*readCache, error) {
+	entries, err := simplelru.NewLRU[cacheKey, cacheEntry](size, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &readCache{
+		entries: entries,
+		hits:    metrics.GetOrRegisterCounter(cacheHitsMetric, registry),
+		misses:  metrics.GetOrRegisterCounter(cacheMissesMetric, registry),
+		now:     time.Now,
+	}, nil
+}
+
+func (c *readCache) get(table string, key string) (Document, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	entry, found := c.entries.Get(cacheKey{table, key})
+	if !found || entry.doc == nil || c.now().After(entry.expires) {
+		c.misses.Inc(1)
+		return Document{}, false
+	}
+
+	c.hits.Inc(1)
+	return *entry.doc, true
+}
+
+func (c *readCache) put(table string, key string, doc Document, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	k := cacheKey{table, key}
+	if entry, found := c.entries.Peek(k); found && entry.doc == nil && entry.hash != doc.Hash && c.now().Before(entry.expires) {
+		// the document was read before a local write of a different version had been committed
+		return
+	}
+
+	c.entries.Add(k, cacheEntry{hash: doc.Hash, doc: &doc, expires: c.now().Add(ttl)})
+}
+
+// invalidate removes the cached document after a local write. If the hash of the written document is known,
+// only that version of the document can be cached until the TTL expires.
+func (c *readCache) invalidate(table string, key string, hash string, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	k := cacheKey{table, key}
+	if hash == "" {
+		c.entries.Remove(k)
+		return
+	}
+
+	c.entries.Add(k, cacheEntry{hash: hash, expires: c.now().Add(ttl)})
+}
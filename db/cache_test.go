@@ -0,0 +1,98 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func newTestReadCache(t *testing.T, size int) (*readCache, *fakeClock, metrics.Registry) {
+	registry := metrics.NewRegistry()
+	cache, err := newReadCache(size, registry)
+	require.NoError(t, err)
+
+	clock := &fakeClock{time.Now()}
+	cache.now = clock.now
+	return cache, clock, registry
+}
+
+func TestReadCacheHitAndMiss(t *testing.T) {
+	cache, _, registry := newTestReadCache(t, 10)
+
+	_, found := cache.get(testTable, "1234")
+	assert.False(t, found)
+
+	cache.put(testTable, "1234", NewDocumentWithHash([]byte(`{"foo":"bar"}`), "hash1"), time.Minute)
+	doc, found := cache.get(testTable, "1234")
+	assert.True(t, found)
+	assert.Equal(t, "hash1", doc.Hash)
+
+	_, found = cache.get(testTableWithMetadata, "1234")
+	assert.False(t, found, "entries are keyed by table")
+
+	assert.Equal(t, int64(1), registry.Get(cacheHitsMetric).(metrics.Counter).Count())
+	assert.Equal(t, int64(2), registry.Get(cacheMissesMetric).(metrics.Counter).Count())
+}
+
+func TestReadCacheExpiry(t *testing.T) {
+	cache, clock, _ := newTestReadCache(t, 10)
+
+	cache.put(testTable, "1234", NewDocumentWithHash([]byte(`{"foo":"bar"}`), "hash1"), time.Minute)
+	clock.t = clock.t.Add(2 * time.Minute)
+
+	_, found := cache.get(testTable, "1234")
+	assert.False(t, found)
+}
+
+func TestReadCacheIsBounded(t *testing.T) {
+	cache, _, _ := newTestReadCache(t, 2)
+
+	for _, key := range []string{"1", "2", "3"} {
+		cache.put(testTable, key, NewDocumentWithHash([]byte(`{}`), key), time.Minute)
+	}
+
+	_, found := cache.get(testTable, "1")
+	assert.False(t, found, "least recently used entry is evicted")
+	_, found = cache.get(testTable, "3")
+	assert.True(t, found)
+}
+
+func TestReadCacheInvalidate(t *testing.T) {
+	cache, clock, _ := newTestReadCache(t, 10)
+
+	cache.put(testTable, "1234", NewDocumentWithHash([]byte(`{"foo":"bar"}`), "hash1"), time.Minute)
+	cache.invalidate(testTable, "1234", "hash2", time.Minute)
+
+	_, found := cache.get(testTable, "1234")
+	assert.False(t, found)
+
+	cache.put(testTable, "1234", NewDocumentWithHash([]byte(`{"foo":"bar"}`), "hash1"), time.Minute)
+	_, found = cache.get(testTable, "1234")
+	assert.False(t, found, "a read that started before the write is not cached")
+
+	cache.put(testTable, "1234", NewDocumentWithHash([]byte(`{"foo":"baz"}`), "hash2"), time.Minute)
+	doc, found := cache.get(testTable, "1234")
+	assert.True(t, found)
+	assert.Equal(t, "hash2", doc.Hash)
+
+	cache.invalidate(testTable, "1234", "hash3", time.Minute)
+	clock.t = clock.t.Add(2 * time.Minute)
+	cache.put(testTable, "1234", NewDocumentWithHash([]byte(`{"foo":"bar"}`), "hash1"), time.Minute)
+	_, found = cache.get(testTable, "1234")
+	assert.True(t, found, "the written hash is only enforced until the TTL expires")
+
+	cache.invalidate(testTable, "1234", "", time.Minute)
+	_, found = cache.get(testTable, "1234")
+	assert.False(t, found)
+}
@@ -0,0 +1,170 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	changeSequenceTable = "change_sequence"
+	changeSeqColumn     = "change_seq"
+)
+
+// changePollInterval is how often a long poll checks the database for changes written by other instances of the service.
+// Changes written by this instance wake the poll immediately.
+var changePollInterval = time.Second
+
+// Change is the latest change of a document in a change feed.
+type Change struct {
+	Key  string `json:"key"`
+	Hash string `json:"hash"`
+	Seq  int64  `json:"seq"`
+	// Metadata has the configured response headers of the document
+	Metadata DocMetadata `json:"metadata,omitempty"`
+}
+
+// ChangeFeed lists the documents of a table that have changed after a sequence number.
+type ChangeFeed interface {
+	// Changes returns up to limit changes with a sequence number greater than since, in sequence order.
+	// If there are none, it waits for up to wait for a change.
+	Changes(ctx context.Context, table string, since int64, limit int, wait time.Duration) ([]Change, error)
+	// ChangeSeq returns the sequence number of the latest change of the table, from which only new changes are listed.
+	ChangeSeq(ctx context.Context, table string) (int64, error)
+}
+
+// changeBus is the in-process bus that the write path publishes to when this instance writes a change.
+// It wakes the subscribers of the table, which read the changes from the change sequence,
+// so that they see the changes in sequence order, whichever instance wrote them.
+type changeBus struct {
+	sync.Mutex
+	subscribers map[string]chan struct{}
+}
+
+// subscribe returns a channel that is closed at the next change of the table.
+func (b *changeBus) subscribe(table string) <-chan struct{} {
+	b.Lock()
+	defer b.Unlock()
+	if b.subscribers == nil {
+		b.subscribers = make(map[string]chan struct{})
+	}
+	ch, found := b.subscribers[table]
+	if !found {
+		ch = make(chan struct{})
+		b.subscribers[table] = ch
+	}
+	return ch
+}
+
+func (b *changeBus) publish(table string) {
+	b.Lock()
+	defer b.Unlock()
+	if ch, found := b.subscribers[table]; found {
+		close(ch)
+		delete(b.subscribers, table)
+	}
+}
+
+// recordChangeSeq assigns the next sequence number of the table to the written document, in the write's transaction.
+func (service *AuroraRWService) recordChangeSeq(ctx context.Context, ex executor, t table, key string) error {
+	if _, err := ex.exec(ctx, service.dialect.nextChangeSeqSQL(), t.name); err != nil {
+		buildLogEntryFromContext(ctx).WithError(err).Error("unable to increment change sequence")
+		return err
+	}
+
+	_, err := ex.exec(ctx, t.changeSeqSQL, t.name, key)
+	if err != nil {
+		buildLogEntryFromContext(ctx).WithError(err).Error("unable to record change sequence")
+	}
+	return err
+}
+
+func (service *AuroraRWService) changeFeedTable(tableName string) (table, error) {
+	t, found := service.rwConfig[tableName]
+	if !found || !t.changeFeed {
+		return table{}, fmt.Errorf("change feed is not configured for table %s", tableName)
+	}
+	return t, nil
+}
+
+func (service *AuroraRWService) Changes(ctx context.Context, tableName string, since int64, limit int, wait time.Duration) ([]Change, error) {
+	t, err := service.changeFeedTable(tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		// the subscription is taken before the query, so that a change committed during the query is not missed
+		signal := service.changes.subscribe(tableName)
+
+		changes, err := service.readChanges(ctx, t, since, limit)
+		if err != nil || len(changes) > 0 {
+			return changes, err
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return changes, nil
+		}
+		if remaining > changePollInterval {
+			remaining = changePollInterval
+		}
+
+		timer := time.NewTimer(remaining)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-signal:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+func (service *AuroraRWService) readChanges(ctx context.Context, t table, since int64, limit int) ([]Change, error) {
+	rows, err := service.writer.db().QueryContext(ctx, t.changesSQL, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// the key, hash and sequence number are followed by the columns for the response headers
+	changes := []Change{}
+	for rows.Next() {
+		var c Change
+		headerValues := make([]string, len(t.readHeaders))
+		vals := []interface{}{&c.Key, &c.Hash, &c.Seq}
+		for i := range headerValues {
+			vals = append(vals, &headerValues[i])
+		}
+		if err := rows.Scan(vals...); err != nil {
+			return nil, err
+		}
+		if len(t.readHeaders) > 0 {
+			c.Metadata = DocMetadata{}
+			for i, header := range t.readHeaders {
+				c.Metadata.Set(header, headerValues[i])
+			}
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+func (service *AuroraRWService) ChangeSeq(ctx context.Context, tableName string) (int64, error) {
+	if _, err := service.changeFeedTable(tableName); err != nil {
+		return 0, err
+	}
+
+	var seq int64
+	err := service.writer.db().QueryRowContext(ctx, service.dialect.rebind("SELECT seq FROM "+changeSequenceTable+" WHERE table_name = ?"), tableName).Scan(&seq)
+	if err == sql.ErrNoRows {
+		// the table has no changes yet
+		return 0, nil
+	}
+	return seq, err
+}
@@ -0,0 +1,150 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTable has a change feed in the test configuration
+func newTestChangeFeedService(t *testing.T) *AuroraRWService {
+	return newTestSQLiteService(t, readTestConfig(t))
+}
+
+func writeTestDocument(t *testing.T, service *AuroraRWService, key string, body string) string {
+	_, docHash, err := service.Write(context.Background(), testTable, key, NewDocument([]byte(body)), map[string]string{"id": key}, "")
+	require.NoError(t, err)
+	return docHash
+}
+
+func TestChanges(t *testing.T) {
+	service := newTestChangeFeedService(t)
+
+	writeTestDocument(t, service, "1", `{"foo":"bar"}`)
+	hash2 := writeTestDocument(t, service, "2", `{"foo":"bar"}`)
+	hash1 := writeTestDocument(t, service, "1", `{"foo":"baz"}`)
+	writeTestDocument(t, service, "2", `{"foo":"bar"}`)
+
+	changes, err := service.Changes(context.Background(), testTable, 0, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, changes, 2, "only the latest change of each document")
+	assert.Equal(t, Change{Key: "2", Hash: hash2, Seq: 2}, changes[0])
+	assert.Equal(t, Change{Key: "1", Hash: hash1, Seq: 3}, changes[1], "an unchanged document does not move in the feed")
+
+	changes, err = service.Changes(context.Background(), testTable, 2, 10, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []Change{{Key: "1", Hash: hash1, Seq: 3}}, changes)
+
+	changes, err = service.Changes(context.Background(), testTable, 0, 1, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []Change{{Key: "2", Hash: hash2, Seq: 2}}, changes)
+
+	changes, err = service.Changes(context.Background(), testTable, 3, 10, 0)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+	assert.NotNil(t, changes, "no changes is an empty list")
+}
+
+func TestChangesNotConfigured(t *testing.T) {
+	service := newTestChangeFeedService(t)
+
+	_, err := service.Changes(context.Background(), testTableWithConflictDetection, 0, 10, 0)
+	assert.EqualError(t, err, "change feed is not configured for table draft_annotations")
+}
+
+func TestChangesLongPoll(t *testing.T) {
+	service := newTestChangeFeedService(t)
+
+	time.AfterFunc(50*time.Millisecond, func() {
+		writeTestDocument(t, service, "1", `{"foo":"bar"}`)
+	})
+
+	start := time.Now()
+	changes, err := service.Changes(context.Background(), testTable, 0, 10, 5*time.Second)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	assert.Equal(t, "1", changes[0].Key)
+	assert.True(t, time.Since(start) < time.Second, "a change written by the service wakes the poll")
+}
+
+func TestChangesLongPollTimeout(t *testing.T) {
+	service := newTestChangeFeedService(t)
+
+	start := time.Now()
+	changes, err := service.Changes(context.Background(), testTable, 0, 10, 100*time.Millisecond)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+	assert.True(t, time.Since(start) >= 100*time.Millisecond)
+}
+
+func TestChangesLongPollFindsChangesFromOtherInstances(t *testing.T) {
+	defer func(interval time.Duration) { changePollInterval = interval }(changePollInterval)
+	changePollInterval = 20 * time.Millisecond
+
+	service := newTestChangeFeedService(t)
+
+	// a write by another instance does not signal this one, so the poll finds it in the database
+	time.AfterFunc(50*time.Millisecond, func() {
+		service.writer.db().Exec("INSERT INTO published_annotations (uuid, hash, change_seq) VALUES ('1', 'abc', 1)")
+	})
+
+	changes, err := service.Changes(context.Background(), testTable, 0, 10, 5*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, []Change{{Key: "1", Hash: "abc", Seq: 1}}, changes)
+}
+
+func TestChangesCancelled(t *testing.T) {
+	service := newTestChangeFeedService(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := service.Changes(ctx, testTable, 0, 10, 5*time.Second)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestChangesWithMetadata(t *testing.T) {
+	service := newTestChangeFeedService(t)
+
+	doc := NewDocument([]byte(`{"foo":"bar"}`))
+	doc.Metadata.Set(timestampMetadata, "2026-10-18T10:00:00.000Z")
+	doc.Metadata.Set("x-request-id", "tid_test")
+	doc.Metadata.Set("x-origin-system-id", "test-system")
+	doc.Metadata.Set("content-type", "application/json")
+	_, docHash, err := service.Write(context.Background(), testTableWithMetadata, "1", doc, map[string]string{"id": "1"}, "")
+	require.NoError(t, err)
+
+	changes, err := service.Changes(context.Background(), testTableWithMetadata, 0, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	assert.Equal(t, Change{Key: "1", Hash: docHash, Seq: 1, Metadata: DocMetadata{
+		"Content-Type":          "application/json",
+		"Last-Modified-RFC3339": "2026-10-18T10:00:00.000Z",
+		"Write-Request-Id":      "tid_test",
+		"X-Origin-System-Id":    "test-system",
+	}}, changes[0], "the change has the response headers of the document")
+}
+
+func TestChangeSeq(t *testing.T) {
+	service := newTestChangeFeedService(t)
+
+	seq, err := service.ChangeSeq(context.Background(), testTable)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), seq, "a table without changes")
+
+	writeTestDocument(t, service, "1", `{"foo":"bar"}`)
+	writeTestDocument(t, service, "2", `{"foo":"bar"}`)
+
+	seq, err = service.ChangeSeq(context.Background(), testTable)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), seq)
+
+	changes, err := service.Changes(context.Background(), testTable, seq, 10, 0)
+	require.NoError(t, err)
+	assert.Empty(t, changes, "only new changes are listed after the latest sequence number")
+
+	_, err = service.ChangeSeq(context.Background(), testTableWithConflictDetection)
+	assert.EqualError(t, err, "change feed is not configured for table draft_annotations")
+}
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+
+	// compressed documents are stored base64 encoded in text columns, after a marker that starts with the
+	// ASCII unit separator, which cannot be the start of a JSON or text document
+	compressionMarker = "\x1f"
+	gzipPrefix        = compressionMarker + "gzip:"
+	zstdPrefix        = compressionMarker + "zstd:"
+)
+
+var (
+	// the encoder and decoder are safe for concurrent use of EncodeAll and DecodeAll, and cannot fail without options
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+func isSupportedCompression(compression string) bool {
+	return compression == "" || compression == compressionGzip || compression == compressionZstd
+}
+
+// compressBody returns the value to store for a document body, compressed as configured for the table.
+func compressBody(compression string, body []byte) (string, error) {
+	var prefix string
+	var compressed []byte
+	switch compression {
+	case "":
+		return string(body), nil
+
+	case compressionGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return "", err
+		}
+		if err := w.Close(); err != nil {
+			return "", err
+		}
+		prefix, compressed = gzipPrefix, buf.Bytes()
+
+	case compressionZstd:
+		prefix, compressed = zstdPrefix, zstdEncoder.EncodeAll(body, nil)
+
+	default:
+		return "", fmt.Errorf("unsupported compression %s", compression)
+	}
+
+	return prefix + base64.StdEncoding.EncodeToString(compressed), nil
+}
+
+// decompressBody returns the document body for a stored value, which may or may not have been compressed.
+func decompressBody(stored string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(stored, gzipPrefix):
+		compressed, err := base64.StdEncoding.DecodeString(stored[len(gzipPrefix):])
+		if err != nil {
+			return nil, err
+		}
+		r, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+
+	case strings.HasPrefix(stored, zstdPrefix):
+		compressed, err := base64.StdEncoding.DecodeString(stored[len(zstdPrefix):])
+		if err != nil {
+			return nil, err
+		}
+		return zstdDecoder.DecodeAll(compressed, nil)
+
+	default:
+		return []byte(stored), nil
+	}
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testCompressibleBody = `{"annotations":[{"predicate":"http://www.ft.com/ontology/annotation/mentions","id":"http://www.ft.com/thing/1"},{"predicate":"http://www.ft.com/ontology/annotation/mentions","id":"http://www.ft.com/thing/2"}]}`
+
+func TestCompressBody(t *testing.T) {
+	tests := map[string]string{
+		compressionGzip: gzipPrefix,
+		compressionZstd: zstdPrefix,
+	}
+
+	for compression, expectedPrefix := range tests {
+		stored, err := compressBody(compression, []byte(testCompressibleBody))
+		require.NoError(t, err, compression)
+		assert.True(t, strings.HasPrefix(stored, expectedPrefix), compression)
+
+		body, err := decompressBody(stored)
+		require.NoError(t, err, compression)
+		assert.Equal(t, testCompressibleBody, string(body), compression)
+	}
+}
+
+func TestCompressBodyUncompressed(t *testing.T) {
+	stored, err := compressBody("", []byte(testCompressibleBody))
+	require.NoError(t, err)
+	assert.Equal(t, testCompressibleBody, stored)
+
+	body, err := decompressBody(stored)
+	require.NoError(t, err)
+	assert.Equal(t, testCompressibleBody, string(body))
+}
+
+func TestDecompressBodyBase64Text(t *testing.T) {
+	for _, stored := range []string{"H4sIAAAAAAAA", "KLUv/QBYAAA="} {
+		body, err := decompressBody(stored)
+		require.NoError(t, err, "a document that looks like base64 encoded compressed data is stored as it is")
+		assert.Equal(t, stored, string(body))
+	}
+}
+
+func TestCompressBodyUnsupported(t *testing.T) {
+	_, err := compressBody("lz4", []byte(testCompressibleBody))
+	assert.EqualError(t, err, "unsupported compression lz4")
+	assert.False(t, isSupportedCompression("lz4"))
+}
+
+func TestDecompressBodyCorrupt(t *testing.T) {
+	_, err := decompressBody(gzipPrefix + "not-base64!")
+	assert.Error(t, err)
+}
@@ -1,27 +1,125 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 	log "github.com/sirupsen/logrus"
 )
 
-func Connect(dbUrl string, maxConnections int) (*sql.DB, error) {
-	i := strings.Index(dbUrl, ":")
-	j := strings.Index(dbUrl, "@")
-	log.Infof("Connecting to %s:********@%s", dbUrl[:i], dbUrl[j+1:])
+// PoolConfig configures the connection pool of a database, and the timeouts of its connections.
+// Zero values leave the database/sql or driver defaults in place.
+type PoolConfig struct {
+	MaxOpenConnections int
+	MaxIdleConnections int
+	// ConnMaxLifetime closes connections after this long, so that they are re-established after a failover
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+	DialTimeout     time.Duration
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+}
+
+func Connect(dbUrl string, pool PoolConfig) (*sql.DB, error) {
+	driverName, dsn := driverFor(dbUrl)
+	switch driverName {
+	case sqliteDriver:
+		log.Infof("Connecting to SQLite database %s", dsn)
+		// SQLite allows a single writer, and every connection to an in-memory database has its own data
+		pool.MaxOpenConnections = 1
+
+	case postgresDriver:
+		// only the host and database are logged, never the credentials
+		if u, err := url.Parse(dsn); err == nil {
+			log.Infof("Connecting to PostgreSQL database %s at %s", strings.TrimPrefix(u.Path, "/"), u.Host)
+		} else {
+			log.Info("Connecting to PostgreSQL")
+		}
+		dsn = withPostgresTimeouts(dsn, pool)
 
-	db, err := sql.Open("mysql", dbUrl)
+	default:
+		if cfg, err := mysql.ParseDSN(dsn); err == nil {
+			log.Infof("Connecting to MySQL database %s at %s", cfg.DBName, cfg.Addr)
+		} else {
+			log.Info("Connecting to MySQL")
+		}
+		dsn = withMySQLTimeouts(dsn, pool)
+	}
 
-	if err == nil {
-		err = db.Ping() // force a meaningful connection check
-		// we may return a *sql.DB even when there seems to be a connection error - it might recover
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		// the connection URL is invalid
+		return nil, err
 	}
 
-	log.Infof("Maximum DB connections = %v", maxConnections)
-	db.SetMaxOpenConns(maxConnections)
+	// force a meaningful connection check, but return the *sql.DB even if it fails - it reconnects when the database is available
+	ctx, cancel := context.WithTimeout(context.Background(), monitorTimeout)
+	err = db.PingContext(ctx)
+	cancel()
+
+	log.WithFields(log.Fields{
+		"maxOpenConnections": pool.MaxOpenConnections,
+		"maxIdleConnections": pool.MaxIdleConnections,
+		"connMaxLifetime":    pool.ConnMaxLifetime,
+		"connMaxIdleTime":    pool.ConnMaxIdleTime,
+	}).Info("DB connection pool configured")
+	db.SetMaxOpenConns(pool.MaxOpenConnections)
+	if pool.MaxIdleConnections > 0 {
+		db.SetMaxIdleConns(pool.MaxIdleConnections)
+	}
+	db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(pool.ConnMaxIdleTime)
 
 	return db, err
 }
+
+// withMySQLTimeouts sets the dial, read and write timeouts of a MySQL DSN, unless the DSN is invalid.
+func withMySQLTimeouts(dsn string, pool PoolConfig) string {
+	if pool.DialTimeout <= 0 && pool.ReadTimeout <= 0 && pool.WriteTimeout <= 0 {
+		return dsn
+	}
+
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		// sql.Open reports the invalid DSN
+		return dsn
+	}
+
+	if pool.DialTimeout > 0 {
+		cfg.Timeout = pool.DialTimeout
+	}
+	if pool.ReadTimeout > 0 {
+		cfg.ReadTimeout = pool.ReadTimeout
+	}
+	if pool.WriteTimeout > 0 {
+		cfg.WriteTimeout = pool.WriteTimeout
+	}
+	return cfg.FormatDSN()
+}
+
+// withPostgresTimeouts sets the connect timeout of a PostgreSQL URL. The pq driver has no read or write timeouts,
+// so queries are bounded by the request context instead.
+func withPostgresTimeouts(dsn string, pool PoolConfig) string {
+	if pool.DialTimeout <= 0 {
+		return dsn
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return dsn
+	}
+
+	// connect_timeout is in whole seconds, and 0 means no timeout
+	seconds := int((pool.DialTimeout + time.Second - 1) / time.Second)
+	q := u.Query()
+	q.Set("connect_timeout", strconv.Itoa(seconds))
+	u.RawQuery = q.Encode()
+	return u.String()
+}
@@ -0,0 +1,136 @@
+package db
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	EngineMySQL    = "mysql"
+	EnginePostgres = "postgres"
+)
+
+// Credentials are the settings to connect to a database whose password is read from a file, such as a mounted secret,
+// so that the password can be rotated without a redeploy.
+type Credentials struct {
+	Engine       string
+	Host         string
+	User         string
+	Database     string
+	PasswordFile string
+}
+
+// URL reads the current password and returns the connection URL for Connect.
+func (c Credentials) URL() (string, error) {
+	password, err := readPasswordFile(c.PasswordFile)
+	if err != nil {
+		return "", err
+	}
+
+	switch c.Engine {
+	case EnginePostgres:
+		u := url.URL{Scheme: "postgres", User: url.UserPassword(c.User, password), Host: c.Host, Path: "/" + c.Database}
+		return u.String(), nil
+
+	case EngineMySQL, "":
+		cfg := mysql.Config{User: c.User, Passwd: password, Net: "tcp", Addr: c.Host, DBName: c.Database}
+		return cfg.FormatDSN(), nil
+
+	default:
+		return "", fmt.Errorf("unsupported database engine %s", c.Engine)
+	}
+}
+
+// readPasswordFile reads a password, ignoring the trailing newline that secret files often have.
+// The error does not include the file contents.
+func readPasswordFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("unable to read database password file: %w", err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// fileDigest returns a digest of the file contents, so that a change can be detected without keeping the password.
+func fileDigest(path string) ([sha256.Size]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(b), nil
+}
+
+// WithPasswordFile polls the password file at the interval, and reconnects the connection pools when it changes.
+// In-flight requests finish on the old pools, which are then closed.
+// The pools are recreated with the functions set by WithReconnect and WithReaderReconnect.
+func WithPasswordFile(path string, interval time.Duration) Option {
+	return func(service *AuroraRWService) {
+		service.passwordFile = path
+		service.passwordPollInterval = interval
+	}
+}
+
+// watchPasswordFile starts to reconnect the connection pools whenever the contents of the password file change,
+// until the service is closed.
+func (service *AuroraRWService) watchPasswordFile() {
+	// the password the pools were opened with is read now, so that a change straight after startup is not missed
+	current, err := fileDigest(service.passwordFile)
+	if err != nil {
+		log.WithError(err).WithField("file", service.passwordFile).Warn("unable to read database password file")
+	}
+
+	go service.pollPasswordFile(current)
+}
+
+func (service *AuroraRWService) pollPasswordFile(current [sha256.Size]byte) {
+	passwordLog := log.WithField("file", service.passwordFile)
+	for {
+		select {
+		case <-service.done:
+			return
+		case <-time.After(service.passwordPollInterval):
+		}
+
+		digest, err := fileDigest(service.passwordFile)
+		if err != nil {
+			passwordLog.WithError(err).Warn("unable to read database password file")
+			continue
+		}
+		if digest == current {
+			continue
+		}
+
+		passwordLog.Info("database password has changed, reconnecting")
+		if err := service.reconnect(); err != nil {
+			// the new password may not be active yet, so the old pools are kept and the change is retried
+			passwordLog.WithError(err).Error("unable to reconnect with the new database password")
+			continue
+		}
+		current = digest
+	}
+}
+
+// reconnect replaces the writer and reader connection pools. A pool that cannot connect is left as it was.
+func (service *AuroraRWService) reconnect() error {
+	var errs []string
+	for _, p := range []*pool{service.writer, service.reader} {
+		if p == nil || p.open == nil {
+			continue
+		}
+		if err := p.reconnect(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("unable to reconnect to database: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,395 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	mysqlDriver    = "mysql"
+	postgresDriver = "postgres"
+	sqliteDriver   = "sqlite3"
+
+	sqliteScheme = "sqlite://"
+
+	mysqlDuplicateEntry  = 1062
+	mysqlLockWaitTimeout = 1205
+	mysqlDeadlock        = 1213
+	mysqlReadOnly        = 1290 // ER_OPTION_PREVENTS_STATEMENT, e.g. --read-only after an Aurora failover
+
+	pqUniqueViolation      = "23505"
+	pqReadOnlyTransaction  = "25006"
+	pqSerializationFailure = "40001"
+	pqDeadlockDetected     = "40P01"
+	pqConnectionException  = "08"
+)
+
+// dialect isolates the SQL that differs between the database engines supported by this service.
+type dialect interface {
+	// name is the dialect name understood by goose
+	name() string
+	// rebind rewrites the ? placeholders in a statement into the form expected by the driver
+	rebind(stmt string) string
+	// upsertSQL returns the statement that inserts a row for a table, or updates it if the primary key already exists
+	upsertSQL(t table) string
+	// upsert executes the upsert statement with the values for the table's columns, and reports whether the row was created or updated
+	upsert(ctx context.Context, ex executor, t table, key string, values []interface{}) (WriteStatus, error)
+	// isUniqueViolation is true for an error from inserting a row whose primary key already exists
+	isUniqueViolation(err error) bool
+	// isTransient is true for an error that may not recur if the transaction is retried,
+	// such as a deadlock, a lock wait timeout, a read-only instance after a failover or a lost connection
+	isTransient(err error) bool
+	// isReadOnly is true for an error from writing to a read-only instance
+	isReadOnly(err error) bool
+	// readOnlyQuery returns 1 if the connected instance is read-only, and 0 otherwise
+	readOnlyQuery() string
+	// forUpdate is appended to a SELECT to lock the rows that it reads until the end of the transaction
+	forUpdate() string
+	// nextChangeSeqSQL increments the change sequence of a table, creating it if necessary.
+	// The sequence row stays locked until the end of the transaction, so the sequence numbers are committed in order.
+	nextChangeSeqSQL() string
+	// lockQuery tries to take the named migration lock for the session without waiting, returning 1 if it was taken.
+	// The lock is held until it is released by releaseLockQuery on the same session, or the session ends.
+	lockQuery() string
+	releaseLockQuery() string
+	// ddl adapts a schema migration statement to the dialect
+	ddl(stmt string) string
+	// columnsQuery returns the table name, column name, data type and whether it is in the primary key
+	// of every column in the connected schema
+	columnsQuery() string
+	// createsTablesFromMapping is true if the tables are created from the configured column mapping rather than by migrations
+	createsTablesFromMapping() bool
+}
+
+// driverFor returns the database/sql driver name and data source name for a connection URL.
+// URLs with a postgres:// or postgresql:// scheme are PostgreSQL, sqlite:// URLs are a path to a SQLite database file,
+// and anything else is a MySQL DSN.
+func driverFor(dbUrl string) (string, string) {
+	if strings.HasPrefix(dbUrl, "postgres://") || strings.HasPrefix(dbUrl, "postgresql://") {
+		return postgresDriver, dbUrl
+	}
+
+	if strings.HasPrefix(dbUrl, sqliteScheme) {
+		return sqliteDriver, dbUrl[len(sqliteScheme):]
+	}
+
+	return mysqlDriver, dbUrl
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+func dialectFor(conn *sql.DB) dialect {
+	if conn != nil {
+		switch conn.Driver().(type) {
+		case *pq.Driver:
+			return postgresDialect{}
+		case *sqlite3.SQLiteDriver:
+			return sqliteDialect{}
+		}
+	}
+
+	return mysqlDialect{}
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) name() string {
+	return "mysql"
+}
+
+func (mysqlDialect) rebind(stmt string) string {
+	return stmt
+}
+
+func (mysqlDialect) upsertSQL(t table) string {
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON DUPLICATE KEY UPDATE %s",
+		t.name, strings.Join(t.valueColumns, ","), placeholders(len(t.valueColumns)), strings.Join(t.valueColumns, "=?,")+"=?")
+}
+
+func (mysqlDialect) upsert(ctx context.Context, ex executor, t table, key string, values []interface{}) (WriteStatus, error) {
+	res, err := ex.exec(ctx, t.upsertSQL, append(values, values...)...)
+	if err != nil {
+		return Updated, err
+	}
+
+	// MySQL reports one affected row for an insert, and two for an update
+	if n, _ := res.RowsAffected(); n == 1 {
+		return Created, nil
+	}
+	return Updated, nil
+}
+
+func (mysqlDialect) isTransient(err error) bool {
+	if err == driver.ErrBadConn || err == mysql.ErrInvalidConn {
+		return true
+	}
+
+	mysqlErr, ok := err.(*mysql.MySQLError)
+	if !ok {
+		return false
+	}
+	switch mysqlErr.Number {
+	case mysqlDeadlock, mysqlLockWaitTimeout, mysqlReadOnly:
+		return true
+	}
+	return false
+}
+
+func (mysqlDialect) isReadOnly(err error) bool {
+	mysqlErr, ok := err.(*mysql.MySQLError)
+	return ok && mysqlErr.Number == mysqlReadOnly
+}
+
+func (mysqlDialect) readOnlyQuery() string {
+	return "SELECT @@innodb_read_only"
+}
+
+func (mysqlDialect) isUniqueViolation(err error) bool {
+	mysqlErr, ok := err.(*mysql.MySQLError)
+	return ok && mysqlErr.Number == mysqlDuplicateEntry
+}
+
+func (mysqlDialect) forUpdate() string {
+	return " FOR UPDATE"
+}
+
+func (mysqlDialect) nextChangeSeqSQL() string {
+	return "INSERT INTO change_sequence (table_name, seq) VALUES (?, 1) ON DUPLICATE KEY UPDATE seq = seq + 1"
+}
+
+func (mysqlDialect) lockQuery() string {
+	return "SELECT get_lock(?, 0)"
+}
+
+func (mysqlDialect) releaseLockQuery() string {
+	return "SELECT release_lock(?)"
+}
+
+func (mysqlDialect) ddl(stmt string) string {
+	return stmt
+}
+
+func (mysqlDialect) columnsQuery() string {
+	return "SELECT table_name, column_name, column_type, column_key = 'PRI' FROM information_schema.columns WHERE table_schema = database()"
+}
+
+func (mysqlDialect) createsTablesFromMapping() bool {
+	return false
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) name() string {
+	return "postgres"
+}
+
+func (postgresDialect) rebind(stmt string) string {
+	var b strings.Builder
+	n := 0
+	for _, c := range stmt {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		} else {
+			b.WriteRune(c)
+		}
+	}
+
+	return b.String()
+}
+
+func (d postgresDialect) upsertSQL(t table) string {
+	var set []string
+	for _, col := range t.valueColumns {
+		set = append(set, fmt.Sprintf("%s=EXCLUDED.%s", col, col))
+	}
+
+	// xmax is only zero for a row version that has been freshly inserted
+	return d.rebind(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) DO UPDATE SET %s RETURNING (xmax = 0)",
+		t.name, strings.Join(t.valueColumns, ","), placeholders(len(t.valueColumns)), t.primaryKey, strings.Join(set, ",")))
+}
+
+func (postgresDialect) upsert(ctx context.Context, ex executor, t table, key string, values []interface{}) (WriteStatus, error) {
+	rows, err := ex.query(ctx, t.upsertSQL, values...)
+	if err != nil {
+		return Updated, err
+	}
+	defer rows.Close()
+
+	var created bool
+	if rows.Next() {
+		err = rows.Scan(&created)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	if created {
+		return Created, err
+	}
+	return Updated, err
+}
+
+func (postgresDialect) isTransient(err error) bool {
+	if err == driver.ErrBadConn {
+		return true
+	}
+
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		return false
+	}
+	switch pqErr.Code {
+	case pqSerializationFailure, pqDeadlockDetected, pqReadOnlyTransaction:
+		return true
+	}
+	return pqErr.Code.Class() == pqConnectionException
+}
+
+func (postgresDialect) isReadOnly(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == pqReadOnlyTransaction
+}
+
+func (postgresDialect) readOnlyQuery() string {
+	return "SELECT CASE WHEN pg_is_in_recovery() THEN 1 ELSE 0 END"
+}
+
+func (postgresDialect) isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == pqUniqueViolation
+}
+
+func (postgresDialect) forUpdate() string {
+	return " FOR UPDATE"
+}
+
+func (postgresDialect) nextChangeSeqSQL() string {
+	return "INSERT INTO change_sequence (table_name, seq) VALUES ($1, 1) ON CONFLICT (table_name) DO UPDATE SET seq = change_sequence.seq + 1"
+}
+
+func (postgresDialect) lockQuery() string {
+	return "SELECT CASE WHEN pg_try_advisory_lock(hashtext($1)) THEN 1 ELSE 0 END"
+}
+
+func (postgresDialect) releaseLockQuery() string {
+	return "SELECT CASE WHEN pg_advisory_unlock(hashtext($1)) THEN 1 ELSE 0 END"
+}
+
+// modifyColumnStatement matches a MySQL statement that changes the type of a column
+var modifyColumnStatement = regexp.MustCompile(`(?is)^(\s*alter table \S+) modify column (\S+) (.+?) not null(?: default \S+)?\s*$`)
+
+func (postgresDialect) ddl(stmt string) string {
+	stmt = strings.Replace(stmt, "bigint auto_increment primary key", "bigserial primary key", -1)
+	// the column keeps its not null constraint and default, and its values are converted to the new type
+	stmt = modifyColumnStatement.ReplaceAllString(stmt, "$1 alter column $2 type $3 using $2::$3")
+	return strings.Replace(stmt, "mediumtext", "text", -1)
+}
+
+func (postgresDialect) columnsQuery() string {
+	return `SELECT c.table_name, c.column_name,
+	CASE WHEN c.character_maximum_length IS NULL THEN c.data_type ELSE c.data_type || '(' || c.character_maximum_length || ')' END, EXISTS (
+		SELECT 1 FROM information_schema.table_constraints tc
+		JOIN information_schema.key_column_usage k
+		ON k.constraint_name = tc.constraint_name AND k.table_schema = tc.table_schema AND k.table_name = tc.table_name
+		WHERE tc.constraint_type = 'PRIMARY KEY' AND tc.table_schema = c.table_schema AND tc.table_name = c.table_name AND k.column_name = c.column_name
+	) FROM information_schema.columns c WHERE c.table_schema = current_schema()`
+}
+
+func (postgresDialect) createsTablesFromMapping() bool {
+	return false
+}
+
+// sqliteDialect supports local development and testing without a database server.
+// The tables are created from the configuration rather than by the (MySQL) schema migrations.
+type sqliteDialect struct{}
+
+func (sqliteDialect) name() string {
+	return "sqlite3"
+}
+
+func (sqliteDialect) rebind(stmt string) string {
+	return stmt
+}
+
+func (sqliteDialect) upsertSQL(t table) string {
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) DO NOTHING",
+		t.name, strings.Join(t.valueColumns, ","), placeholders(len(t.valueColumns)), t.primaryKey)
+}
+
+func (sqliteDialect) upsert(ctx context.Context, ex executor, t table, key string, values []interface{}) (WriteStatus, error) {
+	// SQLite reports one changed row for both outcomes of ON CONFLICT DO UPDATE, so insert and update separately
+	res, err := ex.exec(ctx, t.upsertSQL, values...)
+	if err != nil {
+		return Updated, err
+	}
+
+	if n, _ := res.RowsAffected(); n == 1 {
+		return Created, nil
+	}
+
+	_, err = ex.exec(ctx, t.updateByKeySQL, append(values, key)...)
+	return Updated, err
+}
+
+func (sqliteDialect) isTransient(err error) bool {
+	sqliteErr, ok := err.(sqlite3.Error)
+	return ok && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
+
+func (sqliteDialect) isReadOnly(err error) bool {
+	sqliteErr, ok := err.(sqlite3.Error)
+	return ok && sqliteErr.Code == sqlite3.ErrReadonly
+}
+
+func (sqliteDialect) readOnlyQuery() string {
+	return "SELECT 0"
+}
+
+func (sqliteDialect) isUniqueViolation(err error) bool {
+	sqliteErr, ok := err.(sqlite3.Error)
+	return ok && (sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey || sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique)
+}
+
+// SQLite locks the whole database for a write transaction, so rows are not locked individually
+func (sqliteDialect) forUpdate() string {
+	return ""
+}
+
+func (sqliteDialect) nextChangeSeqSQL() string {
+	return "INSERT INTO change_sequence (table_name, seq) VALUES (?, 1) ON CONFLICT (table_name) DO UPDATE SET seq = change_sequence.seq + 1"
+}
+
+// SQLite is an embedded, single process database, so the migration lock is a no-op
+
+func (sqliteDialect) lockQuery() string {
+	return "SELECT 1 WHERE ? IS NOT NULL"
+}
+
+func (sqliteDialect) releaseLockQuery() string {
+	return "SELECT 1 WHERE ? IS NOT NULL"
+}
+
+func (sqliteDialect) ddl(stmt string) string {
+	// only an integer primary key is assigned automatically
+	return strings.Replace(stmt, "bigint auto_increment primary key", "integer primary key autoincrement", -1)
+}
+
+// SQLite has no information_schema, so the columns are listed by the table_info pragma of each table
+func (sqliteDialect) columnsQuery() string {
+	return "SELECT m.name, p.name, p.type, p.pk > 0 FROM sqlite_master m JOIN pragma_table_info(m.name) p WHERE m.type = 'table'"
+}
+
+func (sqliteDialect) createsTablesFromMapping() bool {
+	return true
+}
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Financial-Times/generic-rw-aurora/config"
+)
+
+// tableColumnsTTL is how long the checks of the tables share the columns read by one of them,
+// so that a health check run reads the columns of the schema once rather than once per table
+var tableColumnsTTL = 10 * time.Second
+
+// tableColumns are the columns of the schema that were read by the latest table check
+type tableColumns struct {
+	sync.Mutex
+	columns map[string]map[string]columnInfo
+	readAt  time.Time
+}
+
+// TableCheck verifies that the table of a configured path exists in the database with its primary key, the columns mapped by the path
+// and the hash column, and that their types are compatible with the configuration, reporting the path of a mismatched table.
+func (service *AuroraRWService) TableCheck(path string, mapping config.Mapping) (string, error) {
+	t := newTable(path, mapping)
+	t.orderColumns()
+
+	existing, err := service.tableCheckColumns()
+	if err != nil {
+		return fmt.Sprintf("Unable to read the columns of table %s: %s", t.name, err.Error()), err
+	}
+
+	if drift := t.schemaDrift(existing[strings.ToLower(t.name)]); len(drift) > 0 {
+		return fmt.Sprintf("Table %s does not match the configuration of %s", t.name, t.path),
+			fmt.Errorf("table %s of path %s: %s", t.name, t.path, strings.Join(drift, ", "))
+	}
+	return fmt.Sprintf("Table %s matches the configuration of %s", t.name, t.path), nil
+}
+
+// tableCheckColumns returns the columns of the schema, which are read again once they are older than tableColumnsTTL
+func (service *AuroraRWService) tableCheckColumns() (map[string]map[string]columnInfo, error) {
+	service.tableColumns.Lock()
+	defer service.tableColumns.Unlock()
+
+	if service.tableColumns.columns != nil && time.Since(service.tableColumns.readAt) < tableColumnsTTL {
+		return service.tableColumns.columns, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), monitorTimeout)
+	defer cancel()
+
+	existing, err := existingColumns(ctx, service.writer.db(), service.dialect)
+	if err != nil {
+		return nil, err
+	}
+	service.tableColumns.columns, service.tableColumns.readAt = existing, time.Now()
+	return existing, nil
+}
+
+// schemaDrift describes how the columns of the table in the database differ from the configuration
+func (t *table) schemaDrift(columns map[string]columnInfo) []string {
+	if columns == nil {
+		return []string{"table does not exist"}
+	}
+
+	var drift []string
+	for _, col := range t.schemaColumns() {
+		info, found := columns[strings.ToLower(col)]
+		switch {
+		case !found:
+			drift = append(drift, fmt.Sprintf("column %s does not exist", col))
+		case typeFamily(info.dataType) != typeFamily(t.columnType(col)):
+			drift = append(drift, fmt.Sprintf("column %s is %s, expected %s", col, strings.ToLower(info.dataType), t.columnType(col)))
+		case col == t.primaryKey && !info.primaryKey:
+			drift = append(drift, fmt.Sprintf("column %s is not the primary key", col))
+		}
+	}
+	return drift
+}
+
+// typeFamily groups the SQL types that hold the same values, e.g. varchar(36) and text,
+// so that a column is compatible with the configured type whatever its length or engine-specific name.
+func typeFamily(sqlType string) string {
+	base := strings.ToLower(strings.TrimSpace(sqlType))
+	if i := strings.Index(base, "("); i >= 0 {
+		base = strings.TrimSpace(base[:i])
+	}
+
+	switch base {
+	case "char", "character", "varchar", "character varying", "text", "tinytext", "mediumtext", "longtext", "clob":
+		return "text"
+	case "tinyint", "smallint", "mediumint", "int", "integer", "bigint", "serial", "bigserial":
+		return "integer"
+	}
+	return base
+}
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Financial-Times/generic-rw-aurora/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// checkTestTable checks the table of the path that maps to it in config.yml
+func checkTestTable(t *testing.T, service *AuroraRWService, tableName string) (string, error) {
+	for path, mapping := range readTestConfig(t).Paths {
+		if mapping.Table == tableName {
+			return service.TableCheck(path, mapping)
+		}
+	}
+	t.Fatalf("table %s is not configured", tableName)
+	return "", nil
+}
+
+func TestTableCheck(t *testing.T) {
+	service := newTestChangeFeedService(t)
+
+	for path, mapping := range readTestConfig(t).Paths {
+		msg, err := service.TableCheck(path, mapping)
+		assert.NoError(t, err, path)
+		assert.Equal(t, "Table "+mapping.Table+" matches the configuration of "+path, msg)
+	}
+}
+
+func TestTableCheckMissingTable(t *testing.T) {
+	service := newTestChangeFeedService(t)
+	_, err := service.writer.db().Exec("DROP TABLE published_annotations")
+	require.NoError(t, err)
+
+	msg, err := checkTestTable(t, service, testTable)
+	assert.EqualError(t, err, "table published_annotations of path /published/content/:id/annotations: table does not exist")
+	assert.Equal(t, "Table published_annotations does not match the configuration of /published/content/:id/annotations", msg)
+
+	_, err = checkTestTable(t, service, testTableWithMetadata)
+	assert.NoError(t, err, "only the path of the missing table is reported")
+}
+
+func TestTableCheckSharesColumns(t *testing.T) {
+	service := newTestChangeFeedService(t)
+	_, err := checkTestTable(t, service, testTable)
+	require.NoError(t, err)
+
+	_, err = service.writer.db().Exec("DROP TABLE draft_content")
+	require.NoError(t, err)
+	_, err = checkTestTable(t, service, testTableWithMetadata)
+	assert.NoError(t, err, "the columns read by the previous check are shared")
+
+	service.tableColumns.readAt = time.Now().Add(-tableColumnsTTL)
+	_, err = checkTestTable(t, service, testTableWithMetadata)
+	assert.EqualError(t, err, "table draft_content of path /drafts/content/:id: table does not exist", "the columns are read again once they expire")
+}
+
+func TestTableCheckMismatchedColumns(t *testing.T) {
+	service := newTestChangeFeedService(t)
+	_, err := service.writer.db().Exec("DROP TABLE draft_content")
+	require.NoError(t, err)
+	_, err = service.writer.db().Exec("CREATE TABLE draft_content (uuid varchar(36), body text, content_type integer, draft_ref text, last_modified text, hash text, change_seq integer)")
+	require.NoError(t, err)
+
+	_, err = checkTestTable(t, service, testTableWithMetadata)
+	assert.EqualError(t, err, "table draft_content of path /drafts/content/:id: "+
+		"column uuid is not the primary key, column content_type is integer, expected varchar(128), column origin_system does not exist")
+}
+
+func TestTableCheckPathsSharingTable(t *testing.T) {
+	things := config.Mapping{
+		Table:      "things",
+		Columns:    map[string]string{"id": ":id", "body": "$"},
+		PrimaryKey: "id",
+	}
+	colouredThings := config.Mapping{
+		Table:      "things",
+		Columns:    map[string]string{"id": ":id", "body": "$", "colour": "$.colour"},
+		PrimaryKey: "id",
+	}
+	service := newTestSQLiteService(t, &config.Config{Paths: map[string]config.Mapping{"/things/:id": things}})
+
+	_, err := service.TableCheck("/things/:id", things)
+	assert.NoError(t, err)
+
+	msg, err := service.TableCheck("/coloured-things/:id", colouredThings)
+	assert.EqualError(t, err, "table things of path /coloured-things/:id: column colour does not exist", "each path is checked against its own columns")
+	assert.Equal(t, "Table things does not match the configuration of /coloured-things/:id", msg)
+}
+
+func TestTypeFamily(t *testing.T) {
+	for sqlType, family := range map[string]string{
+		"varchar(36)":       "text",
+		"character varying": "text",
+		"MEDIUMTEXT":        "text",
+		"text":              "text",
+		"bigint":            "integer",
+		"INTEGER":           "integer",
+		"int(11)":           "integer",
+		"datetime(3)":       "datetime",
+		"":                  "",
+	} {
+		assert.Equal(t, family, typeFamily(sqlType), sqlType)
+	}
+}
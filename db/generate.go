@@ -0,0 +1,212 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultColumnType   = "varchar(255)"
+	documentColumnType  = "mediumtext"
+	hashColumnType      = "varchar(56)"
+	changeSeqColumnType = "bigint"
+)
+
+// schemaChanges are the statements that create the tables and columns that are in the configuration but not in the database
+// and change the columns whose types do not match it, and the statements that roll them back, in MySQL syntax like the migrations.
+type schemaChanges struct {
+	apply    []string
+	rollback []string
+}
+
+// add adds a change and its rollback. A change without a rollback is rolled back by the rollback of an earlier change.
+func (c *schemaChanges) add(apply string, rollback string) {
+	c.apply = append(c.apply, apply)
+	if rollback != "" {
+		// the changes are rolled back in reverse order
+		c.rollback = append([]string{rollback}, c.rollback...)
+	}
+}
+
+// columnType returns the configured SQL type of a column of the table, or its default type
+func (t *table) columnType(col string) string {
+	switch col {
+	case hashColumn:
+		return hashColumnType
+	case changeSeqColumn:
+		return changeSeqColumnType
+	}
+	if typ, found := t.columnTypes[col]; found && typ != "" {
+		return typ
+	}
+	if col == t.documentColumn() {
+		return documentColumnType
+	}
+	return defaultColumnType
+}
+
+func (t *table) columnDefinition(col string) string {
+	switch {
+	case col == t.primaryKey:
+		return fmt.Sprintf("%s %s primary key", col, t.columnType(col))
+	case col == changeSeqColumn:
+		return fmt.Sprintf("%s %s not null default 0", col, t.columnType(col))
+	}
+	return fmt.Sprintf("%s %s not null", col, t.columnType(col))
+}
+
+// modifyColumn changes the type of a column of the table, keeping it not null. The dialects adapt the MySQL statement.
+func modifyColumn(t table, col string, sqlType string) string {
+	def := sqlType + " not null"
+	if col == changeSeqColumn {
+		def += " default 0"
+	}
+	return fmt.Sprintf("alter table %s modify column %s %s", t.name, col, def)
+}
+
+// schemaColumns returns the columns of the table in the database: the key, the other mapped columns in order, the hash,
+// and the change sequence if the table has a change feed
+func (t *table) schemaColumns() []string {
+	cols := []string{t.primaryKey}
+	for _, col := range t.valueColumns {
+		if col != t.primaryKey {
+			cols = append(cols, col)
+		}
+	}
+	if t.changeFeed {
+		cols = append(cols, changeSeqColumn)
+	}
+	return cols
+}
+
+// diffSchema compares the configured tables, and the outbox, change sequence and backfill checkpoint tables, with the columns in the database.
+// The columns whose type does not match the configuration are modified only if modifyColumns is set.
+func diffSchema(ctx context.Context, conn *sql.DB, d dialect, tables map[string]table, modifyColumns bool) (schemaChanges, error) {
+	var changes schemaChanges
+
+	existing, err := existingColumns(ctx, conn, d)
+	if err != nil {
+		return changes, err
+	}
+
+	var names []string
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		t := tables[name]
+		columns, found := existing[strings.ToLower(t.name)]
+		if !found {
+			var defs []string
+			for _, col := range t.schemaColumns() {
+				defs = append(defs, "\t"+t.columnDefinition(col))
+			}
+			changes.add(fmt.Sprintf("create table %s (\n%s\n)", t.name, strings.Join(defs, ",\n")), fmt.Sprintf("drop table %s", t.name))
+			if t.changeFeed {
+				addChangeSeqIndex(&changes, t)
+			}
+			continue
+		}
+
+		for _, col := range t.schemaColumns() {
+			if info, found := columns[strings.ToLower(col)]; found {
+				// the types are compared as in the table health check
+				if modifyColumns && typeFamily(info.dataType) != typeFamily(t.columnType(col)) {
+					changes.add(modifyColumn(t, col, t.columnType(col)), modifyColumn(t, col, strings.ToLower(info.dataType)))
+				}
+				continue
+			}
+			changes.add(fmt.Sprintf("alter table %s add column %s", t.name, t.columnDefinition(col)), fmt.Sprintf("alter table %s drop column %s", t.name, col))
+			if col == changeSeqColumn {
+				addChangeSeqIndex(&changes, t)
+			}
+		}
+	}
+
+	for _, stmt := range supportStatements {
+		if stmt.missing(existing) {
+			changes.add(stmt.ddl, stmt.rollback())
+		}
+	}
+
+	return changes, nil
+}
+
+// addChangeSeqIndex indexes the change sequence of a new table or column. The index is dropped with the table or column,
+// in every database, so it has no rollback of its own.
+func addChangeSeqIndex(changes *schemaChanges, t table) {
+	index := fmt.Sprintf("%s_%s", t.name, changeSeqColumn)
+	changes.add(fmt.Sprintf("create index %s on %s (%s)", index, t.name, changeSeqColumn), "")
+}
+
+// formatDDL indents a create table statement like the generated statements, without the trailing semicolon
+func formatDDL(ddl string) string {
+	lines := strings.Split(strings.TrimSuffix(strings.TrimSpace(ddl), ";"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+		if i > 0 && i < len(lines)-1 {
+			lines[i] = "\t" + lines[i]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// columnInfo is the type of a column in the database, and whether it is (part of) the primary key
+type columnInfo struct {
+	dataType   string
+	primaryKey bool
+}
+
+// existingColumns returns the columns of each table in the database, by lower case name
+func existingColumns(ctx context.Context, conn *sql.DB, d dialect) (map[string]map[string]columnInfo, error) {
+	rows, err := conn.QueryContext(ctx, d.columnsQuery())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	existing := make(map[string]map[string]columnInfo)
+	for rows.Next() {
+		var tableName, column string
+		var info columnInfo
+		if err := rows.Scan(&tableName, &column, &info.dataType, &info.primaryKey); err != nil {
+			return nil, err
+		}
+		tableName = strings.ToLower(tableName)
+		if existing[tableName] == nil {
+			existing[tableName] = make(map[string]columnInfo)
+		}
+		existing[tableName][strings.ToLower(column)] = info
+	}
+	return existing, rows.Err()
+}
+
+// createMissingTables creates the configured tables and columns that are missing from the database,
+// outside of the versioned migrations, while holding the migration lock. It never changes the type of an existing column.
+func (service *AuroraRWService) createMissingTables(ctx context.Context) error {
+	conn := service.writer.db()
+	return withMigrationLock(ctx, conn, service.dialect, service.migrationLockTimeout, func() error {
+		changes, err := diffSchema(ctx, conn, service.dialect, service.rwConfig, false)
+		if err != nil {
+			log.WithError(err).Error("unable to read database columns")
+			return err
+		}
+
+		for _, stmt := range changes.apply {
+			stmt = service.dialect.ddl(stmt)
+			log.Infof("apply: %s", stmt)
+			if _, err := conn.ExecContext(ctx, stmt); err != nil {
+				log.WithError(err).Error("unable to create missing tables")
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,152 @@
+package db
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffSchemaMatchesCreatedTables(t *testing.T) {
+	service := newTestChangeFeedService(t)
+
+	changes, err := diffSchema(context.Background(), service.writer.db(), service.dialect, service.rwConfig, true)
+	require.NoError(t, err)
+	assert.Empty(t, changes.apply)
+	assert.Empty(t, changes.rollback)
+}
+
+func TestDiffSchemaMissingTable(t *testing.T) {
+	service := newTestChangeFeedService(t)
+	_, err := service.writer.db().Exec("DROP TABLE published_annotations")
+	require.NoError(t, err)
+
+	changes, err := diffSchema(context.Background(), service.writer.db(), service.dialect, service.rwConfig, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"create table published_annotations (\n" +
+			"\tuuid varchar(36) primary key,\n" +
+			"\tbody mediumtext not null,\n" +
+			"\tlast_modified varchar(32) not null,\n" +
+			"\tpublish_ref varchar(50) not null,\n" +
+			"\thash varchar(56) not null,\n" +
+			"\tchange_seq bigint not null default 0\n" +
+			")",
+		"create index published_annotations_change_seq on published_annotations (change_seq)",
+	}, changes.apply)
+	assert.Equal(t, []string{
+		"drop table published_annotations",
+	}, changes.rollback, "the changes are rolled back in reverse order")
+}
+
+func TestDiffSchemaMissingColumns(t *testing.T) {
+	service := newTestChangeFeedService(t)
+	_, err := service.writer.db().Exec("DROP TABLE draft_content")
+	require.NoError(t, err)
+	_, err = service.writer.db().Exec("CREATE TABLE draft_content (uuid text primary key, body text, last_modified text, draft_ref text, hash text)")
+	require.NoError(t, err)
+
+	changes, err := diffSchema(context.Background(), service.writer.db(), service.dialect, service.rwConfig, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"alter table draft_content add column content_type varchar(128) not null",
+		"alter table draft_content add column origin_system varchar(50) not null",
+		"alter table draft_content add column change_seq bigint not null default 0",
+		"create index draft_content_change_seq on draft_content (change_seq)",
+	}, changes.apply)
+	assert.Equal(t, []string{
+		"alter table draft_content drop column change_seq",
+		"alter table draft_content drop column origin_system",
+		"alter table draft_content drop column content_type",
+	}, changes.rollback)
+}
+
+func TestDiffSchemaColumnTypes(t *testing.T) {
+	service := newTestChangeFeedService(t)
+	_, err := service.writer.db().Exec("DROP TABLE draft_content")
+	require.NoError(t, err)
+	_, err = service.writer.db().Exec("CREATE TABLE draft_content (uuid varchar(36) primary key, body text, last_modified integer, draft_ref text, content_type varchar(16), origin_system text, hash text, change_seq text)")
+	require.NoError(t, err)
+
+	changes, err := diffSchema(context.Background(), service.writer.db(), service.dialect, service.rwConfig, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"alter table draft_content modify column last_modified varchar(32) not null",
+		"alter table draft_content modify column change_seq bigint not null default 0",
+	}, changes.apply, "a column of the same type family, whatever its length, is not changed")
+	assert.Equal(t, []string{
+		"alter table draft_content modify column change_seq text not null default 0",
+		"alter table draft_content modify column last_modified integer not null",
+	}, changes.rollback)
+}
+
+func TestDiffSchemaMissingSupportTables(t *testing.T) {
+	service := newTestChangeFeedService(t)
+	_, err := service.writer.db().Exec("DROP TABLE change_outbox")
+	require.NoError(t, err)
+
+	changes, err := diffSchema(context.Background(), service.writer.db(), service.dialect, service.rwConfig, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		formatDDL(migrations[4].apply),
+	}, changes.apply, "the outbox is created as it is migrated")
+	assert.Equal(t, []string{"drop table change_outbox"}, changes.rollback)
+}
+
+func TestColumnType(t *testing.T) {
+	service := newTestChangeFeedService(t)
+	for _, tbl := range service.rwConfig {
+		if tbl.name != "draft_content" {
+			continue
+		}
+		assert.Equal(t, "varchar(128)", tbl.columnType("content_type"), "the configured type")
+		assert.Equal(t, "mediumtext", tbl.columnType("body"), "the document column")
+		assert.Equal(t, "varchar(56)", tbl.columnType(hashColumn))
+		assert.Equal(t, "bigint", tbl.columnType(changeSeqColumn))
+		assert.Equal(t, "varchar(255)", tbl.columnType("unconfigured"))
+		return
+	}
+	t.Fatal("draft_content is not configured")
+}
+
+func TestFormatDDL(t *testing.T) {
+	assert.Equal(t, "create table things (\n\tid varchar(36) primary key,\n\tname varchar(64) not null\n)",
+		formatDDL("\ncreate table things (\n  id varchar(36) primary key,\n      name varchar(64) not null\n);\n"))
+}
+
+func TestCreateMissingTables(t *testing.T) {
+	service := newTestChangeFeedService(t)
+	// the migration lock is held on its own session
+	service.writer.db().SetMaxOpenConns(2)
+	_, err := service.writer.db().Exec("DROP TABLE published_annotations")
+	require.NoError(t, err)
+
+	require.NoError(t, service.createMissingTables(context.Background()))
+
+	changes, err := diffSchema(context.Background(), service.writer.db(), service.dialect, service.rwConfig, true)
+	require.NoError(t, err)
+	assert.Empty(t, changes.apply)
+	writeTestDocument(t, service, "1", `{"foo":"bar"}`)
+}
+
+func TestCreateMissingTablesLeavesColumnTypes(t *testing.T) {
+	service := newTestChangeFeedService(t)
+	service.writer.db().SetMaxOpenConns(2)
+	_, err := service.writer.db().Exec("DROP TABLE draft_content")
+	require.NoError(t, err)
+	_, err = service.writer.db().Exec("CREATE TABLE draft_content (uuid varchar(36) primary key, body text, last_modified integer, draft_ref text, content_type varchar(16), hash text, change_seq bigint)")
+	require.NoError(t, err)
+
+	require.NoError(t, service.createMissingTables(context.Background()))
+
+	existing, err := existingColumns(context.Background(), service.writer.db(), service.dialect)
+	require.NoError(t, err)
+	assert.Contains(t, existing["draft_content"], "origin_system", "the missing column is added")
+	assert.Equal(t, "integer", strings.ToLower(existing["draft_content"]["last_modified"].dataType), "the mismatched type is not changed")
+
+	changes, err := diffSchema(context.Background(), service.writer.db(), service.dialect, service.rwConfig, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alter table draft_content modify column last_modified varchar(32) not null"}, changes.apply, "the type change is left to a migration")
+}
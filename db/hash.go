@@ -1,8 +1,16 @@
 package db
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
+
+	"github.com/gowebpki/jcs"
+)
+
+const (
+	hashModeRaw           = "raw"
+	hashModeCanonicalJSON = "canonical-json"
 )
 
 func hash(b []byte) string {
@@ -10,3 +18,31 @@ func hash(b []byte) string {
 	hash.Write(b)
 	return hex.EncodeToString(hash.Sum(nil))
 }
+
+func isSupportedHashMode(mode string) bool {
+	return mode == "" || mode == hashModeRaw || mode == hashModeCanonicalJSON
+}
+
+// canonicalBody returns the body that is hashed in the given mode, which is the RFC 8785 canonical form for canonical-json.
+func canonicalBody(mode string, body []byte) ([]byte, error) {
+	if mode != hashModeCanonicalJSON {
+		return body, nil
+	}
+
+	return jcs.Transform(body)
+}
+
+// hashDocument sets the hash of the document for the table's hash mode,
+// and replaces the body with its canonical form if the table stores it.
+func (t *table) hashDocument(ctx context.Context, doc Document) Document {
+	body, err := canonicalBody(t.hashMode, doc.Body)
+	if err != nil {
+		buildLogEntryFromContext(ctx).WithError(err).WithField("hashMode", t.hashMode).Warn("unable to canonicalise document, hashing the raw body")
+		body = doc.Body
+	} else if t.storeCanonical {
+		doc.Body = body
+	}
+
+	doc.Hash = hash(body)
+	return doc
+}
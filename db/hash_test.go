@@ -0,0 +1,55 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashDocumentRaw(t *testing.T) {
+	tbl := table{hashMode: hashModeRaw}
+
+	a := tbl.hashDocument(context.Background(), NewDocument([]byte(`{"foo":"bar","baz":1}`)))
+	b := tbl.hashDocument(context.Background(), NewDocument([]byte(`{ "baz": 1, "foo": "bar" }`)))
+
+	assert.Equal(t, hash([]byte(`{"foo":"bar","baz":1}`)), a.Hash)
+	assert.NotEqual(t, a.Hash, b.Hash)
+}
+
+func TestHashDocumentCanonicalJSON(t *testing.T) {
+	tbl := table{hashMode: hashModeCanonicalJSON}
+
+	a := tbl.hashDocument(context.Background(), NewDocument([]byte(`{"foo":"bar","baz":1.0}`)))
+	b := tbl.hashDocument(context.Background(), NewDocument([]byte("{\n  \"baz\": 1,\n  \"foo\": \"bar\"\n}")))
+
+	assert.Equal(t, hash([]byte(`{"baz":1,"foo":"bar"}`)), a.Hash)
+	assert.Equal(t, a.Hash, b.Hash)
+	assert.Equal(t, "{\n  \"baz\": 1,\n  \"foo\": \"bar\"\n}", string(b.Body), "body is stored as written")
+}
+
+func TestHashDocumentStoreCanonical(t *testing.T) {
+	tbl := table{hashMode: hashModeCanonicalJSON, storeCanonical: true}
+
+	doc := tbl.hashDocument(context.Background(), NewDocument([]byte(`{ "foo": "bar", "baz": [1, 2] }`)))
+
+	assert.Equal(t, `{"baz":[1,2],"foo":"bar"}`, string(doc.Body))
+	assert.Equal(t, hash(doc.Body), doc.Hash)
+}
+
+func TestHashDocumentCanonicalJSONFallsBackToRaw(t *testing.T) {
+	tbl := table{hashMode: hashModeCanonicalJSON, storeCanonical: true}
+	body := []byte(`not json`)
+
+	doc := tbl.hashDocument(context.Background(), NewDocument(body))
+
+	assert.Equal(t, hash(body), doc.Hash)
+	assert.Equal(t, body, doc.Body)
+}
+
+func TestIsSupportedHashMode(t *testing.T) {
+	assert.True(t, isSupportedHashMode(""))
+	assert.True(t, isSupportedHashMode(hashModeRaw))
+	assert.True(t, isSupportedHashMode(hashModeCanonicalJSON))
+	assert.False(t, isSupportedHashMode("sha1"))
+}
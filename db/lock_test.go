@@ -0,0 +1,127 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tableLockDialect takes the migration lock only when there is no row for it in the test_lock table,
+// which another connection can insert to hold it
+type tableLockDialect struct {
+	sqliteDialect
+}
+
+func (tableLockDialect) lockQuery() string {
+	return "SELECT count(*) = 0 FROM test_lock WHERE name = ?"
+}
+
+func withTableLockDialect(t *testing.T) (*sql.DB, *sql.DB) {
+	interval := lockRetryInterval
+	t.Cleanup(func() { lockRetryInterval = interval })
+	lockRetryInterval = 10 * time.Millisecond
+
+	open := openTestSQLite(t)
+	conn, err := open()
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	// one connection holds the lock while the migration runs on another
+	conn.SetMaxOpenConns(2)
+
+	holder, err := open()
+	require.NoError(t, err)
+	t.Cleanup(func() { holder.Close() })
+
+	_, err = holder.Exec("CREATE TABLE test_lock (name text primary key)")
+	require.NoError(t, err)
+	return conn, holder
+}
+
+func TestMigrationLock(t *testing.T) {
+	conn, _ := withTableLockDialect(t)
+
+	migrated := false
+	err := withMigrationLock(context.Background(), conn, tableLockDialect{}, time.Second, func() error {
+		migrated = true
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.True(t, migrated)
+}
+
+func TestMigrationLockNeedsTwoConnections(t *testing.T) {
+	conn, _ := withTableLockDialect(t)
+	conn.SetMaxOpenConns(1)
+
+	err := withMigrationLock(context.Background(), conn, tableLockDialect{}, time.Second, func() error {
+		t.Fatal("the migration would wait for the connection that holds the lock")
+		return nil
+	})
+	assert.Equal(t, errSingleConnectionMigration, err)
+}
+
+func TestMigrationLockWaitsForAnotherInstance(t *testing.T) {
+	conn, holder := withTableLockDialect(t)
+
+	_, err := holder.Exec("INSERT INTO test_lock (name) VALUES (?)", dbLockName)
+	require.NoError(t, err)
+	time.AfterFunc(100*time.Millisecond, func() {
+		holder.Exec("DELETE FROM test_lock")
+	})
+
+	start := time.Now()
+	migrated := false
+	err = withMigrationLock(context.Background(), conn, tableLockDialect{}, 5*time.Second, func() error {
+		migrated = true
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.True(t, migrated)
+	assert.True(t, time.Since(start) >= 100*time.Millisecond, "the migration waits until the lock is released")
+}
+
+func TestMigrationLockTimeout(t *testing.T) {
+	conn, holder := withTableLockDialect(t)
+
+	_, err := holder.Exec("INSERT INTO test_lock (name) VALUES (?)", dbLockName)
+	require.NoError(t, err)
+
+	start := time.Now()
+	err = withMigrationLock(context.Background(), conn, tableLockDialect{}, 50*time.Millisecond, func() error {
+		t.Fatal("the migration must not run without the lock")
+		return nil
+	})
+	assert.EqualError(t, err, ErrDbLockFailure)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+}
+
+func TestMigrationLockCancelled(t *testing.T) {
+	conn, holder := withTableLockDialect(t)
+
+	_, err := holder.Exec("INSERT INTO test_lock (name) VALUES (?)", dbLockName)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = withMigrationLock(ctx, conn, tableLockDialect{}, time.Minute, func() error {
+		t.Fatal("the migration must not run without the lock")
+		return nil
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestMigrationLockReleasedOnFailure(t *testing.T) {
+	conn, _ := withTableLockDialect(t)
+
+	err := withMigrationLock(context.Background(), conn, tableLockDialect{}, time.Second, func() error {
+		return assert.AnError
+	})
+	assert.Equal(t, assert.AnError, err)
+
+	// the pinned session is returned to the pool
+	assert.Equal(t, 0, conn.Stats().InUse)
+}
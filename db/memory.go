@@ -0,0 +1,118 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+
+	"github.com/Financial-Times/generic-rw-aurora/config"
+)
+
+// MemoryRWService is an in-memory RWService and RWMonitor, for use in tests.
+// It computes document hashes, detects write conflicts and reports created/updated documents in the same way as AuroraRWService.
+type MemoryRWService struct {
+	sync.RWMutex
+	rwConfig map[string]table
+	rows     map[string]map[string]map[string]string
+}
+
+func NewMemoryService(rwConfig *config.Config) *MemoryRWService {
+	tables := newTableMappings(rwConfig)
+	rows := make(map[string]map[string]map[string]string)
+	for name, t := range tables {
+		t.orderColumns()
+		tables[name] = t
+		rows[name] = make(map[string]map[string]string)
+	}
+
+	return &MemoryRWService{rwConfig: tables, rows: rows}
+}
+
+func (service *MemoryRWService) Ping() (string, error) {
+	return "Ping OK", nil
+}
+
+func (service *MemoryRWService) Writable() (string, error) {
+	return "In-memory tables are writable", nil
+}
+
+func (service *MemoryRWService) SchemaCheck() (string, error) {
+	return "In-memory tables are created from the configuration", nil
+}
+
+func (service *MemoryRWService) TableCheck(path string, mapping config.Mapping) (string, error) {
+	if _, found := service.rwConfig[mapping.Table]; !found {
+		return fmt.Sprintf("Table %s is not configured", mapping.Table), fmt.Errorf("table %s is not configured", mapping.Table)
+	}
+	return fmt.Sprintf("In-memory table %s is created from the configuration of %s", mapping.Table, path), nil
+}
+
+func (service *MemoryRWService) Read(ctx context.Context, tableName string, key string) (Document, error) {
+	service.RLock()
+	defer service.RUnlock()
+
+	table := service.rwConfig[tableName]
+	docColumn := table.documentColumn()
+	if docColumn == "" {
+		return Document{}, fmt.Errorf("document column is not configured for table %s", tableName)
+	}
+
+	row, found := service.rows[tableName][key]
+	if !found {
+		return Document{}, sql.ErrNoRows
+	}
+
+	body, err := decompressBody(row[docColumn])
+	if err != nil {
+		return Document{}, err
+	}
+
+	doc := NewDocumentWithHash(body, row[hashColumn])
+	for header, col := range table.responseHeaders {
+		doc.Metadata.Set(header, row[col])
+	}
+
+	return doc, nil
+}
+
+func (service *MemoryRWService) Write(ctx context.Context, tableName string, key string, doc Document, params map[string]string, previousDocHash string) (WriteStatus, string, error) {
+	ctx = context.WithValue(ctx, contextTable, tableName)
+	ctx = context.WithValue(ctx, contextDocumentKey, key)
+
+	table, found := service.rwConfig[tableName]
+	if !found {
+		return Updated, "", fmt.Errorf("table %s is not configured", tableName)
+	}
+
+	doc = table.hashDocument(ctx, doc)
+	row := make(map[string]string)
+	for col, val := range generateColumnValuesMap(ctx, table, key, doc, params) {
+		if val != nil {
+			row[col] = fmt.Sprint(val)
+		}
+	}
+
+	service.Lock()
+	defer service.Unlock()
+
+	existing, exists := service.rows[tableName][key]
+	if exists && existing[hashColumn] == doc.Hash {
+		if table.updateMetadataWhenUnchanged {
+			for _, col := range table.metadataColumns {
+				existing[col] = row[col]
+			}
+		}
+		return Unchanged, doc.Hash, nil
+	}
+
+	if table.hasConflictDetection && (exists && existing[hashColumn] != previousDocHash || !exists && previousDocHash != "") {
+		buildLogEntryFromContext(ctx).Warn(conflictLogMessage)
+	}
+
+	service.rows[tableName][key] = row
+	if exists {
+		return Updated, doc.Hash, nil
+	}
+	return Created, doc.Hash, nil
+}
@@ -0,0 +1,120 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/Financial-Times/generic-rw-aurora/config"
+	tid "github.com/Financial-Times/transactionid-utils-go"
+	"github.com/sirupsen/logrus"
+	logTest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMemoryService(t *testing.T) *MemoryRWService {
+	cfg, err := config.ReadConfig("../config.yml")
+	require.NoError(t, err)
+
+	return NewMemoryService(cfg)
+}
+
+func TestMemoryReadNotFound(t *testing.T) {
+	service := newTestMemoryService(t)
+
+	_, err := service.Read(context.Background(), testTable, "1234")
+	assert.EqualError(t, err, sql.ErrNoRows.Error())
+}
+
+func TestMemoryWriteAndRead(t *testing.T) {
+	service := newTestMemoryService(t)
+	params := map[string]string{"id": "1234"}
+
+	doc := NewDocument([]byte(`{"foo":"bar"}`))
+	doc.Metadata.Set(timestampMetadata, "2018-01-01T00:00:00.000Z")
+	doc.Metadata.Set("x-origin-system-id", "test-system")
+
+	status, docHash, err := service.Write(context.Background(), testTableWithMetadata, "1234", doc, params, "")
+	require.NoError(t, err)
+	assert.Equal(t, Created, status)
+	assert.Equal(t, hash(doc.Body), docHash)
+
+	actual, err := service.Read(context.Background(), testTableWithMetadata, "1234")
+	require.NoError(t, err)
+	assert.Equal(t, doc.Body, actual.Body)
+	assert.Equal(t, docHash, actual.Hash)
+	assert.Equal(t, "test-system", actual.Metadata["X-Origin-System-Id"])
+	assert.Equal(t, "2018-01-01T00:00:00.000Z", actual.Metadata["Last-Modified-RFC3339"])
+
+	status, _, err = service.Write(context.Background(), testTableWithMetadata, "1234", NewDocument([]byte(`{"foo":"baz"}`)), params, "")
+	require.NoError(t, err)
+	assert.Equal(t, Updated, status)
+}
+
+func TestMemoryWriteWithConflictDetection(t *testing.T) {
+	hook := logTest.NewGlobal()
+	service := newTestMemoryService(t)
+	params := map[string]string{"id": "1234"}
+	ctx := tid.TransactionAwareContext(context.Background(), "tid_testmemory")
+
+	status, previousDocHash, err := service.Write(ctx, testTableWithConflictDetection, "1234", NewDocument([]byte(`{"foo":"bar"}`)), params, "")
+	require.NoError(t, err)
+	assert.Equal(t, Created, status)
+	assert.False(t, hasLogEntry(hook, conflictLogMessage))
+
+	status, docHash, err := service.Write(ctx, testTableWithConflictDetection, "1234", NewDocument([]byte(`{"foo":"baz"}`)), params, previousDocHash)
+	require.NoError(t, err)
+	assert.Equal(t, Updated, status)
+	assert.False(t, hasLogEntry(hook, conflictLogMessage))
+
+	status, _, err = service.Write(ctx, testTableWithConflictDetection, "1234", NewDocument([]byte(`{"foo":"qux"}`)), params, previousDocHash)
+	require.NoError(t, err)
+	assert.Equal(t, Updated, status)
+	require.NotNil(t, hook.LastEntry())
+	assert.Equal(t, conflictLogMessage, hook.LastEntry().Message)
+	assert.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+	assert.Equal(t, "1234", hook.LastEntry().Data["key"])
+	assert.Equal(t, "tid_testmemory", hook.LastEntry().Data[tid.TransactionIDKey])
+
+	hook.Reset()
+	status, _, err = service.Write(ctx, testTableWithConflictDetection, "5678", NewDocument([]byte(`{"foo":"bar"}`)), map[string]string{"id": "5678"}, docHash)
+	require.NoError(t, err)
+	assert.Equal(t, Created, status)
+	require.NotNil(t, hook.LastEntry())
+	assert.Equal(t, conflictLogMessage, hook.LastEntry().Message)
+}
+
+func TestMemoryMonitor(t *testing.T) {
+	service := newTestMemoryService(t)
+
+	_, err := service.Ping()
+	assert.NoError(t, err)
+
+	_, err = service.SchemaCheck()
+	assert.NoError(t, err)
+
+	_, err = service.Writable()
+	assert.NoError(t, err)
+}
+
+func TestMemoryWriteUnchanged(t *testing.T) {
+	service := newTestMemoryService(t)
+	params := map[string]string{"id": "1234"}
+
+	doc := NewDocument([]byte(`{"foo":"bar"}`))
+	doc.Metadata.Set(timestampMetadata, "2018-01-01T00:00:00.000Z")
+	_, docHash, err := service.Write(context.Background(), testTableWithMetadata, "1234", doc, params, "")
+	require.NoError(t, err)
+
+	doc = NewDocument([]byte(`{"foo":"bar"}`))
+	doc.Metadata.Set(timestampMetadata, "2019-01-01T00:00:00.000Z")
+	status, unchangedHash, err := service.Write(context.Background(), testTableWithMetadata, "1234", doc, params, docHash)
+	require.NoError(t, err)
+	assert.Equal(t, Unchanged, status)
+	assert.Equal(t, docHash, unchangedHash)
+
+	actual, err := service.Read(context.Background(), testTableWithMetadata, "1234")
+	require.NoError(t, err)
+	assert.Equal(t, "2018-01-01T00:00:00.000Z", actual.Metadata["Last-Modified-RFC3339"], "metadata is not updated")
+}
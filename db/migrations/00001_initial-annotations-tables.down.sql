@@ -0,0 +1,3 @@
+drop table published_annotations;
+
+drop table draft_annotations;
@@ -0,0 +1,13 @@
+create table draft_annotations (
+	uuid varchar(36) primary key,
+	last_modified varchar(32) not null,
+	publish_ref varchar(50) not null,
+	body mediumtext not null
+);
+
+create table published_annotations (
+	uuid varchar(36) primary key,
+	last_modified varchar(32) not null,
+	publish_ref varchar(50) not null,
+	body mediumtext not null
+);
@@ -0,0 +1,3 @@
+alter table draft_annotations drop column hash;
+
+alter table published_annotations drop column hash;
@@ -0,0 +1,3 @@
+alter table draft_annotations add column hash varchar(56) not null;
+
+alter table published_annotations add column hash varchar(56) not null;
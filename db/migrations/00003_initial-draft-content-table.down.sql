@@ -0,0 +1 @@
+drop table draft_content;
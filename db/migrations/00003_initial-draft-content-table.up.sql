@@ -0,0 +1,8 @@
+create table draft_content (
+	uuid varchar(36) primary key,
+	last_modified varchar(32) not null,
+	draft_ref varchar(50) not null,
+	origin_system varchar(50) not null,
+	hash varchar(56) not null,
+	body mediumtext not null
+);
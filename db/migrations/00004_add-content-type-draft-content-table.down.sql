@@ -0,0 +1 @@
+alter table draft_content drop column content_type;
@@ -0,0 +1 @@
+alter table draft_content add column content_type varchar(128) not null;
@@ -0,0 +1 @@
+drop table change_outbox;
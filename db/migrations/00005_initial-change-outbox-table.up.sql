@@ -0,0 +1,13 @@
+create table change_outbox (
+	id bigint auto_increment primary key,
+	path varchar(255) not null,
+	table_name varchar(64) not null,
+	doc_key varchar(255) not null,
+	old_hash varchar(56) not null,
+	new_hash varchar(56) not null,
+	event_type varchar(16) not null,
+	transaction_id varchar(255) not null,
+	created_at varchar(32) not null,
+	claimed_by varchar(64) not null default '',
+	claimed_until bigint not null default 0
+);
@@ -0,0 +1,5 @@
+alter table draft_content drop column change_seq;
+
+alter table published_annotations drop column change_seq;
+
+drop table change_sequence;
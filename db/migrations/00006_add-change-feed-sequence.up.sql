@@ -0,0 +1,12 @@
+create table change_sequence (
+	table_name varchar(64) primary key,
+	seq bigint not null
+);
+
+alter table published_annotations add column change_seq bigint not null default 0;
+
+alter table draft_content add column change_seq bigint not null default 0;
+
+create index published_annotations_change_seq on published_annotations (change_seq);
+
+create index draft_content_change_seq on draft_content (change_seq);
@@ -0,0 +1 @@
+drop table backfill_checkpoint;
@@ -0,0 +1,9 @@
+create table backfill_checkpoint (
+	table_name varchar(64) primary key,
+	column_names varchar(1024) not null,
+	last_key varchar(255) not null,
+	scanned bigint not null,
+	updated bigint not null,
+	claimed_by varchar(64) not null default '',
+	claimed_until bigint not null default 0
+);
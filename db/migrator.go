@@ -0,0 +1,252 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	goose "github.com/Financial-Times/cm-goose"
+	"github.com/Financial-Times/generic-rw-aurora/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// Migrator applies and rolls back the schema migrations on demand, e.g. from a Kubernetes job,
+// rather than only migrating up to the version required by the service when it starts.
+// Like the service, it holds the database lock while it migrates.
+type Migrator struct {
+	conn        *sql.DB
+	dialect     dialect
+	lockTimeout time.Duration
+	// dryRun prints the SQL of the migrations to out instead of applying them
+	dryRun bool
+	out    io.Writer
+}
+
+// migrationName is the name of a generated migration, as in the migration file names
+var migrationName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// migrationStep is a migration to apply, or to roll back if down is set
+type migrationStep struct {
+	migration
+	down bool
+}
+
+// NewMigrator returns a migrator for the connected database, which waits for up to lockTimeout for the lock
+// and prints its output to out.
+func NewMigrator(conn *sql.DB, lockTimeout time.Duration, dryRun bool, out io.Writer) (*Migrator, error) {
+	return newMigrator(conn, dialectFor(conn), lockTimeout, dryRun, out)
+}
+
+func newMigrator(conn *sql.DB, d dialect, lockTimeout time.Duration, dryRun bool, out io.Writer) (*Migrator, error) {
+	if d.createsTablesFromMapping() {
+		return nil, fmt.Errorf("%s tables are created from the configuration, they have no migrations", d.name())
+	}
+
+	if err := registerMigrations(d); err != nil {
+		return nil, err
+	}
+	return &Migrator{conn: conn, dialect: d, lockTimeout: lockTimeout, dryRun: dryRun, out: out}, nil
+}
+
+// Status prints every migration, and whether it has been applied.
+func (m *Migrator) Status(ctx context.Context) error {
+	current, err := goose.GetDBVersion(m.conn)
+	if err != nil {
+		return err
+	}
+	return printMigrationStatus(m.out, current)
+}
+
+// Up applies the migrations up to the version, or up to the latest version if it is 0.
+func (m *Migrator) Up(ctx context.Context, version int64) error {
+	if version == 0 {
+		version = requiredVersion
+	}
+
+	current, err := goose.GetDBVersion(m.conn)
+	if err != nil {
+		return err
+	}
+	if version < current {
+		return fmt.Errorf("schema version %d is older than the current version %d, it requires a migration down", version, current)
+	}
+
+	return m.run(ctx, current, version, func() error {
+		return goose.UpTo(m.conn, ".", version)
+	})
+}
+
+// Down rolls back the migrations after the version.
+func (m *Migrator) Down(ctx context.Context, version int64) error {
+	current, err := goose.GetDBVersion(m.conn)
+	if err != nil {
+		return err
+	}
+	if version > current {
+		return fmt.Errorf("schema version %d is newer than the current version %d, it requires a migration up", version, current)
+	}
+
+	return m.run(ctx, current, version, func() error {
+		return goose.DownTo(m.conn, ".", version)
+	})
+}
+
+// Redo rolls back the latest applied migration, then applies it again.
+func (m *Migrator) Redo(ctx context.Context) error {
+	current, err := goose.GetDBVersion(m.conn)
+	if err != nil {
+		return err
+	}
+	if current == 0 {
+		return fmt.Errorf("no migration has been applied")
+	}
+
+	if m.dryRun {
+		down, err := planMigration(current, current-1)
+		if err != nil {
+			return err
+		}
+		up, _ := planMigration(current-1, current)
+		fmt.Fprintf(m.out, "-- redo schema version %d\n", current)
+		printMigrationSQL(m.out, m.dialect, append(down, up...))
+		return nil
+	}
+
+	log.WithField("version", current).Info("redoing database migration")
+	return withMigrationLock(ctx, m.conn, m.dialect, m.lockTimeout, func() error {
+		return goose.Redo(m.conn, ".")
+	})
+}
+
+// Generate writes the migration that creates the configured tables and columns that are missing from the database
+// to the next version's files in the directory, e.g. 00007_name.up.sql and 00007_name.down.sql.
+// The database must be at the latest version, so that the migration does not repeat a pending migration.
+func (m *Migrator) Generate(ctx context.Context, rwConfig *config.Config, dir string, name string) error {
+	if !migrationName.MatchString(name) {
+		return fmt.Errorf("invalid migration name %s, it may only contain letters, digits, - and _", name)
+	}
+
+	current, err := goose.GetDBVersion(m.conn)
+	if err != nil {
+		return err
+	}
+	if current != requiredVersion {
+		return fmt.Errorf("the database is at schema version %d, migrate it to version %d before generating a migration", current, requiredVersion)
+	}
+
+	tables := newTableMappings(rwConfig)
+	for tableName, t := range tables {
+		t.compile(m.dialect)
+		tables[tableName] = t
+	}
+
+	changes, err := diffSchema(ctx, m.conn, m.dialect, tables, true)
+	if err != nil {
+		return err
+	}
+	if len(changes.apply) == 0 {
+		fmt.Fprintln(m.out, "the database schema matches the configuration, no migration is required")
+		return nil
+	}
+
+	base := fmt.Sprintf("%05d_%s", requiredVersion+1, name)
+	files := []struct{ name, content string }{
+		{base + ".up.sql", strings.Join(changes.apply, ";\n\n") + ";\n"},
+		{base + ".down.sql", strings.Join(changes.rollback, ";\n\n") + ";\n"},
+	}
+	for _, file := range files {
+		if m.dryRun {
+			fmt.Fprintf(m.out, "-- %s\n%s", file.name, file.content)
+			continue
+		}
+
+		path := filepath.Join(dir, file.name)
+		if err := os.WriteFile(path, []byte(file.content), 0644); err != nil {
+			return err
+		}
+		fmt.Fprintln(m.out, path)
+	}
+	return nil
+}
+
+// run plans the migration from the current version to the target version, then prints it or applies it
+func (m *Migrator) run(ctx context.Context, current int64, target int64, migrate func() error) error {
+	steps, err := planMigration(current, target)
+	if err != nil {
+		return err
+	}
+
+	if m.dryRun {
+		fmt.Fprintf(m.out, "-- migrate from schema version %d to %d\n", current, target)
+		printMigrationSQL(m.out, m.dialect, steps)
+		return nil
+	}
+
+	if len(steps) == 0 {
+		log.WithField("version", current).Info("database schema is already at the requested version")
+		return nil
+	}
+
+	log.WithFields(log.Fields{"from": current, "to": target}).Info("migrating database")
+	return withMigrationLock(ctx, m.conn, m.dialect, m.lockTimeout, migrate)
+}
+
+// planMigration returns the migrations to apply, in order, to migrate from the current version to the target version,
+// or to roll back, in reverse order, if the target is older.
+func planMigration(current int64, target int64) ([]migrationStep, error) {
+	if target < 0 || target > requiredVersion {
+		return nil, fmt.Errorf("unknown schema version %d, the latest is %d", target, requiredVersion)
+	}
+
+	var steps []migrationStep
+	if target >= current {
+		for _, step := range migrations {
+			if step.cardinal > current && step.cardinal <= target {
+				steps = append(steps, migrationStep{migration: step})
+			}
+		}
+		return steps, nil
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		if step := migrations[i]; step.cardinal > target && step.cardinal <= current {
+			steps = append(steps, migrationStep{migration: step, down: true})
+		}
+	}
+	return steps, nil
+}
+
+func printMigrationSQL(out io.Writer, d dialect, steps []migrationStep) {
+	for _, step := range steps {
+		sqlStatements, direction := step.apply, "apply"
+		if step.down {
+			sqlStatements, direction = step.rollback, "rollback"
+		}
+
+		fmt.Fprintf(out, "-- %s %d %s\n", direction, step.cardinal, step.name)
+		for _, stmt := range migrationStatements(d, sqlStatements) {
+			fmt.Fprintf(out, "%s;\n", strings.TrimSpace(stmt))
+		}
+	}
+}
+
+func printMigrationStatus(out io.Writer, current int64) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tAPPLIED\tMIGRATION")
+	for _, step := range migrations {
+		applied := "no"
+		if step.cardinal <= current {
+			applied = "yes"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", step.cardinal, applied, step.name)
+	}
+	fmt.Fprintf(w, "\ncurrent version %d, required version %d\n", current, requiredVersion)
+	return w.Flush()
+}
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func cardinals(steps []migrationStep) []int64 {
+	var c []int64
+	for _, step := range steps {
+		c = append(c, step.cardinal)
+	}
+	return c
+}
+
+func TestPlanMigrationUp(t *testing.T) {
+	steps, err := planMigration(0, requiredVersion)
+	require.NoError(t, err)
+	assert.Len(t, steps, len(migrations))
+	for _, step := range steps {
+		assert.False(t, step.down)
+	}
+
+	steps, err = planMigration(2, 4)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{3, 4}, cardinals(steps))
+
+	steps, err = planMigration(4, 4)
+	require.NoError(t, err)
+	assert.Empty(t, steps)
+}
+
+func TestPlanMigrationDown(t *testing.T) {
+	steps, err := planMigration(4, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{4, 3}, cardinals(steps), "migrations are rolled back in reverse order")
+	for _, step := range steps {
+		assert.True(t, step.down)
+	}
+
+	steps, err = planMigration(requiredVersion, 0)
+	require.NoError(t, err)
+	assert.Len(t, steps, len(migrations))
+}
+
+func TestPlanMigrationUnknownVersion(t *testing.T) {
+	_, err := planMigration(0, requiredVersion+1)
+	assert.EqualError(t, err, fmt.Sprintf("unknown schema version %d, the latest is %d", requiredVersion+1, requiredVersion))
+
+	_, err = planMigration(3, -1)
+	assert.EqualError(t, err, fmt.Sprintf("unknown schema version -1, the latest is %d", requiredVersion))
+}
+
+func TestPrintMigrationSQL(t *testing.T) {
+	steps, err := planMigration(3, 4)
+	require.NoError(t, err)
+	down, err := planMigration(4, 3)
+	require.NoError(t, err)
+
+	out := &bytes.Buffer{}
+	printMigrationSQL(out, mysqlDialect{}, append(steps, down...))
+	assert.Equal(t, "-- apply 4 add-content-type-draft-content-table\n"+
+		"alter table draft_content add column content_type varchar(128) not null;\n"+
+		"-- rollback 4 add-content-type-draft-content-table\n"+
+		"alter table draft_content drop column content_type;\n", out.String())
+}
+
+func TestPrintMigrationSQLForDialect(t *testing.T) {
+	steps, err := planMigration(4, 5)
+	require.NoError(t, err)
+
+	out := &bytes.Buffer{}
+	printMigrationSQL(out, postgresDialect{}, steps)
+	assert.Contains(t, out.String(), "-- apply 5 initial-change-outbox-table\n")
+	assert.Contains(t, out.String(), "bigserial primary key")
+	assert.NotContains(t, out.String(), "auto_increment")
+}
+
+func TestPrintMigrationStatus(t *testing.T) {
+	out := &bytes.Buffer{}
+	require.NoError(t, printMigrationStatus(out, 4))
+
+	lines := strings.Split(out.String(), "\n")
+	assert.Equal(t, "VERSION  APPLIED  MIGRATION", lines[0])
+	assert.Equal(t, "4        yes      add-content-type-draft-content-table", lines[4])
+	assert.Equal(t, "5        no       initial-change-outbox-table", lines[5])
+	assert.Contains(t, out.String(), fmt.Sprintf("current version 4, required version %d", requiredVersion))
+}
+
+func TestMigratorNotSupportedForSQLite(t *testing.T) {
+	conn, err := openTestSQLite(t)()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = newMigrator(conn, sqliteDialect{}, time.Second, false, &bytes.Buffer{})
+	assert.EqualError(t, err, "sqlite3 tables are created from the configuration, they have no migrations")
+}
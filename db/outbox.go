@@ -0,0 +1,184 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Financial-Times/generic-rw-aurora/events"
+	tid "github.com/Financial-Times/transactionid-utils-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const outboxTable = "change_outbox"
+
+// publishTimeout bounds each step of the publishing of a batch of events: claiming them, notifying them and removing them
+const publishTimeout = 30 * time.Second
+
+// claimLease is how long an instance has to publish the events it claimed, after which another instance may claim them
+const claimLease = 3 * publishTimeout
+
+// outbox records change events in the same transaction as the writes, and publishes them to a notifier.
+type outbox struct {
+	notifier  events.Notifier
+	interval  time.Duration
+	batchSize int
+
+	insertSQL string
+	selectSQL string
+}
+
+// idsSQL formats a statement on the events with the ids, after the other arguments
+func (o *outbox) idsSQL(d dialect, format string, batch []events.Event, args ...interface{}) (string, []interface{}) {
+	placeholders := make([]string, len(batch))
+	for i, e := range batch {
+		placeholders[i] = "?"
+		args = append(args, e.ID)
+	}
+	return d.rebind(fmt.Sprintf(format, outboxTable, strings.Join(placeholders, ", "))), args
+}
+
+// WithOutbox records a change event in the outbox table, in the same transaction as each write that changes a document.
+// The events are published to the notifier in batches of up to batchSize, at the interval, and removed from the outbox
+// once they have been published. With a nil notifier the events are only recorded, for the other instances to publish.
+func WithOutbox(notifier events.Notifier, interval time.Duration, batchSize int) Option {
+	return func(service *AuroraRWService) {
+		if batchSize < 1 {
+			batchSize = 1
+		}
+		service.outbox = &outbox{
+			notifier:  notifier,
+			interval:  interval,
+			batchSize: batchSize,
+			insertSQL: service.dialect.rebind(fmt.Sprintf("INSERT INTO %s (path, table_name, doc_key, old_hash, new_hash, event_type, transaction_id, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", outboxTable)),
+			selectSQL: service.dialect.rebind(fmt.Sprintf("SELECT id, path, table_name, doc_key, old_hash, new_hash, event_type, transaction_id, created_at, claimed_until FROM %s ORDER BY id LIMIT ?", outboxTable) + service.dialect.forUpdate()),
+		}
+	}
+}
+
+// recordChange inserts the change event of a write into the outbox, in the write's transaction.
+func (service *AuroraRWService) recordChange(ctx context.Context, ex executor, t table, key string, oldHash string, newHash string, status WriteStatus) error {
+	eventType := events.Updated
+	if status == Created {
+		eventType = events.Created
+	}
+	txid, _ := ctx.Value(tid.TransactionIDKey).(string)
+	timestamp := time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+
+	_, err := ex.exec(ctx, service.outbox.insertSQL, t.path, t.name, key, oldHash, newHash, eventType, txid, timestamp)
+	if err != nil {
+		buildLogEntryFromContext(ctx).WithError(err).Error("unable to record change event")
+	}
+	return err
+}
+
+// publishOutbox drains the outbox to the notifier at every interval, until the service is closed.
+func (service *AuroraRWService) publishOutbox() {
+	for {
+		select {
+		case <-service.done:
+			return
+		case <-time.After(service.outbox.interval):
+		}
+
+		for {
+			published, err := service.publishEvents()
+			if err != nil {
+				log.WithError(err).Warn("unable to publish change events, they will be retried")
+				break
+			}
+			if published < service.outbox.batchSize {
+				break
+			}
+		}
+	}
+}
+
+// publishEvents publishes the oldest batch of events, and removes them from the outbox.
+// The events are claimed by this instance, so that no transaction is open while the notifier publishes them.
+func (service *AuroraRWService) publishEvents() (int, error) {
+	batch, err := service.claimEvents()
+	if err != nil || len(batch) == 0 {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	err = service.outbox.notifier.Notify(ctx, batch)
+	cancel()
+	if err != nil {
+		service.releaseEvents(batch)
+		return 0, err
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+
+	// the published rows are deleted by id, as rows with lower ids may be committed later,
+	// unless another instance has claimed them since the lease expired
+	deleteSQL, args := service.outbox.idsSQL(service.dialect, "DELETE FROM %s WHERE claimed_by = ? AND id IN (%s)", batch, service.instanceID)
+	if _, err := service.writer.db().ExecContext(ctx, deleteSQL, args...); err != nil {
+		return 0, err
+	}
+	log.WithField("events", len(batch)).Info("change events published")
+	return len(batch), nil
+}
+
+// claimEvents claims the oldest batch of events for this instance in a short transaction.
+// Nothing is claimed while another instance holds an unexpired claim on the oldest events,
+// so that the events are published in order, by one instance at a time.
+func (service *AuroraRWService) claimEvents() ([]events.Event, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+
+	tx, err := service.writer.db().BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, service.outbox.selectSQL, service.outbox.batchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var batch []events.Event
+	for rows.Next() {
+		var e events.Event
+		var claimedUntil int64
+		if err := rows.Scan(&e.ID, &e.Path, &e.Table, &e.Key, &e.OldHash, &e.NewHash, &e.Type, &e.TransactionID, &e.Timestamp, &claimedUntil); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if claimedUntil > now.UnixMilli() {
+			rows.Close()
+			return nil, nil
+		}
+		batch = append(batch, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(batch) == 0 {
+		return nil, nil
+	}
+
+	claimSQL, args := service.outbox.idsSQL(service.dialect, "UPDATE %s SET claimed_by = ?, claimed_until = ? WHERE id IN (%s)", batch, service.instanceID, now.Add(claimLease).UnixMilli())
+	if _, err := tx.ExecContext(ctx, claimSQL, args...); err != nil {
+		return nil, err
+	}
+	return batch, tx.Commit()
+}
+
+// releaseEvents releases the claim of this instance on events that it failed to publish, so that they are retried without waiting for the lease to expire.
+func (service *AuroraRWService) releaseEvents(batch []events.Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+
+	releaseSQL, args := service.outbox.idsSQL(service.dialect, "UPDATE %s SET claimed_until = 0 WHERE claimed_by = ? AND id IN (%s)", batch, service.instanceID)
+	if _, err := service.writer.db().ExecContext(ctx, releaseSQL, args...); err != nil {
+		log.WithError(err).Warn("unable to release the claim on change events, they will be retried when it expires")
+	}
+}
@@ -0,0 +1,235 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Financial-Times/generic-rw-aurora/events"
+	tid "github.com/Financial-Times/transactionid-utils-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingNotifier records the events it is notified of, and fails while err is set
+type recordingNotifier struct {
+	sync.Mutex
+	events []events.Event
+	err    error
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, batch []events.Event) error {
+	n.Lock()
+	defer n.Unlock()
+	if n.err != nil {
+		return n.err
+	}
+	n.events = append(n.events, batch...)
+	return nil
+}
+
+func (n *recordingNotifier) published() []events.Event {
+	n.Lock()
+	defer n.Unlock()
+	return append([]events.Event(nil), n.events...)
+}
+
+func (n *recordingNotifier) setError(err error) {
+	n.Lock()
+	defer n.Unlock()
+	n.err = err
+}
+
+func newTestOutboxService(t *testing.T, notifier events.Notifier) *AuroraRWService {
+	return newTestSQLiteService(t, readTestConfig(t), WithOutbox(notifier, 10*time.Millisecond, 2))
+}
+
+func countOutboxEvents(t *testing.T, service *AuroraRWService) int {
+	var count int
+	require.NoError(t, service.writer.db().QueryRow("SELECT COUNT(*) FROM "+outboxTable).Scan(&count))
+	return count
+}
+
+func TestOutboxPublishesChanges(t *testing.T) {
+	notifier := &recordingNotifier{}
+	service := newTestOutboxService(t, notifier)
+	ctx := tid.TransactionAwareContext(context.Background(), "tid_testoutbox")
+	params := map[string]string{"id": "1234"}
+
+	_, createdHash, err := service.Write(ctx, testTable, "1234", NewDocument([]byte(`{"foo":"bar"}`)), params, "")
+	require.NoError(t, err)
+	_, updatedHash, err := service.Write(ctx, testTable, "1234", NewDocument([]byte(`{"foo":"baz"}`)), params, "")
+	require.NoError(t, err)
+	status, _, err := service.Write(ctx, testTable, "1234", NewDocument([]byte(`{"foo":"baz"}`)), params, "")
+	require.NoError(t, err)
+	require.Equal(t, Unchanged, status)
+	_, _, err = service.Write(ctx, testTable, "5678", NewDocument([]byte(`{"foo":"qux"}`)), map[string]string{"id": "5678"}, "")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return len(notifier.published()) == 3 }, time.Second, 10*time.Millisecond)
+	published := notifier.published()
+
+	assert.Equal(t, "/published/content/:id/annotations", published[0].Path)
+	assert.Equal(t, testTable, published[0].Table)
+	assert.Equal(t, "1234", published[0].Key)
+	assert.Empty(t, published[0].OldHash)
+	assert.Equal(t, createdHash, published[0].NewHash)
+	assert.Equal(t, events.Created, published[0].Type)
+	assert.Equal(t, "tid_testoutbox", published[0].TransactionID)
+	assert.NotEmpty(t, published[0].Timestamp)
+
+	assert.Equal(t, createdHash, published[1].OldHash)
+	assert.Equal(t, updatedHash, published[1].NewHash)
+	assert.Equal(t, events.Updated, published[1].Type, "an unchanged document has no event")
+
+	assert.Equal(t, "5678", published[2].Key)
+	assert.True(t, published[0].ID < published[1].ID && published[1].ID < published[2].ID, "events are published in order")
+
+	assert.Eventually(t, func() bool { return countOutboxEvents(t, service) == 0 }, time.Second, 10*time.Millisecond, "published events are removed")
+}
+
+func TestOutboxRetriesFailedNotification(t *testing.T) {
+	notifier := &recordingNotifier{err: errors.New("downstream is unavailable")}
+	service := newTestOutboxService(t, notifier)
+
+	_, _, err := service.Write(context.Background(), testTable, "1234", NewDocument([]byte(`{"foo":"bar"}`)), map[string]string{"id": "1234"}, "")
+	require.NoError(t, err)
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, countOutboxEvents(t, service), "the event is kept while the notifier fails")
+
+	notifier.setError(nil)
+	assert.Eventually(t, func() bool { return len(notifier.published()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return countOutboxEvents(t, service) == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestOutboxSkipsEventsClaimedByAnotherInstance(t *testing.T) {
+	notifier := &recordingNotifier{}
+	service := newTestSQLiteService(t, readTestConfig(t), WithOutbox(notifier, time.Hour, 2))
+
+	_, _, err := service.Write(context.Background(), testTable, "1234", NewDocument([]byte(`{"foo":"bar"}`)), map[string]string{"id": "1234"}, "")
+	require.NoError(t, err)
+	_, err = service.writer.db().Exec("UPDATE change_outbox SET claimed_by = 'other', claimed_until = ?", time.Now().Add(time.Minute).UnixMilli())
+	require.NoError(t, err)
+
+	published, err := service.publishEvents()
+	require.NoError(t, err)
+	assert.Equal(t, 0, published, "the other instance is publishing the event")
+	assert.Empty(t, notifier.published())
+
+	_, err = service.writer.db().Exec("UPDATE change_outbox SET claimed_until = ?", time.Now().Add(-time.Second).UnixMilli())
+	require.NoError(t, err)
+
+	published, err = service.publishEvents()
+	require.NoError(t, err)
+	assert.Equal(t, 1, published, "the claim of the other instance has expired")
+	assert.Len(t, notifier.published(), 1)
+	assert.Equal(t, 0, countOutboxEvents(t, service))
+}
+
+// queryingNotifier reads the outbox while it is notified, which needs a connection that is not held by a transaction
+type queryingNotifier struct {
+	service *AuroraRWService
+	counts  []int
+}
+
+func (n *queryingNotifier) Notify(ctx context.Context, batch []events.Event) error {
+	var count int
+	if err := n.service.writer.db().QueryRowContext(ctx, "SELECT COUNT(*) FROM "+outboxTable).Scan(&count); err != nil {
+		return err
+	}
+	n.counts = append(n.counts, count)
+	return nil
+}
+
+func TestOutboxNotifiesOutsideTransaction(t *testing.T) {
+	notifier := &queryingNotifier{}
+	service := newTestSQLiteService(t, readTestConfig(t), WithOutbox(notifier, time.Hour, 2))
+	notifier.service = service
+
+	_, _, err := service.Write(context.Background(), testTable, "1234", NewDocument([]byte(`{"foo":"bar"}`)), map[string]string{"id": "1234"}, "")
+	require.NoError(t, err)
+
+	// the SQLite pool has a single connection, so the notifier would block on an open transaction
+	published, err := service.publishEvents()
+	require.NoError(t, err)
+	assert.Equal(t, 1, published)
+	assert.Equal(t, []int{1}, notifier.counts)
+	assert.Equal(t, 0, countOutboxEvents(t, service))
+}
+
+func TestOutboxEventIsNotRecordedForFailedWrite(t *testing.T) {
+	notifier := &recordingNotifier{}
+	service := newTestOutboxService(t, notifier)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := service.Write(ctx, testTable, "1234", NewDocument([]byte(`{"foo":"bar"}`)), map[string]string{"id": "1234"}, "")
+	require.Error(t, err)
+
+	assert.Equal(t, 0, countOutboxEvents(t, service))
+}
+
+func TestOutboxWithoutNotifierOnlyRecords(t *testing.T) {
+	service := newTestSQLiteService(t, readTestConfig(t), WithOutbox(nil, 10*time.Millisecond, 2))
+
+	_, _, err := service.Write(context.Background(), testTable, "1234", NewDocument([]byte(`{"foo":"bar"}`)), map[string]string{"id": "1234"}, "")
+	require.NoError(t, err)
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, countOutboxEvents(t, service), "the event is left for the instances that publish")
+}
+
+func TestRehashRecordsChange(t *testing.T) {
+	notifier := &recordingNotifier{}
+	service := newTestOutboxService(t, notifier)
+	ctx := tid.TransactionAwareContext(context.Background(), "tid_testrehash")
+
+	_, docHash, err := service.Write(ctx, testTable, "1234", NewDocument([]byte(`{"foo":"bar"}`)), map[string]string{"id": "1234"}, "")
+	require.NoError(t, err)
+	_, err = service.writer.db().Exec("UPDATE "+testTable+" SET hash = 'stale'")
+	require.NoError(t, err)
+
+	_, updated, err := service.Rehash(ctx, testTable, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 1, updated)
+
+	changes, err := service.Changes(context.Background(), testTable, 1, 10, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []Change{{Key: "1234", Hash: docHash, Seq: 2}}, changes, "the rehash moves the document in the change feed")
+
+	require.Eventually(t, func() bool { return len(notifier.published()) == 2 }, time.Second, 10*time.Millisecond)
+	rehashed := notifier.published()[1]
+	assert.Equal(t, events.Updated, rehashed.Type)
+	assert.Equal(t, "stale", rehashed.OldHash)
+	assert.Equal(t, docHash, rehashed.NewHash)
+}
+
+func TestOutboxToWebhook(t *testing.T) {
+	received := make(chan []events.Event, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []events.Event
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&batch))
+		received <- batch
+	}))
+	defer server.Close()
+
+	service := newTestOutboxService(t, events.NewWebhookNotifier(server.URL, time.Second))
+
+	_, docHash, err := service.Write(context.Background(), testTable, "1234", NewDocument([]byte(`{"foo":"bar"}`)), map[string]string{"id": "1234"}, "")
+	require.NoError(t, err)
+
+	select {
+	case batch := <-received:
+		require.Len(t, batch, 1)
+		assert.Equal(t, "1234", batch[0].Key)
+		assert.Equal(t, docHash, batch[0].NewHash)
+	case <-time.After(time.Second):
+		t.Fatal("the event was not posted to the webhook")
+	}
+}
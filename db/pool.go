@@ -0,0 +1,115 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// minRecreateInterval stops a burst of failing requests from recreating the pool more than once
+const minRecreateInterval = time.Second
+
+// poolDrainDelay is how long a replaced pool stays open, for the requests that took it before it was replaced
+var poolDrainDelay = 30 * time.Second
+
+var errCannotRecreatePool = errors.New("connection pool cannot be recreated")
+
+// errPoolClosed is the error of database/sql from a pool that has been closed, which it does not export
+const errPoolClosed = "sql: database is closed"
+
+// isPoolClosed is true for an error from a connection or pool that has been closed, e.g. because it was replaced
+// whilst the request was using it, which does not recur on the current pool.
+func isPoolClosed(err error) bool {
+	return err != nil && (errors.Is(err, sql.ErrConnDone) || err.Error() == errPoolClosed)
+}
+
+// pool is a connection pool and its prepared statements. It can be replaced by a new pool, e.g. when an Aurora
+// failover has left its connections on an instance that is now read-only.
+type pool struct {
+	sync.RWMutex
+	conn  *sql.DB
+	stmts *statements
+
+	// open creates a new connection pool, or is nil if the pool cannot be recreated
+	open       func() (*sql.DB, error)
+	recreating sync.Mutex
+	recreated  time.Time
+}
+
+func newPool(conn *sql.DB) *pool {
+	return &pool{conn: conn, stmts: newStatements(conn)}
+}
+
+// current returns the connection pool with its statements, which must be used together.
+func (p *pool) current() (*sql.DB, *statements) {
+	p.RLock()
+	defer p.RUnlock()
+	return p.conn, p.stmts
+}
+
+func (p *pool) db() *sql.DB {
+	conn, _ := p.current()
+	return conn
+}
+
+// replace swaps in a new connection pool. The old pool and its statements are closed after poolDrainDelay, once the requests
+// that took it before it was replaced have started their queries, and then once its in-flight queries have finished.
+func (p *pool) replace(conn *sql.DB) {
+	p.Lock()
+	old, oldStmts := p.conn, p.stmts
+	p.conn = conn
+	p.stmts = newStatements(conn)
+	p.Unlock()
+
+	time.AfterFunc(poolDrainDelay, func() {
+		oldStmts.close()
+		old.Close()
+	})
+}
+
+// recreate replaces the connection pool with a new one, unless it has just been recreated.
+func (p *pool) recreate() error {
+	if p.open == nil {
+		return errCannotRecreatePool
+	}
+
+	p.recreating.Lock()
+	defer p.recreating.Unlock()
+
+	if time.Since(p.recreated) < minRecreateInterval {
+		return nil
+	}
+
+	return p.reopen()
+}
+
+// reopen replaces the connection pool with a new one, if the new pool can connect. p.recreating must be held.
+func (p *pool) reopen() error {
+	conn, err := p.open()
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	p.replace(conn)
+	p.recreated = time.Now()
+	log.Info("database connection pool recreated")
+	return nil
+}
+
+// reconnect replaces the connection pool with a new one, e.g. after the database credentials have changed.
+// Unlike recreate, it is not throttled.
+func (p *pool) reconnect() error {
+	if p.open == nil {
+		return errCannotRecreatePool
+	}
+
+	p.recreating.Lock()
+	defer p.recreating.Unlock()
+	return p.reopen()
+}
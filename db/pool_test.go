@@ -0,0 +1,154 @@
+package db
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Financial-Times/generic-rw-aurora/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestSQLite(t *testing.T) func() (*sql.DB, error) {
+	path := filepath.Join(t.TempDir(), "rw.db")
+	return func() (*sql.DB, error) {
+		return Connect("sqlite://"+path, PoolConfig{})
+	}
+}
+
+// newTestSQLiteService is a service on a new SQLite database, whose tables are created from the configuration,
+// that is closed with the test
+func newTestSQLiteService(t *testing.T, cfg *config.Config, options ...Option) *AuroraRWService {
+	conn, err := openTestSQLite(t)()
+	require.NoError(t, err)
+
+	service := newService(conn, sqliteDialect{}, false, cfg, options...)
+	t.Cleanup(func() {
+		service.Close()
+		conn.Close()
+	})
+	return service
+}
+
+func TestIsPoolClosed(t *testing.T) {
+	conn, err := openTestSQLite(t)()
+	require.NoError(t, err)
+	conn.Close()
+
+	_, err = conn.Exec("SELECT 1")
+	assert.True(t, isPoolClosed(err))
+	assert.True(t, isPoolClosed(sql.ErrConnDone))
+	assert.False(t, isPoolClosed(sql.ErrNoRows))
+	assert.False(t, isPoolClosed(nil))
+}
+
+// readTestConfig reads the configuration of the service in config.yml
+func readTestConfig(t *testing.T) *config.Config {
+	cfg, err := config.ReadConfig("../config.yml")
+	require.NoError(t, err)
+	return cfg
+}
+
+func TestPoolRecreate(t *testing.T) {
+	defer func(delay time.Duration) { poolDrainDelay = delay }(poolDrainDelay)
+	poolDrainDelay = 100 * time.Millisecond
+
+	open := openTestSQLite(t)
+	conn, err := open()
+	require.NoError(t, err)
+
+	opened := 0
+	p := newPool(conn)
+	p.open = func() (*sql.DB, error) {
+		opened++
+		return open()
+	}
+
+	require.NoError(t, p.recreate())
+	newConn, stmts := p.current()
+	defer newConn.Close()
+	assert.NotSame(t, conn, newConn)
+	assert.Same(t, newConn, stmts.conn, "statements are prepared on the new pool")
+	assert.NoError(t, conn.Ping(), "old pool stays open for the requests that took it")
+	assert.Eventually(t, func() bool { return conn.Ping() != nil }, time.Second, 10*time.Millisecond, "old pool is closed")
+
+	require.NoError(t, p.recreate())
+	assert.Equal(t, 1, opened, "pool is not recreated again immediately")
+	assert.Same(t, newConn, p.db())
+}
+
+func TestPoolCannotRecreateWithoutOpen(t *testing.T) {
+	conn, err := openTestSQLite(t)()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	p := newPool(conn)
+	assert.Equal(t, errCannotRecreatePool, p.recreate())
+	assert.Same(t, conn, p.db())
+}
+
+// readOnlySQLiteDialect reports that the database is read-only, as MySQL does for a demoted Aurora writer
+type readOnlySQLiteDialect struct {
+	sqliteDialect
+}
+
+func (readOnlySQLiteDialect) readOnlyQuery() string {
+	return "SELECT 1"
+}
+
+func TestWritableRecreatesReadOnlyPool(t *testing.T) {
+	open := openTestSQLite(t)
+	conn, err := open()
+	require.NoError(t, err)
+
+	service := newService(conn, readOnlySQLiteDialect{}, false, &config.Config{}, WithReconnect(open))
+	defer func() { service.writer.db().Close() }()
+
+	msg, err := service.Writable()
+	assert.Equal(t, errReadOnly, err)
+	assert.Equal(t, "Database is read-only", msg)
+	assert.NotSame(t, conn, service.writer.db(), "pool is recreated")
+
+	msg, err = service.Ping()
+	assert.NoError(t, err)
+	assert.Equal(t, "Ping OK, but the database is read-only", msg)
+}
+
+func TestWritable(t *testing.T) {
+	conn, err := openTestSQLite(t)()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	service := newService(conn, sqliteDialect{}, false, &config.Config{})
+
+	msg, err := service.Writable()
+	assert.NoError(t, err)
+	assert.Equal(t, "Database is writable", msg)
+}
+
+func TestSchemaCheckRecoversInBackground(t *testing.T) {
+	defer func(interval time.Duration) { minSchemaRetryInterval = interval }(minSchemaRetryInterval)
+	minSchemaRetryInterval = 10 * time.Millisecond
+
+	dir := filepath.Join(t.TempDir(), "not-yet-mounted")
+	conn, err := Connect("sqlite://"+filepath.Join(dir, "rw.db"), PoolConfig{})
+	require.Error(t, err, "database is unavailable")
+	defer conn.Close()
+
+	cfg, err := config.ReadConfig("../config.yml")
+	require.NoError(t, err)
+	service := newService(conn, sqliteDialect{}, true, cfg)
+	defer service.Close()
+
+	_, err = service.SchemaCheck()
+	assert.Error(t, err)
+
+	require.NoError(t, os.Mkdir(dir, 0700))
+	assert.Eventually(t, func() bool {
+		_, err := service.SchemaCheck()
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond, "schema check recovers once the database is available")
+}
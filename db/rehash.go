@@ -0,0 +1,118 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Rehash recomputes the hash of every document in a table with the table's hash mode, and rewrites the document
+// in its canonical form if the table stores it. It returns the number of rows that were scanned and updated.
+// A row that is written concurrently is left alone, since the write has already hashed it with the current mode.
+// Each rehashed document is recorded as an update in the change feed and the outbox, like a write, so that consumers see its new hash.
+func (service *AuroraRWService) Rehash(ctx context.Context, tableName string, batchSize int) (int, int, error) {
+	t, found := service.rwConfig[tableName]
+	if !found {
+		return 0, 0, fmt.Errorf("table %s is not configured", tableName)
+	}
+
+	docColumn := t.documentColumn()
+	if docColumn == "" {
+		return 0, 0, fmt.Errorf("document column is not configured for table %s", tableName)
+	}
+
+	update := service.dialect.rebind(fmt.Sprintf("UPDATE %s SET %s = ?, %s = ? WHERE %s = ? AND %s = ?", t.name, hashColumn, docColumn, t.primaryKey, hashColumn))
+	rehashLog := log.WithFields(log.Fields{"table": t.name, "hashMode": t.hashMode})
+
+	var scanned, updated int
+	err := service.walkTable(ctx, t, []string{docColumn, hashColumn}, "", batchSize, func(rows [][]string) error {
+		for _, row := range rows {
+			key, stored, storedHash := row[0], row[1], row[2]
+			scanned++
+
+			body, err := decompressBody(stored)
+			if err != nil {
+				rehashLog.WithError(err).WithField("key", key).Warn("unable to decompress document, skipping it")
+				continue
+			}
+
+			doc := t.hashDocument(ctx, NewDocument(body))
+			if doc.Hash == storedHash && bytes.Equal(doc.Body, body) {
+				continue
+			}
+
+			if !bytes.Equal(doc.Body, body) {
+				if stored, err = compressBody(t.compression, doc.Body); err != nil {
+					rehashLog.WithError(err).WithField("key", key).Warn("unable to compress document, storing it uncompressed")
+					stored = string(doc.Body)
+				}
+			}
+
+			rehashed, err := service.rehashDocument(ctx, t, update, key, storedHash, doc.Hash, stored)
+			if err != nil {
+				rehashLog.WithError(err).WithField("key", key).Error("unable to update document hash")
+				return err
+			}
+			if rehashed {
+				updated++
+				// a cached read of the document would otherwise serve the old hash until it expires
+				service.invalidateCache(t, key, doc.Hash)
+				if t.changeFeed {
+					service.changes.publish(t.name)
+				}
+			}
+		}
+
+		rehashLog.WithFields(log.Fields{"scanned": scanned, "updated": updated}).Info("rehashed batch of documents")
+		return nil
+	})
+
+	return scanned, updated, err
+}
+
+// rehashDocument stores the new hash of a document, unless it was written since it was read,
+// and records the change in the same transaction.
+func (service *AuroraRWService) rehashDocument(ctx context.Context, t table, update string, key string, storedHash string, newHash string, stored string) (bool, error) {
+	conn, stmts := service.writer.current()
+
+	// statements are prepared on the pool before the transaction takes a connection from it
+	queries := []string{update}
+	if service.outbox != nil {
+		queries = append(queries, service.outbox.insertSQL)
+	}
+	if t.changeFeed {
+		queries = append(queries, service.dialect.nextChangeSeqSQL(), t.changeSeqSQL)
+	}
+	if err := stmts.prepareAll(ctx, queries...); err != nil {
+		return false, err
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	ex := &txStatements{tx: tx, stmts: stmts}
+
+	res, err := ex.exec(ctx, update, newHash, stored, key, storedHash)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+
+	if t.changeFeed {
+		if err := service.recordChangeSeq(ctx, ex, t, key); err != nil {
+			return false, err
+		}
+	}
+	if service.outbox != nil {
+		if err := service.recordChange(ctx, ex, t, key, storedHash, newHash, Updated); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
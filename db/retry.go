@@ -0,0 +1,103 @@
+package db
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/Financial-Times/generic-rw-aurora/config"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultInitialBackoff = 50 * time.Millisecond
+	defaultMaxBackoff     = time.Second
+)
+
+// retryPolicy retries a write that failed with a transient error, with exponential backoff and full jitter.
+type retryPolicy struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+func newRetryPolicy(cfg config.RetryMapping) retryPolicy {
+	p := retryPolicy{maxAttempts: cfg.MaxAttempts, initialBackoff: cfg.InitialBackoff, maxBackoff: cfg.MaxBackoff}
+	if p.maxAttempts < 1 {
+		p.maxAttempts = 1
+	}
+	if p.initialBackoff <= 0 {
+		p.initialBackoff = defaultInitialBackoff
+	}
+	if p.maxBackoff < p.initialBackoff {
+		p.maxBackoff = defaultMaxBackoff
+		if p.maxBackoff < p.initialBackoff {
+			p.maxBackoff = p.initialBackoff
+		}
+	}
+	return p
+}
+
+// backoff returns a random delay of up to initialBackoff * 2^(attempt-1), capped at maxBackoff.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	ceiling := p.initialBackoff
+	for i := 1; i < attempt && ceiling < p.maxBackoff; i++ {
+		ceiling *= 2
+	}
+	if ceiling > p.maxBackoff {
+		ceiling = p.maxBackoff
+	}
+
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// retry calls write until it succeeds, fails with an error that is not transient, or the policy's attempts are used up.
+// It does not retry if the backoff would take it past the context deadline.
+// Each attempt is a separate transaction, so a failed attempt has been rolled back, unless it failed to commit.
+// An error from a pool that was closed after it was replaced is retried on the new pool.
+func (service *AuroraRWService) retry(ctx context.Context, p retryPolicy, write func() (WriteStatus, error)) (WriteStatus, error) {
+	var committed *WriteStatus
+	for attempt := 1; ; attempt++ {
+		status, err := write()
+		if commitErr, ok := err.(*commitError); ok {
+			committed = &commitErr.status
+			err = commitErr.err
+		} else if err == nil && status == Unchanged && committed != nil {
+			// an earlier attempt wrote the document, but its commit was reported as failed
+			status = *committed
+		}
+		if err == nil || attempt >= p.maxAttempts || !(service.dialect.isTransient(err) || isPoolClosed(err)) {
+			return status, err
+		}
+
+		delay := p.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return status, err
+		}
+
+		buildLogEntryFromContext(ctx).WithError(err).WithFields(log.Fields{"attempt": attempt, "backoff": delay}).Warn("transient database error, retrying write")
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return status, err
+		case <-timer.C:
+		}
+	}
+}
+
+// commitError is an error from the commit of a write. The connection may have been lost after the commit
+// succeeded, in which case the next attempt finds the document unchanged, and the write is reported with
+// the status that it was committed with.
+type commitError struct {
+	status WriteStatus
+	err    error
+}
+
+func (e *commitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *commitError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,121 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Financial-Times/generic-rw-aurora/config"
+	"github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+var errBusy = sqlite3.Error{Code: sqlite3.ErrBusy}
+
+func TestNewRetryPolicy(t *testing.T) {
+	p := newRetryPolicy(config.RetryMapping{})
+	assert.Equal(t, retryPolicy{maxAttempts: 1, initialBackoff: defaultInitialBackoff, maxBackoff: defaultMaxBackoff}, p)
+
+	p = newRetryPolicy(config.RetryMapping{MaxAttempts: 3, InitialBackoff: 2 * time.Second})
+	assert.Equal(t, retryPolicy{maxAttempts: 3, initialBackoff: 2 * time.Second, maxBackoff: 2 * time.Second}, p)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := retryPolicy{maxAttempts: 10, initialBackoff: 10 * time.Millisecond, maxBackoff: 50 * time.Millisecond}
+
+	for i := 0; i < 100; i++ {
+		assert.True(t, p.backoff(1) <= 10*time.Millisecond)
+		assert.True(t, p.backoff(2) <= 20*time.Millisecond)
+		assert.True(t, p.backoff(3) <= 40*time.Millisecond)
+		assert.True(t, p.backoff(8) <= 50*time.Millisecond)
+		assert.True(t, p.backoff(1) >= 0)
+	}
+}
+
+func countingWrite(failures int, err error) (func() (WriteStatus, error), *int) {
+	calls := 0
+	return func() (WriteStatus, error) {
+		calls++
+		if calls <= failures {
+			return Updated, err
+		}
+		return Created, nil
+	}, &calls
+}
+
+func TestRetryTransientError(t *testing.T) {
+	service := &AuroraRWService{dialect: sqliteDialect{}}
+	p := retryPolicy{maxAttempts: 3, initialBackoff: time.Millisecond, maxBackoff: time.Millisecond}
+
+	write, calls := countingWrite(2, errBusy)
+	status, err := service.retry(context.Background(), p, write)
+	assert.NoError(t, err)
+	assert.Equal(t, Created, status)
+	assert.Equal(t, 3, *calls)
+
+	write, calls = countingWrite(3, errBusy)
+	_, err = service.retry(context.Background(), p, write)
+	assert.Equal(t, errBusy, err, "attempts are used up")
+	assert.Equal(t, 3, *calls)
+}
+
+func TestRetryClosedPool(t *testing.T) {
+	service := &AuroraRWService{dialect: sqliteDialect{}}
+	p := retryPolicy{maxAttempts: 3, initialBackoff: time.Millisecond, maxBackoff: time.Millisecond}
+
+	write, calls := countingWrite(1, sql.ErrConnDone)
+	status, err := service.retry(context.Background(), p, write)
+	assert.NoError(t, err, "a pool that was replaced during the write is retried")
+	assert.Equal(t, Created, status)
+	assert.Equal(t, 2, *calls)
+}
+
+func TestRetryAmbiguousCommit(t *testing.T) {
+	service := &AuroraRWService{dialect: sqliteDialect{}}
+	p := retryPolicy{maxAttempts: 3, initialBackoff: time.Millisecond, maxBackoff: time.Millisecond}
+
+	calls := 0
+	write := func() (WriteStatus, error) {
+		calls++
+		if calls == 1 {
+			return Created, &commitError{status: Created, err: errBusy}
+		}
+		return Unchanged, nil
+	}
+	status, err := service.retry(context.Background(), p, write)
+	assert.NoError(t, err)
+	assert.Equal(t, Created, status, "the document found unchanged was written by the attempt whose commit failed")
+	assert.Equal(t, 2, calls)
+
+	write, _ = countingWrite(3, &commitError{status: Created, err: errBusy})
+	_, err = service.retry(context.Background(), p, write)
+	assert.Equal(t, errBusy, err, "the commit error is returned")
+}
+
+func TestRetryDoesNotRetryPermanentError(t *testing.T) {
+	service := &AuroraRWService{dialect: sqliteDialect{}}
+	p := retryPolicy{maxAttempts: 3, initialBackoff: time.Millisecond, maxBackoff: time.Millisecond}
+
+	write, calls := countingWrite(1, errors.New("syntax error"))
+	_, err := service.retry(context.Background(), p, write)
+	assert.EqualError(t, err, "syntax error")
+	assert.Equal(t, 1, *calls)
+}
+
+func TestRetryStaysWithinDeadline(t *testing.T) {
+	service := &AuroraRWService{dialect: sqliteDialect{}}
+	p := retryPolicy{maxAttempts: 100, initialBackoff: 20 * time.Millisecond, maxBackoff: 20 * time.Millisecond}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	write, calls := countingWrite(100, errBusy)
+	_, err := service.retry(ctx, p, write)
+	assert.Equal(t, errBusy, err)
+	assert.True(t, *calls > 1)
+	assert.True(t, *calls < 100)
+	assert.True(t, time.Since(start) < 150*time.Millisecond, "retries stop before the deadline")
+}
@@ -1,10 +1,21 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"embed"
 	"errors"
 	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	goose "github.com/Financial-Times/cm-goose" // forked from "github.com/pressly/goose"
 	log "github.com/sirupsen/logrus"
@@ -20,80 +31,233 @@ type migration struct {
 const (
 	dbLockName = "goose"
 
+	// DefaultMigrationLockTimeout is how long a migration waits for the lock held by another instance
+	DefaultMigrationLockTimeout = time.Minute
+
 	ErrDbLockFailure        = "unable to obtain database lock"
 	ErrDbReleaseLockFailure = "unable to release database lock"
 )
 
+var errSingleConnectionMigration = errors.New("migrations need at least 2 open database connections, one holds the migration lock while another migrates")
+
+var (
+	// migrations are loaded from the embedded migration files, unless LoadMigrations is called
+	migrations, requiredVersion = mustLoadMigrations(embeddedMigrations)
+
+	// supportStatements create the outbox, change sequence and backfill checkpoint tables as in the embedded migrations,
+	// for the databases whose tables are created from the configuration
+	supportStatements = supportTableStatements(migrations)
+
+	// the schema check is retried in the background with exponential backoff between these intervals
+	minSchemaRetryInterval = time.Second
+	maxSchemaRetryInterval = time.Minute
+
+	// migrationStatementTimeout bounds each statement of a migration, which may rebuild a large table
+	migrationStatementTimeout = time.Hour
+
+	// lockRetryInterval is how often an instance that is waiting for the migration lock tries to take it
+	lockRetryInterval = time.Second
+)
+
+// embeddedMigrations are the migration files for the tables in config.yml, in MySQL syntax
+//
+//go:embed migrations/*.sql
+var embeddedMigrations embed.FS
+
+// migrationFile is a versioned migration file name, e.g. 00001_initial-annotations-tables.up.sql
+var migrationFile = regexp.MustCompile(`^(\d+)_([A-Za-z0-9_-]+)\.(up|down)\.sql$`)
+
+// createSQLiteVersionTableSQL creates the goose version table for SQLite, whose tables are created from the configuration
+const createSQLiteVersionTableSQL = `CREATE TABLE IF NOT EXISTS goose_db_version (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	version_id INTEGER NOT NULL,
+	is_applied INTEGER NOT NULL,
+	tstamp TIMESTAMP DEFAULT (datetime('now'))
+)`
+
+// supportTables are the tables of the service itself, which are not in the configuration
+var supportTables = map[string]bool{outboxTable: true, changeSequenceTable: true, backfillCheckpointTable: true}
+
+// tableStatement matches a statement that creates a table, or adds a column to it
+var tableStatement = regexp.MustCompile(`(?is)^\s*(create table|alter table)\s+(\w+)(?:\s+add column\s+(\w+))?`)
+
+// supportStatement creates a support table, or adds a column to it if column is set
+type supportStatement struct {
+	table  string
+	column string
+	ddl    string
+}
+
+// supportTableStatements returns the statements of the migrations that create the support tables or add columns to them, in order
+func supportTableStatements(steps []migration) []supportStatement {
+	var stmts []supportStatement
+	for _, step := range steps {
+		for _, stmt := range strings.Split(step.apply, ";") {
+			match := tableStatement.FindStringSubmatch(stmt)
+			if match == nil || !supportTables[strings.ToLower(match[2])] {
+				continue
+			}
+			if strings.EqualFold(match[1], "alter table") && match[3] == "" {
+				continue
+			}
+			stmts = append(stmts, supportStatement{table: strings.ToLower(match[2]), column: strings.ToLower(match[3]), ddl: formatDDL(stmt)})
+		}
+	}
+	return stmts
+}
+
+// missing is true if the table, or the column that the statement adds, is not in the database
+func (stmt supportStatement) missing(existing map[string]map[string]columnInfo) bool {
+	columns, found := existing[stmt.table]
+	if stmt.column == "" || !found {
+		return !found
+	}
+	_, found = columns[stmt.column]
+	return !found
+}
+
+// rollback drops the table or the column that the statement adds
+func (stmt supportStatement) rollback() string {
+	if stmt.column == "" {
+		return fmt.Sprintf("drop table %s", stmt.table)
+	}
+	return fmt.Sprintf("alter table %s drop column %s", stmt.table, stmt.column)
+}
+
 var (
-	migrations = []migration{
-		{1, "initial-annotations-tables",
-			`create table draft_annotations (
-			uuid varchar(36) primary key,
-			last_modified varchar(32) not null,
-			publish_ref varchar(50) not null,
-			body mediumtext not null
-		);
-
-		create table published_annotations (
-			uuid varchar(36) primary key,
-			last_modified varchar(32) not null,
-			publish_ref varchar(50) not null,
-			body mediumtext not null
-		);
-		`,
-			`drop table published_annotations;
-
-		drop table draft_annotations;
-		`,
-		},
-		{2, "add-hash-annotations-tables",
-			`alter table draft_annotations add column hash varchar(56) not null;
-
-			alter table published_annotations add column hash varchar(56) not null;
-		`,
-			`alter table draft_annotations drop column hash;
-
-			alter table published_annotations drop column hash;
-		`,
-		},
-		{3, "initial-draft-content-table",
-			`create table draft_content (
-			uuid varchar(36) primary key,
-			last_modified varchar(32) not null,
-			draft_ref varchar(50) not null,
-			origin_system varchar(50) not null,
-			hash varchar(56) not null,
-			body mediumtext not null
-		);
-		`,
-			`drop table draft_content;
-		`,
-		},
-		{4, "add-content-type-draft-content-table",
-			`alter table draft_content add column content_type varchar(128) not null;
-		`,
-			`alter table draft_content drop column content_type;
-		`,
-		},
-	}
-	requiredVersion int64
+	registerLock         sync.Mutex
+	migrationsRegistered bool
+	// registeredDialect is the database the migrations are registered for, as goose has a single dialect per process
+	registeredDialect string
 )
 
-func init() {
-	goose.SetDialect("mysql")
+// registerMigrations registers the migrations with goose, adapted to the connected database, and sets the goose dialect,
+// once, before the first migration. The migrations cannot then run on another kind of database.
+func registerMigrations(d dialect) error {
+	registerLock.Lock()
+	defer registerLock.Unlock()
+	if migrationsRegistered {
+		if registeredDialect != d.name() {
+			return fmt.Errorf("migrations are registered for %s, they cannot run on %s", registeredDialect, d.name())
+		}
+		return nil
+	}
 
+	if err := goose.SetDialect(d.name()); err != nil {
+		return err
+	}
 	for _, step := range migrations {
-		goose.AddNamedMigration(step.filename(), exec(step.apply), exec(step.rollback))
-		requiredVersion = step.cardinal
+		goose.AddNamedMigration(step.filename(), exec(d, step.apply), exec(d, step.rollback))
 	}
+	migrationsRegistered = true
+	registeredDialect = d.name()
+	return nil
+}
+
+// LoadMigrations replaces the embedded migrations with the migration files in the directory,
+// which are named NNNNN_name.up.sql and NNNNN_name.down.sql, where NNNNN is the goose version.
+// It must be called before the service or a migrator is created.
+func LoadMigrations(dir string) error {
+	registerLock.Lock()
+	defer registerLock.Unlock()
+	if migrationsRegistered {
+		return errors.New("migrations are already registered")
+	}
+
+	steps, version, err := loadMigrations(os.DirFS(dir))
+	if err != nil {
+		return err
+	}
+	migrations, requiredVersion = steps, version
+	log.WithFields(log.Fields{"dir": dir, "requiredVersion": version}).Info("loaded migrations")
+	return nil
+}
+
+func mustLoadMigrations(fsys fs.FS) ([]migration, int64) {
+	sub, err := fs.Sub(fsys, "migrations")
+	if err != nil {
+		panic(err)
+	}
+	steps, version, err := loadMigrations(sub)
+	if err != nil {
+		panic(err)
+	}
+	return steps, version
+}
+
+// loadMigrations reads the migration files in the root of the file system, in version order,
+// and returns them with the latest version. A migration without a down file has no rollback.
+func loadMigrations(fsys fs.FS) ([]migration, int64, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	byVersion := make(map[int64]*migration)
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".sql" {
+			continue
+		}
+
+		match := migrationFile.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, 0, fmt.Errorf("invalid migration file name %s, expected NNNNN_name.up.sql or NNNNN_name.down.sql", entry.Name())
+		}
+		cardinal, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil || cardinal < 1 {
+			return nil, 0, fmt.Errorf("invalid migration version in %s", entry.Name())
+		}
+
+		content, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, 0, err
+		}
+
+		step, found := byVersion[cardinal]
+		if !found {
+			step = &migration{cardinal: cardinal, name: match[2]}
+			byVersion[cardinal] = step
+		}
+		if step.name != match[2] {
+			return nil, 0, fmt.Errorf("migration version %d has files with different names, %s and %s", cardinal, step.name, match[2])
+		}
+		if match[3] == "up" {
+			step.apply = string(content)
+		} else {
+			step.rollback = string(content)
+		}
+	}
+
+	var steps []migration
+	for _, step := range byVersion {
+		if strings.TrimSpace(step.apply) == "" {
+			return nil, 0, fmt.Errorf("migration %05d_%s has no up file", step.cardinal, step.name)
+		}
+		steps = append(steps, *step)
+	}
+	if len(steps) == 0 {
+		return nil, 0, errors.New("no migration files found")
+	}
+
+	sort.Slice(steps, func(i, j int) bool { return steps[i].cardinal < steps[j].cardinal })
+	return steps, steps[len(steps)-1].cardinal, nil
 }
 
 func (m *migration) filename() string {
 	return fmt.Sprintf("%05d_%s.go", m.cardinal, m.name)
 }
 
-func (service *AuroraRWService) migrate(apply bool) error {
-	currentVersion, err := goose.GetDBVersion(service.conn)
+func (service *AuroraRWService) migrate(ctx context.Context, apply bool) error {
+	if service.dialect.createsTablesFromMapping() {
+		return service.createTables(ctx)
+	}
+
+	if err := registerMigrations(service.dialect); err != nil {
+		log.WithError(err).Error("unable to set database dialect")
+		return err
+	}
+
+	currentVersion, err := goose.GetDBVersion(service.writer.db())
 	if err != nil {
 		log.WithError(err).Error("unable to discover DB version")
 		return err
@@ -102,7 +266,7 @@ func (service *AuroraRWService) migrate(apply bool) error {
 	if requiredVersion > currentVersion {
 		if apply {
 			log.WithFields(log.Fields{"from": currentVersion, "to": requiredVersion}).Info("migrating database")
-			err = doMigrate(service.conn)
+			err = doMigrate(ctx, service.writer.db(), service.dialect, service.migrationLockTimeout)
 			if err != nil {
 				log.WithError(err).Errorf("migrating database from %v to %v failed", currentVersion, requiredVersion)
 				err = errors.New(fmt.Sprintf("migrating database from %v to %v failed", currentVersion, requiredVersion))
@@ -114,60 +278,216 @@ func (service *AuroraRWService) migrate(apply bool) error {
 		return errors.New(fmt.Sprintf("migrating database DOWN from %v to %v is required", currentVersion, requiredVersion))
 	}
 
-	if err == nil {
-		service.schemaVersion, _ = goose.GetDBVersion(service.conn)
-		log.WithField("schemaVersion", service.schemaVersion).Info("database schema checked")
+	if err == nil && service.autoCreateTables {
+		err = service.createMissingTables(ctx)
 	}
 
-	return err
+	if err != nil {
+		return err
+	}
+
+	version, err := goose.GetDBVersion(service.writer.db())
+	if err != nil {
+		log.WithError(err).Error("unable to discover DB version")
+		return err
+	}
+	service.setSchemaVersion(version)
+	log.WithField("schemaVersion", version).Info("database schema checked")
+	return nil
 }
 
-func doMigrate(conn *sql.DB) error {
-	var locked int
-	lock, err := conn.Query("SELECT get_lock(?, 1)", dbLockName)
+// createTables creates any missing tables from the configured column mappings, with every column as text.
+func (service *AuroraRWService) createTables(ctx context.Context) error {
+	for _, t := range service.rwConfig {
+		var defs []string
+		for _, col := range t.valueColumns {
+			defs = append(defs, fmt.Sprintf("%s text not null default ''", col))
+		}
+		if t.changeFeed {
+			defs = append(defs, fmt.Sprintf("%s integer not null default 0", changeSeqColumn))
+		}
+
+		stmt := fmt.Sprintf("create table if not exists %s (%s, primary key (%s))", t.name, strings.Join(defs, ", "), t.primaryKey)
+		log.Infof("apply: %s", stmt)
+		if _, err := service.writer.db().ExecContext(ctx, stmt); err != nil {
+			log.WithError(err).WithField("table", t.name).Error("unable to create table")
+			return err
+		}
+	}
+
+	existing, err := existingColumns(ctx, service.writer.db(), service.dialect)
 	if err != nil {
-		log.WithError(err).Info("unable to obtain database lock")
+		log.WithError(err).Error("unable to read database columns")
 		return err
 	}
+	for _, stmt := range supportStatements {
+		if !stmt.missing(existing) {
+			continue
+		}
+		if _, err := service.writer.db().ExecContext(ctx, service.dialect.ddl(stmt.ddl)); err != nil {
+			log.WithError(err).WithField("table", stmt.table).Error("unable to create table")
+			return err
+		}
+		if existing[stmt.table] == nil {
+			existing[stmt.table] = make(map[string]columnInfo)
+		}
+		existing[stmt.table][stmt.column] = columnInfo{}
+	}
 
-	defer lock.Close()
-	lock.Next()
-	lock.Scan(&locked)
-	if locked != 1 {
-		log.Warn(ErrDbLockFailure)
-		return errors.New(ErrDbLockFailure)
+	// the tables have no migrations, but the version table is created as goose would, as it is also used to check the connection
+	if _, err := service.writer.db().ExecContext(ctx, createSQLiteVersionTableSQL); err != nil {
+		log.WithError(err).Error("unable to create the version table")
+		return err
 	}
 
-	defer releaseLock(conn)
+	service.setSchemaVersion(0)
+	log.Info("database tables created from configuration")
+	return nil
+}
+
+func (service *AuroraRWService) setSchemaVersion(version int64) {
+	service.schemaLock.Lock()
+	defer service.schemaLock.Unlock()
+	service.schemaVersion = version
+}
+
+func (service *AuroraRWService) setSchemaMismatch(err error) {
+	service.schemaLock.Lock()
+	defer service.schemaLock.Unlock()
+	service.schemaMismatch = err
+}
 
-	return goose.UpTo(conn, ".", requiredVersion)
+// ping checks that the writer is reachable, within the time allowed for a health check.
+func (service *AuroraRWService) ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), monitorTimeout)
+	defer cancel()
+	return service.writer.db().PingContext(ctx)
 }
 
-func releaseLock(conn *sql.DB) {
-	unlock, err := conn.Query("SELECT release_lock(?)", dbLockName)
+// retrySchemaCheck re-runs the schema check, and the migration if it is enabled, in the background until it succeeds.
+// The service then recovers by itself if the database was unavailable when it started, or was migrated by another instance.
+func (service *AuroraRWService) retrySchemaCheck(apply bool) {
+	interval := minSchemaRetryInterval
+	for {
+		select {
+		case <-service.done:
+			return
+		case <-time.After(interval):
+		}
+
+		if interval *= 2; interval > maxSchemaRetryInterval {
+			interval = maxSchemaRetryInterval
+		}
+
+		if err := service.ping(); err != nil {
+			log.WithError(err).WithField("retryIn", interval).Warn("database is unavailable, retrying schema check")
+			continue
+		}
+
+		err := service.migrate(context.Background(), apply)
+		service.setSchemaMismatch(err)
+		if err == nil {
+			log.Info("database schema check recovered")
+			return
+		}
+		log.WithError(err).WithField("retryIn", interval).Warn("database schema check failed, retrying")
+	}
+}
+
+func doMigrate(ctx context.Context, conn *sql.DB, d dialect, lockTimeout time.Duration) error {
+	return withMigrationLock(ctx, conn, d, lockTimeout, func() error {
+		// another instance may have migrated the database while this one waited for the lock
+		version, err := goose.GetDBVersion(conn)
+		if err != nil {
+			log.WithError(err).Error("unable to discover DB version")
+			return err
+		}
+		if version >= requiredVersion {
+			log.WithField("schemaVersion", version).Info("database was migrated by another instance")
+			return nil
+		}
+		return goose.UpTo(conn, ".", requiredVersion)
+	})
+}
+
+// withMigrationLock runs the migration while holding the database lock, so that only one instance migrates at a time.
+// It waits for up to lockTimeout for another instance to release the lock.
+// The lock is held by a session, so it is taken and released on a connection that is pinned for its lifetime.
+// The migration runs on the pool, so the pool must allow a second connection.
+func withMigrationLock(ctx context.Context, conn *sql.DB, d dialect, lockTimeout time.Duration, migrate func() error) error {
+	if conn.Stats().MaxOpenConnections == 1 {
+		log.Error(errSingleConnectionMigration.Error())
+		return errSingleConnectionMigration
+	}
+
+	session, err := conn.Conn(ctx)
 	if err != nil {
-		log.WithError(err).Error(ErrDbReleaseLockFailure)
+		log.WithError(err).Info("unable to obtain database lock")
+		return err
+	}
+	defer session.Close()
+
+	if err := acquireLock(ctx, session, d, lockTimeout); err != nil {
+		return err
 	}
+	defer releaseLock(session, d)
+
+	return migrate()
+}
+
+func acquireLock(ctx context.Context, session *sql.Conn, d dialect, lockTimeout time.Duration) error {
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		var locked int
+		if err := session.QueryRowContext(ctx, d.lockQuery(), dbLockName).Scan(&locked); err != nil {
+			log.WithError(err).Info("unable to obtain database lock")
+			return err
+		}
+		if locked == 1 {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			log.WithField("lockTimeout", lockTimeout).Warn(ErrDbLockFailure)
+			return errors.New(ErrDbLockFailure)
+		}
+		log.Info("database lock is held by another instance, waiting")
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+// releaseLock releases the lock, even if the migration was cancelled.
+// If it cannot be released, the session is discarded, which releases it.
+func releaseLock(session *sql.Conn, d dialect) {
+	ctx, cancel := context.WithTimeout(context.Background(), monitorTimeout)
+	defer cancel()
 
-	defer unlock.Close()
-	unlock.Next()
 	var unlocked int
-	unlock.Scan(&unlocked)
-	unlock.Close()
-	if unlocked != 1 {
-		log.Error(ErrDbReleaseLockFailure)
+	err := session.QueryRowContext(ctx, d.releaseLockQuery(), dbLockName).Scan(&unlocked)
+	if err == nil && unlocked == 1 {
+		return
 	}
+
+	log.WithError(err).Error(ErrDbReleaseLockFailure)
+	session.Raw(func(interface{}) error {
+		return driver.ErrBadConn
+	})
 }
 
-func exec(sqlStatements string) func(*sql.Tx) error {
+// exec runs the statements of a migration in the transaction that goose begins for it, each bounded by migrationStatementTimeout
+func exec(d dialect, sqlStatements string) func(*sql.Tx) error {
 	return func(tx *sql.Tx) error {
-		for _, stmt := range strings.Split(sqlStatements, ";") {
-			if len(strings.TrimSpace(stmt)) == 0 {
-				continue
-			}
-
+		for _, stmt := range migrationStatements(d, sqlStatements) {
 			log.Infof("apply: %s", stmt)
-			if _, err := tx.Exec(stmt); err != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), migrationStatementTimeout)
+			_, err := tx.ExecContext(ctx, stmt)
+			cancel()
+			if err != nil {
 				return err
 			}
 		}
@@ -175,3 +495,15 @@ func exec(sqlStatements string) func(*sql.Tx) error {
 		return nil
 	}
 }
+
+// migrationStatements splits the statements of a migration, adapted to the database
+func migrationStatements(d dialect, sqlStatements string) []string {
+	var stmts []string
+	for _, stmt := range strings.Split(sqlStatements, ";") {
+		if len(strings.TrimSpace(stmt)) == 0 {
+			continue
+		}
+		stmts = append(stmts, d.ddl(stmt))
+	}
+	return stmts
+}
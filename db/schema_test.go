@@ -0,0 +1,132 @@
+package db
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	steps, version := mustLoadMigrations(embeddedMigrations)
+	require.NotEmpty(t, steps)
+	assert.Equal(t, steps[len(steps)-1].cardinal, version)
+
+	// the goose versions of the migrations that were applied before they were moved to files
+	assert.Equal(t, migration{1, "initial-annotations-tables", steps[0].apply, steps[0].rollback}, steps[0])
+	assert.Equal(t, "add-hash-annotations-tables", steps[1].name)
+	assert.Equal(t, "initial-draft-content-table", steps[2].name)
+	assert.Equal(t, "add-content-type-draft-content-table", steps[3].name)
+	assert.Equal(t, "initial-change-outbox-table", steps[4].name)
+	assert.Equal(t, "add-change-feed-sequence", steps[5].name)
+	assert.Equal(t, "initial-backfill-checkpoint-table", steps[6].name)
+	assert.Len(t, steps, 7)
+	for i, step := range steps {
+		assert.Equal(t, int64(i+1), step.cardinal)
+		assert.NotEmpty(t, step.apply)
+		assert.NotEmpty(t, step.rollback)
+		// drop index ... on ... is MySQL syntax, and dropping the columns drops their indexes in every database
+		assert.NotContains(t, step.rollback, "drop index", step.name)
+	}
+	assert.Contains(t, steps[0].apply, "create table draft_annotations (")
+	assert.Equal(t, "drop table draft_content;\n", steps[2].rollback)
+}
+
+func TestSupportTableStatements(t *testing.T) {
+	steps := []migration{
+		{1, "initial-things-table", "create table things (id varchar(36) primary key);", ""},
+		{2, "initial-change-outbox-table", "create table change_outbox (\n  id bigint auto_increment primary key\n);\n", ""},
+		{3, "add-things-column", "alter table things add column colour varchar(16);\nalter table change_outbox add column claimed_by varchar(64) not null default '';", ""},
+		{4, "add-change-sequence-index", "create index change_sequence_seq on change_sequence (seq);", ""},
+	}
+
+	stmts := supportTableStatements(steps)
+	assert.Equal(t, []supportStatement{
+		{outboxTable, "", "create table change_outbox (\n\tid bigint auto_increment primary key\n)"},
+		{outboxTable, "claimed_by", "alter table change_outbox add column claimed_by varchar(64) not null default ''"},
+	}, stmts, "only the statements that create the support tables or add their columns")
+
+	assert.True(t, stmts[0].missing(map[string]map[string]columnInfo{}))
+	assert.False(t, stmts[0].missing(map[string]map[string]columnInfo{outboxTable: {"id": {}}}))
+	assert.True(t, stmts[1].missing(map[string]map[string]columnInfo{outboxTable: {"id": {}}}))
+	assert.False(t, stmts[1].missing(map[string]map[string]columnInfo{outboxTable: {"id": {}, "claimed_by": {}}}))
+	assert.Equal(t, "drop table change_outbox", stmts[0].rollback())
+	assert.Equal(t, "alter table change_outbox drop column claimed_by", stmts[1].rollback())
+}
+
+func TestEmbeddedMigrationsCreateSupportTables(t *testing.T) {
+	tables := make(map[string]bool)
+	for _, stmt := range supportStatements {
+		if stmt.column == "" {
+			tables[stmt.table] = true
+		}
+	}
+	assert.Equal(t, supportTables, tables, "the tables created from the configuration have the same support tables as the migrated tables")
+}
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"00002_add-things-column.up.sql":      {Data: []byte("alter table things add column colour varchar(16);")},
+		"00001_initial-things-table.up.sql":   {Data: []byte("create table things (id varchar(36) primary key);")},
+		"00001_initial-things-table.down.sql": {Data: []byte("drop table things;")},
+		"README.md":                           {Data: []byte("not a migration")},
+	}
+
+	steps, version, err := loadMigrations(fsys)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), version)
+	assert.Equal(t, []migration{
+		{1, "initial-things-table", "create table things (id varchar(36) primary key);", "drop table things;"},
+		{2, "add-things-column", "alter table things add column colour varchar(16);", ""},
+	}, steps, "a migration without a down file has no rollback")
+}
+
+func TestLoadMigrationsInvalid(t *testing.T) {
+	for name, test := range map[string]struct {
+		fsys fstest.MapFS
+		err  string
+	}{
+		"invalid name": {
+			fstest.MapFS{"initial-things-table.sql": {Data: []byte("create table things;")}},
+			"invalid migration file name initial-things-table.sql, expected NNNNN_name.up.sql or NNNNN_name.down.sql",
+		},
+		"zero version": {
+			fstest.MapFS{"00000_initial-things-table.up.sql": {Data: []byte("create table things;")}},
+			"invalid migration version in 00000_initial-things-table.up.sql",
+		},
+		"no up file": {
+			fstest.MapFS{"00001_initial-things-table.down.sql": {Data: []byte("drop table things;")}},
+			"migration 00001_initial-things-table has no up file",
+		},
+		"different names": {
+			fstest.MapFS{
+				"00001_initial-things-table.up.sql": {Data: []byte("create table things;")},
+				"00001_initial-things.down.sql":     {Data: []byte("drop table things;")},
+			},
+			"migration version 1 has files with different names, initial-things-table and initial-things",
+		},
+		"empty": {
+			fstest.MapFS{},
+			"no migration files found",
+		},
+	} {
+		_, _, err := loadMigrations(test.fsys)
+		assert.EqualError(t, err, test.err, name)
+	}
+}
+
+func TestLoadMigrationsAfterRegistration(t *testing.T) {
+	registerLock.Lock()
+	registered := migrationsRegistered
+	migrationsRegistered = true
+	registerLock.Unlock()
+	defer func() {
+		registerLock.Lock()
+		migrationsRegistered = registered
+		registerLock.Unlock()
+	}()
+
+	err := LoadMigrations(t.TempDir())
+	assert.EqualError(t, err, "migrations are already registered")
+}
@@ -7,52 +7,186 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Financial-Times/generic-rw-aurora/config"
 	tid "github.com/Financial-Times/transactionid-utils-go"
-	"github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
 	"github.com/oliveagle/jsonpath"
+	"github.com/rcrowley/go-metrics"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
 	testSql = "SELECT COUNT(*) FROM goose_db_version"
+	// monitorTimeout bounds the queries of the health checks, which are not given a request context
+	monitorTimeout = 5 * time.Second
 )
 
 const hashColumn = "hash"
 const conflictLogMessage = "document hash conflict detected while updating document"
 
-const Created = true
-const Updated = false
+// WriteStatus is the outcome of a write.
+type WriteStatus int
+
+const (
+	Updated WriteStatus = iota
+	Created
+	// Unchanged means that the stored document already had the same hash, so it was not rewritten
+	Unchanged
+)
 
 const contextDocumentKey = "contextDocumentKey"
 const contextTable = "contextTable"
+const contextLastWrittenHash = "contextLastWrittenHash"
 
 var errDataNotAffectedByOperation = errors.New("data is not affected by the operation")
+var errReadOnly = errors.New("database is read-only")
 
 type RWMonitor interface {
 	Ping() (string, error)
 	SchemaCheck() (string, error)
+	Writable() (string, error)
+}
+
+// TableChecker verifies the columns of the table of a configured path. The RWMonitors that can check tables implement it.
+type TableChecker interface {
+	TableCheck(path string, mapping config.Mapping) (string, error)
 }
 
 type RWService interface {
 	Read(ctx context.Context, table string, key string) (Document, error)
-	Write(ctx context.Context, table string, key string, doc Document, params map[string]string, previousDocumentHash string) (bool, string, error)
+	Write(ctx context.Context, table string, key string, doc Document, params map[string]string, previousDocumentHash string) (WriteStatus, string, error)
 }
 
 type table struct {
+	// path is the configured endpoint path of the table, which is recorded in its change events
+	path                 string
 	name                 string
 	columns              map[string]string
+	columnTypes          map[string]string
 	primaryKey           string
 	hasConflictDetection bool
+	// updateMetadataWhenUnchanged rewrites the columns other than the document when the document is unchanged
+	updateMetadataWhenUnchanged bool
+	compression                 string
+	hashMode                    string
+	storeCanonical              bool
+	cacheTTL                    time.Duration
+	changeFeed                  bool
+	retry                       retryPolicy
+	responseHeaders             map[string]string
+
+	// precomputed by compile, in a deterministic order
+	valueColumns      []string
+	metadataColumns   []string
+	readHashSQL       string
+	lockRowSQL        string
+	insertSQL         string
+	updateSQL         string
+	updateByKeySQL    string
+	updateMetadataSQL string
+	upsertSQL         string
+	readSQL           string
+	readHeaders       []string
+	changeSeqSQL      string
+	changesSQL        string
 }
 
 type AuroraRWService struct {
-	conn               *sql.DB
-	schemaVersion      int64
-	schemaMismatch     error
-	rwConfig           map[string]table
-	httpResponseConfig map[string]map[string]string
+	writer         *pool
+	reader         *pool
+	dialect        dialect
+	schemaLock     sync.RWMutex
+	schemaVersion  int64
+	schemaMismatch error
+	done           chan struct{}
+	closeOnce      sync.Once
+	rwConfig       map[string]table
+	cache          *readCache
+	outbox         *outbox
+	changes        changeBus
+	tableColumns   tableColumns
+	// instanceID identifies this instance of the service in its claims on shared rows
+	instanceID string
+
+	passwordFile         string
+	passwordPollInterval time.Duration
+	migrationLockTimeout time.Duration
+	autoCreateTables     bool
+	// backfills are the progress of the backfills started in this instance, by table
+	backfills    map[string]BackfillProgress
+	backfillLock sync.Mutex
+}
+
+// Option configures optional behaviour of an AuroraRWService.
+type Option func(*AuroraRWService)
+
+// WithReader routes reads to a separate connection pool, typically the Aurora reader endpoint.
+// Reads fall back to the writer if the reader fails.
+func WithReader(readConn *sql.DB) Option {
+	return func(service *AuroraRWService) {
+		service.reader = newPool(readConn)
+	}
+}
+
+// WithReconnect allows the writer's connection pool to be recreated with the open function,
+// which happens when the writer turns out to be read-only after an Aurora failover.
+func WithReconnect(open func() (*sql.DB, error)) Option {
+	return func(service *AuroraRWService) {
+		service.writer.open = open
+	}
+}
+
+// WithReaderReconnect allows the reader's connection pool to be recreated with the open function.
+func WithReaderReconnect(open func() (*sql.DB, error)) Option {
+	return func(service *AuroraRWService) {
+		if service.reader != nil {
+			service.reader.open = open
+		}
+	}
+}
+
+// WithReadCache caches up to size documents read from the tables that have a cache TTL,
+// and records the cache hits and misses in the metrics registry.
+func WithReadCache(size int, registry metrics.Registry) Option {
+	return func(service *AuroraRWService) {
+		cache, err := newReadCache(size, registry)
+		if err != nil {
+			log.WithError(err).WithField("size", size).Error("unable to create read cache, reads will not be cached")
+			return
+		}
+		service.cache = cache
+	}
+}
+
+// WithMigrationLockTimeout is how long the service waits at startup for another instance to finish migrating the schema
+// before it reports a schema mismatch, and retries the schema check in the background.
+func WithMigrationLockTimeout(timeout time.Duration) Option {
+	return func(service *AuroraRWService) {
+		service.migrationLockTimeout = timeout
+	}
+}
+
+// WithAutoCreateTables creates the configured tables and columns that are missing from the database at startup,
+// after the schema check, which is intended for development environments.
+func WithAutoCreateTables() Option {
+	return func(service *AuroraRWService) {
+		service.autoCreateTables = true
+	}
+}
+
+// ContextWithLastWrittenHash records the hash of the last document written by the client,
+// so that a read from a stale replica is retried against the writer.
+func ContextWithLastWrittenHash(ctx context.Context, hash string) context.Context {
+	return context.WithValue(ctx, contextLastWrittenHash, hash)
+}
+
+// LastWrittenHash returns the hash recorded by ContextWithLastWrittenHash, or an empty string if there is none.
+func LastWrittenHash(ctx context.Context) string {
+	hash, _ := ctx.Value(contextLastWrittenHash).(string)
+	return hash
 }
 
 func (t *table) columnMapping() string {
@@ -64,43 +198,156 @@ func (t *table) columnMapping() string {
 	return mapping[1:]
 }
 
-func NewService(conn *sql.DB, migrate bool, rwConfig *config.Config) *AuroraRWService {
+// documentColumn returns the column that holds the whole document, or an empty string if there is none.
+func (t *table) documentColumn() string {
+	for col, expr := range t.columns {
+		if expr == "$" {
+			return col
+		}
+	}
+
+	return ""
+}
+
+// newTable maps the configuration of a path to its table
+func newTable(path string, tableConfig config.Mapping) table {
+	return table{
+		path:                        path,
+		name:                        tableConfig.Table,
+		columns:                     tableConfig.Columns,
+		columnTypes:                 tableConfig.ColumnTypes,
+		primaryKey:                  tableConfig.PrimaryKey,
+		hasConflictDetection:        tableConfig.HasConflictDetection,
+		updateMetadataWhenUnchanged: tableConfig.UpdateMetadataWhenUnchanged,
+		compression:                 tableConfig.Compression,
+		hashMode:                    tableConfig.HashMode,
+		storeCanonical:              tableConfig.StoreCanonical,
+		cacheTTL:                    tableConfig.CacheTTL,
+		changeFeed:                  tableConfig.ChangeFeed,
+		retry:                       newRetryPolicy(tableConfig.Retry),
+		responseHeaders:             tableConfig.Response.Headers,
+	}
+}
+
+func newTableMappings(rwConfig *config.Config) map[string]table {
 	tables := make(map[string]table)
-	responseHeaders := make(map[string]map[string]string)
-	for _, tableConfig := range rwConfig.Paths {
-		t := table{
-			tableConfig.Table,
-			tableConfig.Columns,
-			tableConfig.PrimaryKey,
-			tableConfig.HasConflictDetection,
+	for path, tableConfig := range rwConfig.Paths {
+		t := newTable(path, tableConfig)
+		if !isSupportedCompression(t.compression) {
+			log.WithFields(log.Fields{"table": t.name, "compression": t.compression}).Error("unsupported compression, documents will be stored uncompressed")
+			t.compression = ""
+		}
+		if !isSupportedHashMode(t.hashMode) {
+			log.WithFields(log.Fields{"table": t.name, "hashMode": t.hashMode}).Error("unsupported hash mode, documents will be hashed raw")
+			t.hashMode = hashModeRaw
 		}
 		tables[tableConfig.Table] = t
-		log.WithFields(log.Fields{"table": t.name, "primaryKey": t.primaryKey, "columnMapping": t.columnMapping()}).Info("mapping initialised")
+		log.WithFields(log.Fields{"table": t.name, "primaryKey": t.primaryKey, "columnMapping": t.columnMapping(), "compression": t.compression, "hashMode": t.hashMode}).Info("mapping initialised")
+	}
 
-		if tableConfig.Response.Headers != nil {
-			responseHeaders[tableConfig.Table] = tableConfig.Response.Headers
-		}
+	return tables
+}
+
+func NewService(conn *sql.DB, migrate bool, rwConfig *config.Config, options ...Option) *AuroraRWService {
+	return newService(conn, dialectFor(conn), migrate, rwConfig, options...)
+}
+
+func newService(conn *sql.DB, d dialect, migrate bool, rwConfig *config.Config, options ...Option) *AuroraRWService {
+	tables := newTableMappings(rwConfig)
+	for name, t := range tables {
+		t.compile(d)
+		tables[name] = t
+	}
+
+	service := &AuroraRWService{writer: newPool(conn), dialect: d, rwConfig: tables, done: make(chan struct{}), instanceID: uuid.New().String(), migrationLockTimeout: DefaultMigrationLockTimeout}
+	for _, option := range options {
+		option(service)
+	}
+	if service.passwordFile != "" {
+		service.watchPasswordFile()
+	}
+	if service.outbox != nil && service.outbox.notifier != nil {
+		go service.publishOutbox()
 	}
-	service := &AuroraRWService{conn: conn, rwConfig: tables, httpResponseConfig: responseHeaders}
 
-	if err := service.migrate(migrate); err != nil {
+	if err := service.migrate(context.Background(), migrate); err != nil {
 		log.WithError(err).Error("failed to migrate db")
-		service.schemaMismatch = err
+		service.setSchemaMismatch(err)
+		go service.retrySchemaCheck(migrate)
 	}
 
 	return service
 }
 
+// Close stops the background work of the service. It does not close the connection pools.
+func (service *AuroraRWService) Close() {
+	service.closeOnce.Do(func() {
+		close(service.done)
+	})
+}
+
 func (service *AuroraRWService) Ping() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), monitorTimeout)
+	defer cancel()
+
 	var result interface{}
-	if err := service.conn.QueryRow(testSql).Scan(&result); err != nil {
+	if err := service.writer.db().QueryRowContext(ctx, testSql).Scan(&result); err != nil {
 		return fmt.Sprintf("Ping Not OK: %s", err.Error()), err
 	}
 
+	if readOnly, err := service.checkReadOnly(ctx); err == nil && readOnly {
+		return "Ping OK, but the database is read-only", nil
+	}
+
 	return "Ping OK", nil
 }
 
+// Writable checks that the writer is connected to a writable instance, and recreates its connection pool if it is not.
+func (service *AuroraRWService) Writable() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), monitorTimeout)
+	defer cancel()
+
+	readOnly, err := service.checkReadOnly(ctx)
+	if err != nil {
+		return fmt.Sprintf("Unable to check whether the database is writable: %s", err.Error()), err
+	}
+	if readOnly {
+		return "Database is read-only", errReadOnly
+	}
+
+	return "Database is writable", nil
+}
+
+// checkReadOnly reports whether the writer is connected to a read-only instance, and recreates its connection pool if it is.
+func (service *AuroraRWService) checkReadOnly(ctx context.Context) (bool, error) {
+	var readOnly int
+	if err := service.writer.db().QueryRowContext(ctx, service.dialect.readOnlyQuery()).Scan(&readOnly); err != nil {
+		return false, err
+	}
+	if readOnly == 0 {
+		return false, nil
+	}
+
+	service.recreateWriter()
+	return true, nil
+}
+
+// recreateWriter replaces the writer's connection pool, whose connections are to an instance that has become read-only.
+func (service *AuroraRWService) recreateWriter() {
+	log.Warn("database is read-only, recreating the connection pool")
+	if err := service.writer.recreate(); err != nil {
+		log.WithError(err).Error("unable to recreate the connection pool")
+	}
+}
+
 func (service *AuroraRWService) SchemaCheck() (string, error) {
+	service.schemaLock.RLock()
+	defer service.schemaLock.RUnlock()
+
+	if service.schemaMismatch == nil && service.dialect.createsTablesFromMapping() {
+		return "Database tables are created from the configuration", nil
+	}
+
 	if service.schemaMismatch == nil {
 		return fmt.Sprintf("Database schema is at version %d", service.schemaVersion), nil
 	}
@@ -109,38 +356,61 @@ func (service *AuroraRWService) SchemaCheck() (string, error) {
 }
 
 func (service *AuroraRWService) Read(ctx context.Context, tableName string, key string) (Document, error) {
-	txid, _ := tid.GetTransactionIDFromContext(ctx)
-	readLog := log.WithField("table", tableName).
-		WithField("key", key).
-		WithField(tid.TransactionIDKey, txid)
+	t := service.rwConfig[tableName]
+	if service.cache == nil || t.cacheTTL <= 0 {
+		return service.readFromDatabase(ctx, tableName, key)
+	}
 
-	readLog.Info("Reading document from database")
-	table := service.rwConfig[tableName]
-	var docColumn string
+	lastWrittenHash := LastWrittenHash(ctx)
+	if doc, found := service.cache.get(tableName, key); found && (lastWrittenHash == "" || lastWrittenHash == doc.Hash) {
+		return doc, nil
+	}
 
-	for col, expr := range table.columns {
-		if expr == "$" {
-			docColumn = col
-			break
+	doc, err := service.readFromDatabase(ctx, tableName, key)
+	if err == nil {
+		service.cache.put(tableName, key, doc, t.cacheTTL)
+	}
+	return doc, err
+}
+
+func (service *AuroraRWService) readFromDatabase(ctx context.Context, tableName string, key string) (Document, error) {
+	_, stmts := service.writer.current()
+	if service.reader == nil {
+		return service.readDocument(ctx, stmts, tableName, key)
+	}
+
+	_, readStmts := service.reader.current()
+	doc, err := service.readDocument(ctx, readStmts, tableName, key)
+	if err != nil && err != sql.ErrNoRows {
+		// a read that was cancelled or timed out is not retried, as the request has already been answered
+		if ctx.Err() != nil {
+			return doc, err
 		}
+		buildReadLogEntry(ctx, tableName, key).WithError(err).Warn("unable to read from replica, falling back to writer")
+		return service.readDocument(ctx, stmts, tableName, key)
 	}
 
-	if docColumn == "" {
-		readLog.Error("document column is not configured")
-		return Document{}, fmt.Errorf("document column is not configured for table %s", tableName)
+	if lastWrittenHash := LastWrittenHash(ctx); lastWrittenHash != "" && lastWrittenHash != doc.Hash {
+		buildReadLogEntry(ctx, tableName, key).Info("replica is stale, reading from writer")
+		return service.readDocument(ctx, stmts, tableName, key)
 	}
 
-	responseHeaderCols := []string{docColumn, hashColumn}
-	sqlToHeaderMap := make(map[string]string)
-	for k, v := range service.httpResponseConfig[tableName] {
-		responseHeaderCols = append(responseHeaderCols, v)
-		sqlToHeaderMap[v] = k
+	return doc, err
+}
+
+func (service *AuroraRWService) readDocument(ctx context.Context, ex executor, tableName string, key string) (Document, error) {
+	readLog := buildReadLogEntry(ctx, tableName, key)
+
+	readLog.Info("Reading document from database")
+	table := service.rwConfig[tableName]
+	if table.readSQL == "" {
+		readLog.Error("document column is not configured")
+		return Document{}, fmt.Errorf("document column is not configured for table %s", tableName)
 	}
 
-	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = ?", strings.Join(responseHeaderCols, ","), table.name, table.primaryKey)
-	readLog.Info(query)
+	readLog.Info(table.readSQL)
 
-	rows, err := service.conn.Query(query, key)
+	rows, err := ex.query(ctx, table.readSQL, key)
 	if err != nil {
 		readLog.WithError(err).Error("unable to read from database")
 		return Document{}, err
@@ -156,148 +426,251 @@ func (service *AuroraRWService) Read(ctx context.Context, tableName string, key
 		return Document{}, sql.ErrNoRows
 	}
 
-	colNames, err := rows.Columns()
+	// the document and hash columns are followed by the columns for the response headers
+	var body, docHash string
+	headerValues := make([]string, len(table.readHeaders))
+	vals := []interface{}{&body, &docHash}
+	for i := range headerValues {
+		vals = append(vals, &headerValues[i])
+	}
+
+	err = rows.Scan(vals...)
 	if err != nil {
 		readLog.WithError(err).Error("unable to read from database")
 		return Document{}, err
 	}
 
-	var colDoc, colHash int
-	for i := range colNames {
-		switch colNames[i] {
-		case docColumn:
-			colDoc = i
+	decompressed, err := decompressBody(body)
+	if err != nil {
+		readLog.WithError(err).Error("unable to decompress document")
+		return Document{}, err
+	}
 
-		case hashColumn:
-			colHash = i
+	doc := NewDocumentWithHash(decompressed, docHash)
+	for i, header := range table.readHeaders {
+		doc.Metadata.Set(header, headerValues[i])
+	}
+
+	return doc, nil
+}
+
+func (service *AuroraRWService) Write(ctx context.Context, tableName string, key string, doc Document, params map[string]string, previousDocHash string) (WriteStatus, string, error) {
+	ctx = context.WithValue(ctx, contextTable, tableName)
+	ctx = context.WithValue(ctx, contextDocumentKey, key)
 
-		default:
+	writeLog := buildLogEntryFromContext(ctx)
+	writeLog.Info("Writing document to database")
+
+	table := service.rwConfig[tableName]
+	doc = table.hashDocument(ctx, doc)
+
+	status, err := service.retry(ctx, table.retry, func() (WriteStatus, error) {
+		status, err := service.writeInTransaction(ctx, table, key, doc, params, previousDocHash)
+		if err != nil && service.dialect.isUniqueViolation(err) {
+			// another request inserted the document after this one found it missing, so it is written again, now that it exists
+			status, err = service.writeInTransaction(ctx, table, key, doc, params, previousDocHash)
+		}
+		if service.dialect.isReadOnly(err) || service.dialect.isReadOnly(errors.Unwrap(err)) {
+			// the next attempt is made on a new pool, which connects to the new writer
+			service.recreateWriter()
 		}
+		return status, err
+	})
+	if err != nil {
+		service.invalidateCache(table, key, "")
+		return status, doc.Hash, err
 	}
 
-	cols := len(responseHeaderCols)
-	vals := make([]interface{}, cols)
-	for i := range vals {
-		vals[i] = new(string)
+	service.invalidateCache(table, key, doc.Hash)
+	if table.changeFeed && status != Unchanged {
+		service.changes.publish(table.name)
 	}
-	err = rows.Scan(vals...)
+	return status, doc.Hash, nil
+}
+
+func (service *AuroraRWService) writeInTransaction(ctx context.Context, t table, key string, doc Document, params map[string]string, previousDocHash string) (WriteStatus, error) {
+	writeLog := buildLogEntryFromContext(ctx)
+
+	conn, stmts := service.writer.current()
 
+	// statements are prepared on the pool before the transaction takes a connection from it
+	queries := []string{t.readHashSQL, t.lockRowSQL, t.insertSQL, t.updateSQL, t.updateByKeySQL, t.upsertSQL, t.updateMetadataSQL}
+	if service.outbox != nil {
+		queries = append(queries, service.outbox.insertSQL)
+	}
+	if t.changeFeed {
+		queries = append(queries, service.dialect.nextChangeSeqSQL(), t.changeSeqSQL)
+	}
+	if err := stmts.prepareAll(ctx, queries...); err != nil {
+		writeLog.WithError(err).Error("unable to prepare statements")
+		return Updated, err
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
 	if err != nil {
-		if err != sql.ErrNoRows {
-			readLog.WithError(err).Error("unable to read from database")
-		}
-		return Document{}, err
+		writeLog.WithError(err).Error("unable to begin transaction")
+		return Updated, err
 	}
+	ex := &txStatements{tx: tx, stmts: stmts}
 
-	doc := NewDocumentWithHash([]byte(*vals[colDoc].(*string)), *vals[colHash].(*string))
+	status, err := service.writeDocument(ctx, ex, t, key, doc, params, previousDocHash)
+	if err != nil {
+		tx.Rollback()
+		return status, err
+	}
 
-	for i := 0; i < cols; i++ {
-		if i != colDoc && i != colHash {
-			doc.Metadata.Set(sqlToHeaderMap[responseHeaderCols[i]], *vals[i].(*string))
-		}
+	if err = tx.Commit(); err != nil {
+		writeLog.WithError(err).Error("unable to commit transaction")
+		return status, &commitError{status: status, err: err}
 	}
+	return status, nil
+}
 
-	return doc, nil
+func (service *AuroraRWService) invalidateCache(t table, key string, hash string) {
+	if service.cache != nil && t.cacheTTL > 0 {
+		service.cache.invalidate(t.name, key, hash, t.cacheTTL)
+	}
 }
 
-func (service *AuroraRWService) Write(ctx context.Context, tableName string, key string, doc Document, params map[string]string, previousDocHash string) (bool, string, error) {
-	ctx = context.WithValue(ctx, contextTable, tableName)
-	ctx = context.WithValue(ctx, contextDocumentKey, key)
+func (service *AuroraRWService) writeDocument(ctx context.Context, ex executor, t table, key string, doc Document, params map[string]string, previousDocHash string) (WriteStatus, error) {
+	storedHash, exists, err := service.lockRow(ctx, ex, t, key)
+	if err != nil {
+		buildLogEntryFromContext(ctx).WithError(err).Error("unable to read document hash")
+		return Updated, err
+	}
 
-	writeLog := buildLogEntryFromContext(ctx)
-	writeLog.Info("Writing document to database")
+	if exists && storedHash == doc.Hash {
+		return service.skipUnchangedDocument(ctx, ex, t, key, doc, params)
+	}
 
-	table := service.rwConfig[tableName]
-	doc.Hash = hash(doc.Body)
-	var status bool
-	var err error
-	if table.hasConflictDetection {
+	status, err := service.writeChangedDocument(ctx, ex, t, key, doc, params, previousDocHash, exists)
+	if err != nil {
+		return status, err
+	}
+
+	if t.changeFeed {
+		if err := service.recordChangeSeq(ctx, ex, t, key); err != nil {
+			return status, err
+		}
+	}
+	if service.outbox != nil {
+		return status, service.recordChange(ctx, ex, t, key, storedHash, doc.Hash, status)
+	}
+	return status, nil
+}
+
+func (service *AuroraRWService) writeChangedDocument(ctx context.Context, ex executor, t table, key string, doc Document, params map[string]string, previousDocHash string, exists bool) (WriteStatus, error) {
+	if !exists {
+		return service.insertDocument(ctx, ex, t, key, doc, params, previousDocHash)
+	}
+	if t.hasConflictDetection {
 		if previousDocHash == "" {
-			status, err = service.insertDocumentWithConflictDetection(ctx, table, key, doc, params)
-		} else {
-			status, err = service.updateDocumentWithConflictDetection(ctx, table, key, doc, params, previousDocHash)
+			buildLogEntryFromContext(ctx).Warn(conflictLogMessage)
+			return service.insertDocumentOnDuplicateKeyUpdate(ctx, ex, t, key, doc, params)
 		}
-	} else {
-		status, err = service.insertDocumentOnDuplicateKeyUpdate(ctx, table, key, doc, params)
+		return service.updateDocumentWithConflictDetection(ctx, ex, t, key, doc, params, previousDocHash)
+	}
+	return service.insertDocumentOnDuplicateKeyUpdate(ctx, ex, t, key, doc, params)
+}
+
+// lockRow reads the stored hash of the document and locks its row until the end of the transaction.
+// A missing row is not locked, as a locking read of a missing key takes a gap lock in MySQL, which deadlocks
+// the concurrent inserts into the gap. The document is inserted instead, which fails if another request inserts it first.
+func (service *AuroraRWService) lockRow(ctx context.Context, ex executor, t table, key string) (string, bool, error) {
+	storedHash, exists, err := readHash(ctx, ex, t.readHashSQL, key)
+	if err != nil || !exists || t.lockRowSQL == t.readHashSQL {
+		return storedHash, exists, err
+	}
+	return readHash(ctx, ex, t.lockRowSQL, key)
+}
+
+func readHash(ctx context.Context, ex executor, query string, key string) (string, bool, error) {
+	rows, err := ex.query(ctx, query, key)
+	if err != nil {
+		return "", false, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return "", false, rows.Err()
 	}
-	return status, doc.Hash, err
+
+	var storedHash string
+	err = rows.Scan(&storedHash)
+	return storedHash, err == nil, err
 }
 
-func (service *AuroraRWService) insertDocumentWithConflictDetection(ctx context.Context, t table, key string, doc Document, params map[string]string) (bool, error) {
+func (service *AuroraRWService) skipUnchangedDocument(ctx context.Context, ex executor, t table, key string, doc Document, params map[string]string) (WriteStatus, error) {
 	writeLog := buildLogEntryFromContext(ctx)
-	columns, values, bindings := buildInsertComponents(ctx, t, key, doc, params)
-	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", t.name, columns, values)
+	if !t.updateMetadataWhenUnchanged || t.updateMetadataSQL == "" {
+		writeLog.Info("document is unchanged, skipping write")
+		return Unchanged, nil
+	}
+
+	writeLog.Info("document is unchanged, updating metadata")
+	valuesMap := generateColumnValuesMap(ctx, t, key, doc, params)
+	var bindings []interface{}
+	for _, col := range t.metadataColumns {
+		bindings = append(bindings, valuesMap[col])
+	}
 
-	_, err := service.executeStatement(insert, bindings)
+	_, err := service.executeStatement(ctx, ex, t.updateMetadataSQL, append(bindings, key))
 	if err != nil {
-		if mysqlErr, ok := err.(*mysql.MySQLError); ok {
-			if mysqlErr.Number == 1062 {
-				writeLog.Warn(conflictLogMessage)
-				return service.insertDocumentOnDuplicateKeyUpdate(ctx, t, key, doc, params)
-			}
-		}
+		writeLog.WithError(err).Error("unable to write to database")
+	}
+	return Unchanged, err
+}
+
+// insertDocument inserts a document that was not found. If another request has inserted it since,
+// the insert fails with a unique violation, and the write is repeated on the existing row.
+func (service *AuroraRWService) insertDocument(ctx context.Context, ex executor, t table, key string, doc Document, params map[string]string, previousDocHash string) (WriteStatus, error) {
+	writeLog := buildLogEntryFromContext(ctx)
+	if t.hasConflictDetection && previousDocHash != "" {
+		writeLog.Warn(conflictLogMessage)
+	}
+
+	_, err := service.executeStatement(ctx, ex, t.insertSQL, columnValues(ctx, t, key, doc, params))
+	if err != nil && !service.dialect.isUniqueViolation(err) {
 		writeLog.WithError(err).Error("unable to write to database")
 	}
 	return Created, err
 }
 
-func (service *AuroraRWService) updateDocumentWithConflictDetection(ctx context.Context, t table, key string, doc Document, params map[string]string, previousDocHash string) (bool, error) {
+func (service *AuroraRWService) updateDocumentWithConflictDetection(ctx context.Context, ex executor, t table, key string, doc Document, params map[string]string, previousDocHash string) (WriteStatus, error) {
 	writeLog := buildLogEntryFromContext(ctx)
 
-	setStmt, values := buildUpdateSetComponents(ctx, t, key, doc, params)
-	bindings := append(values, key, previousDocHash)
-	updateStmt := fmt.Sprintf("UPDATE %s SET %s WHERE %s = ? AND %s = ?", t.name, setStmt, t.primaryKey, hashColumn)
-	affectedRows, err := service.executeStatement(updateStmt, bindings)
+	bindings := append(columnValues(ctx, t, key, doc, params), key, previousDocHash)
+	affectedRows, err := service.executeStatement(ctx, ex, t.updateSQL, bindings)
 	if err != nil {
 		writeLog.WithError(err).Error("unable to write to database")
+		return Updated, err
 	}
 	if affectedRows == 0 {
 		writeLog.Warn(conflictLogMessage)
-		return service.insertDocumentOnDuplicateKeyUpdate(ctx, t, key, doc, params)
+		return service.insertDocumentOnDuplicateKeyUpdate(ctx, ex, t, key, doc, params)
 	}
-	return Updated, err
+	return Updated, nil
 }
 
-func (service *AuroraRWService) insertDocumentOnDuplicateKeyUpdate(ctx context.Context, t table, key string, doc Document, params map[string]string) (bool, error) {
+func (service *AuroraRWService) insertDocumentOnDuplicateKeyUpdate(ctx context.Context, ex executor, t table, key string, doc Document, params map[string]string) (WriteStatus, error) {
 	writeLog := buildLogEntryFromContext(ctx)
-	columns, valuesStmt, insertBindings := buildInsertComponents(ctx, t, key, doc, params)
-	setStmt, values := buildUpdateSetComponents(ctx, t, key, doc, params)
-	bindings := append(insertBindings, values...)
+	values := columnValues(ctx, t, key, doc, params)
 
-	insertStmt := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", t.name, columns, valuesStmt)
-	insertStmt += " ON DUPLICATE KEY UPDATE " + setStmt
-	affectedRows, err := service.executeStatement(insertStmt, bindings)
+	status, err := service.dialect.upsert(ctx, ex, t, key, values)
 	if err != nil {
 		writeLog.WithError(err).Error("Error in writing ")
 	}
-	if affectedRows == 1 {
-		return Created, err
-	}
-	return Updated, err
-}
-
-func buildInsertComponents(ctx context.Context, t table, key string, doc Document, params map[string]string) (string, string, []interface{}) {
-	valuesMap := generateColumnValuesMap(ctx, t, key, doc, params)
-	insertCols := ""
-	valuesStmt := ""
-	var bindings []interface{}
-	for col, val := range valuesMap {
-		insertCols += "," + col
-		valuesStmt += ",?"
-		bindings = append(bindings, val)
-	}
-	return insertCols[1:], valuesStmt[1:], bindings
+	return status, err
 }
 
-func buildUpdateSetComponents(ctx context.Context, t table, key string, doc Document, params map[string]string) (string, []interface{}) {
+// columnValues returns the values to write, in the order of the table's value columns.
+func columnValues(ctx context.Context, t table, key string, doc Document, params map[string]string) []interface{} {
 	valuesMap := generateColumnValuesMap(ctx, t, key, doc, params)
-	setStmt := ""
-	var values []interface{}
-	for col, val := range valuesMap {
-		setStmt += "," + col + "=?"
-		values = append(values, val)
+	values := make([]interface{}, len(t.valueColumns))
+	for i, col := range t.valueColumns {
+		values[i] = valuesMap[col]
 	}
-	return setStmt[1:], values
+	return values
 }
 
 func generateColumnValuesMap(ctx context.Context, table table, key string, doc Document, params map[string]string) map[string]interface{} {
@@ -315,8 +688,13 @@ func generateColumnValuesMap(ctx context.Context, table table, key string, doc D
 			// @. - in the metadata, e.g. @.timestamp
 			val = doc.Metadata[expr[2:]]
 		} else if expr == "$" {
-			// $ - the whole document
-			val = doc.Body
+			// $ - the whole document, compressed if configured
+			body, err := compressBody(table.compression, doc.Body)
+			if err != nil {
+				writeLog.WithError(err).WithField("compression", table.compression).Warn("unable to compress document, storing it uncompressed")
+				body = string(doc.Body)
+			}
+			val = body
 		} else if strings.HasPrefix(expr, "$") {
 			// $. - a JSONpath in the document, e.g. $.post.body
 			// only unmarshal into a JSON document if necessary, and only once
@@ -340,8 +718,8 @@ func generateColumnValuesMap(ctx context.Context, table table, key string, doc D
 	return values
 }
 
-func (service *AuroraRWService) executeStatement(stmt string, bindings []interface{}) (int64, error) {
-	res, err := service.conn.Exec(stmt, bindings...)
+func (service *AuroraRWService) executeStatement(ctx context.Context, ex executor, stmt string, bindings []interface{}) (int64, error) {
+	res, err := ex.exec(ctx, stmt, bindings...)
 	if err != nil {
 		return 0, err
 	}
@@ -349,6 +727,13 @@ func (service *AuroraRWService) executeStatement(stmt string, bindings []interfa
 	return n, nil
 }
 
+func buildReadLogEntry(ctx context.Context, tableName string, key string) *log.Entry {
+	txid, _ := tid.GetTransactionIDFromContext(ctx)
+	return log.WithField("table", tableName).
+		WithField("key", key).
+		WithField(tid.TransactionIDKey, txid)
+}
+
 func buildLogEntryFromContext(ctx context.Context) *log.Entry {
 	txid := ctx.Value(tid.TransactionIDKey)
 	key := ctx.Value(contextDocumentKey)
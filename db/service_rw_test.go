@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -11,6 +12,7 @@ import (
 	"github.com/Financial-Times/generic-rw-aurora/config"
 	tid "github.com/Financial-Times/transactionid-utils-go"
 	"github.com/google/uuid"
+	"github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 	logTest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
@@ -33,7 +35,9 @@ const (
 type ServiceRWTestSuite struct {
 	suite.Suite
 	dbAdminUrl string
+	dbUrl      string
 	dbConn     *sql.DB
+	rwConfig   *config.Config
 	service    *AuroraRWService
 }
 
@@ -44,26 +48,35 @@ func TestServiceRWTestSuite(t *testing.T) {
 	suite.Run(t, &testSuite)
 }
 
+func TestServiceRWTestSuiteOnSQLite(t *testing.T) {
+	testSuite := ServiceRWTestSuite{}
+	testSuite.dbUrl = "sqlite://" + filepath.Join(t.TempDir(), "rw.db")
+
+	suite.Run(t, &testSuite)
+}
+
 func (s *ServiceRWTestSuite) SetupSuite() {
-	adminConn, err := sql.Open("mysql", s.dbAdminUrl)
-	require.NoError(s.T(), err)
-	defer adminConn.Close()
+	if s.dbAdminUrl != "" {
+		adminConn, err := sql.Open("mysql", s.dbAdminUrl)
+		require.NoError(s.T(), err)
+		defer adminConn.Close()
 
-	pacSchema := "pac_test"
-	pacUser := "pac_test_user"
+		pacSchema := "pac_test"
+		pacUser := "pac_test_user"
 
-	err = cleanDatabase(adminConn, pacUser, pacSchema)
-	require.NoError(s.T(), err)
+		err = cleanDatabase(adminConn, pacUser, pacSchema)
+		require.NoError(s.T(), err)
 
-	pacPassword := uuid.New().String()
-	err = createDatabase(adminConn, pacUser, pacPassword, pacSchema)
-	require.NoError(s.T(), err)
+		pacPassword := uuid.New().String()
+		err = createDatabase(adminConn, pacUser, pacPassword, pacSchema)
+		require.NoError(s.T(), err)
 
-	i := strings.Index(s.dbAdminUrl, "@")
-	j := strings.Index(s.dbAdminUrl, "/")
-	dbUrl := fmt.Sprintf("%s:%s@%s/%s", pacUser, pacPassword, s.dbAdminUrl[i+1:j], pacSchema)
+		i := strings.Index(s.dbAdminUrl, "@")
+		j := strings.Index(s.dbAdminUrl, "/")
+		s.dbUrl = fmt.Sprintf("%s:%s@%s/%s", pacUser, pacPassword, s.dbAdminUrl[i+1:j], pacSchema)
+	}
 
-	conn, err := Connect(dbUrl, 5)
+	conn, err := Connect(s.dbUrl, PoolConfig{MaxOpenConnections: 5})
 	require.NoError(s.T(), err)
 
 	cfg, err := config.ReadConfig("../config.yml")
@@ -71,6 +84,7 @@ func (s *ServiceRWTestSuite) SetupSuite() {
 
 	s.dbConn = conn
 	s.dbConn.SetMaxIdleConns(0)
+	s.rwConfig = cfg
 	s.service = NewService(conn, true, cfg)
 }
 
@@ -111,6 +125,152 @@ func (s *ServiceRWTestSuite) TestReadNotFound() {
 	assert.EqualError(s.T(), err, sql.ErrNoRows.Error())
 }
 
+func (s *ServiceRWTestSuite) TestReadFallsBackToWriterWhenReaderFails() {
+	hook := logTest.NewGlobal()
+	testKey := uuid.New().String()
+	testTID := "tid_testreadfallback"
+
+	testDocBody := fmt.Sprintf(testDocTemplate, time.Now().String())
+	testDoc := NewDocument([]byte(testDocBody))
+	testDoc.Metadata.Set(timestampMetadata, time.Now().UTC().Format("2006-01-02T15:04:05.000Z"))
+	testDoc.Metadata.Set(strings.ToLower(tid.TransactionIDHeader), testTID)
+
+	testCtx := tid.TransactionAwareContext(context.Background(), testTID)
+
+	params := map[string]string{"id": testKey}
+
+	_, expectedDocHash, err := s.service.Write(testCtx, testTable, testKey, testDoc, params, "")
+	require.NoError(s.T(), err)
+
+	readConn, err := sql.Open("mysql", "foo:bar@tcp(nowhere.example.com)/nodatabase")
+	require.NoError(s.T(), err)
+	readConn.Close()
+
+	srv := NewService(s.dbConn, false, s.rwConfig, WithReader(readConn))
+
+	actual, err := srv.Read(testCtx, testTable, testKey)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), testDoc.Body, actual.Body, "document read from store")
+	assert.Equal(s.T(), expectedDocHash, actual.Hash)
+
+	assert.True(s.T(), hasLogEntry(hook, "unable to read from replica, falling back to writer"), "read should have fallen back to the writer")
+}
+
+func (s *ServiceRWTestSuite) TestReadCancelled() {
+	hook := logTest.NewGlobal()
+	testKey := uuid.New().String()
+	params := map[string]string{"id": testKey}
+
+	_, _, err := s.service.Write(context.Background(), testTable, testKey, NewDocument([]byte(fmt.Sprintf(testDocTemplate, time.Now().String()))), params, "")
+	require.NoError(s.T(), err)
+
+	srv := NewService(s.dbConn, false, s.rwConfig, WithReader(s.dbConn))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = srv.Read(ctx, testTable, testKey)
+	assert.Equal(s.T(), context.Canceled, err)
+	assert.False(s.T(), hasLogEntry(hook, "unable to read from replica, falling back to writer"), "a cancelled read should not fall back to the writer")
+}
+
+func (s *ServiceRWTestSuite) TestWriteCancelled() {
+	testKey := uuid.New().String()
+	params := map[string]string{"id": testKey}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := s.service.Write(ctx, testTable, testKey, NewDocument([]byte(fmt.Sprintf(testDocTemplate, time.Now().String()))), params, "")
+	assert.Equal(s.T(), context.Canceled, err)
+
+	_, err = s.service.Read(context.Background(), testTable, testKey)
+	assert.Equal(s.T(), sql.ErrNoRows, err, "a cancelled write is not stored")
+}
+
+func (s *ServiceRWTestSuite) TestReadTimeoutCancelsQuery() {
+	if s.dbAdminUrl == "" {
+		s.T().Skip("The SQLite pool has a single connection, so a read waits for the pool rather than the table lock.")
+	}
+	testKey := uuid.New().String()
+	params := map[string]string{"id": testKey}
+
+	_, _, err := s.service.Write(context.Background(), testTable, testKey, NewDocument([]byte(fmt.Sprintf(testDocTemplate, time.Now().String()))), params, "")
+	require.NoError(s.T(), err)
+
+	lockConn, err := s.dbConn.Conn(context.Background())
+	require.NoError(s.T(), err)
+	defer lockConn.Close()
+	_, err = lockConn.ExecContext(context.Background(), "LOCK TABLES "+testTable+" WRITE")
+	require.NoError(s.T(), err)
+	defer lockConn.ExecContext(context.Background(), "UNLOCK TABLES")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = s.service.Read(ctx, testTable, testKey)
+	assert.Equal(s.T(), context.DeadlineExceeded, err)
+	assert.True(s.T(), time.Since(start) < 5*time.Second, "the read should be cancelled while the table is still locked")
+}
+
+func (s *ServiceRWTestSuite) TestWriteTimeoutCancelsQuery() {
+	if s.dbAdminUrl == "" {
+		s.T().Skip("The SQLite pool has a single connection, so a write waits for the pool rather than the row lock.")
+	}
+	testKey := uuid.New().String()
+	params := map[string]string{"id": testKey}
+
+	testDoc := NewDocument([]byte(fmt.Sprintf(testDocTemplate, "stored")))
+	_, _, err := s.service.Write(context.Background(), testTable, testKey, testDoc, params, "")
+	require.NoError(s.T(), err)
+
+	tx, err := s.dbConn.Begin()
+	require.NoError(s.T(), err)
+	_, err = tx.Exec("SELECT uuid FROM "+testTable+" WHERE uuid = ? FOR UPDATE", testKey)
+	require.NoError(s.T(), err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err = s.service.Write(ctx, testTable, testKey, NewDocument([]byte(fmt.Sprintf(testDocTemplate, "timed out"))), params, "")
+	assert.Equal(s.T(), context.DeadlineExceeded, err)
+	assert.True(s.T(), time.Since(start) < 5*time.Second, "the write should be cancelled while the row is still locked")
+	require.NoError(s.T(), tx.Commit())
+
+	actual, err := s.service.Read(context.Background(), testTable, testKey)
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), testDoc.Body, actual.Body, "a cancelled write is not stored")
+}
+
+func (s *ServiceRWTestSuite) TestReadYourWritesFromStaleReader() {
+	hook := logTest.NewGlobal()
+	testKey := uuid.New().String()
+	testTID := "tid_testreadyourwrites"
+
+	testDocBody := fmt.Sprintf(testDocTemplate, time.Now().String())
+	testDoc := NewDocument([]byte(testDocBody))
+	testDoc.Metadata.Set(timestampMetadata, time.Now().UTC().Format("2006-01-02T15:04:05.000Z"))
+	testDoc.Metadata.Set(strings.ToLower(tid.TransactionIDHeader), testTID)
+
+	testCtx := tid.TransactionAwareContext(context.Background(), testTID)
+
+	params := map[string]string{"id": testKey}
+
+	_, expectedDocHash, err := s.service.Write(testCtx, testTable, testKey, testDoc, params, "")
+	require.NoError(s.T(), err)
+
+	srv := NewService(s.dbConn, false, s.rwConfig, WithReader(s.dbConn))
+
+	actual, err := srv.Read(testCtx, testTable, testKey)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), expectedDocHash, actual.Hash)
+	assert.False(s.T(), hasLogEntry(hook, "replica is stale, reading from writer"), "read should have been served by the reader")
+
+	aNewerHash := "01234567890123456789012345678901234567890123456789012345"
+	actual, err = srv.Read(ContextWithLastWrittenHash(testCtx, aNewerHash), testTable, testKey)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), expectedDocHash, actual.Hash)
+	assert.True(s.T(), hasLogEntry(hook, "replica is stale, reading from writer"), "read should have been served by the writer")
+}
+
 func (s *ServiceRWTestSuite) TestReadWithMetadata() {
 	testKey := uuid.New().String()
 
@@ -139,6 +299,209 @@ func (s *ServiceRWTestSuite) TestReadWithMetadata() {
 	assert.Equal(s.T(), testSystem, actual.Metadata[testHeader])
 }
 
+func (s *ServiceRWTestSuite) TestWriteCompressedAndReadMixedRows() {
+	uncompressedKey := uuid.New().String()
+	compressedKey := uuid.New().String()
+	testTID := "tid_testcompression"
+	testCtx := tid.TransactionAwareContext(context.Background(), testTID)
+
+	testDocBody := fmt.Sprintf(testDocTemplate, strings.Repeat(time.Now().String(), 10))
+	testDoc := NewDocument([]byte(testDocBody))
+	testDoc.Metadata.Set(timestampMetadata, time.Now().UTC().Format("2006-01-02T15:04:05.000Z"))
+	testDoc.Metadata.Set(strings.ToLower(tid.TransactionIDHeader), testTID)
+
+	_, uncompressedHash, err := s.service.Write(testCtx, testTable, uncompressedKey, testDoc, map[string]string{"id": uncompressedKey}, "")
+	require.NoError(s.T(), err)
+
+	cfg := &config.Config{Paths: make(map[string]config.Mapping)}
+	for path, mapping := range s.rwConfig.Paths {
+		mapping.Compression = compressionZstd
+		cfg.Paths[path] = mapping
+	}
+	srv := NewService(s.dbConn, false, cfg)
+
+	_, compressedHash, err := srv.Write(testCtx, testTable, compressedKey, testDoc, map[string]string{"id": compressedKey}, "")
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), uncompressedHash, compressedHash, "hash of the uncompressed document")
+
+	var stored string
+	err = s.dbConn.QueryRow(fmt.Sprintf("SELECT %s FROM %s WHERE %s = ?", testDocColumn, testTable, testKeyColumn), compressedKey).Scan(&stored)
+	require.NoError(s.T(), err)
+	assert.True(s.T(), strings.HasPrefix(stored, zstdPrefix), "stored document should be compressed")
+
+	for _, key := range []string{uncompressedKey, compressedKey} {
+		for _, service := range []*AuroraRWService{s.service, srv} {
+			actual, err := service.Read(testCtx, testTable, key)
+			require.NoError(s.T(), err)
+			assert.Equal(s.T(), testDoc.Body, actual.Body, "document read from store")
+			assert.Equal(s.T(), uncompressedHash, actual.Hash)
+		}
+	}
+}
+
+func (s *ServiceRWTestSuite) canonicalJSONService(storeCanonical bool, options ...Option) *AuroraRWService {
+	cfg := &config.Config{Paths: make(map[string]config.Mapping)}
+	for path, mapping := range s.rwConfig.Paths {
+		mapping.HashMode = hashModeCanonicalJSON
+		mapping.StoreCanonical = storeCanonical
+		mapping.CacheTTL = time.Minute
+		cfg.Paths[path] = mapping
+	}
+	return NewService(s.dbConn, false, cfg, options...)
+}
+
+func (s *ServiceRWTestSuite) TestWriteCanonicalJSONHash() {
+	testKey := uuid.New().String()
+	testCtx := tid.TransactionAwareContext(context.Background(), "tid_testcanonical")
+	params := map[string]string{"id": testKey}
+	srv := s.canonicalJSONService(true)
+
+	_, firstHash, err := srv.Write(testCtx, testTable, testKey, NewDocument([]byte(`{"foo":"bar","baz":[1,2]}`)), params, "")
+	require.NoError(s.T(), err)
+
+	_, secondHash, err := srv.Write(testCtx, testTable, testKey, NewDocument([]byte("{\n  \"baz\": [1, 2],\n  \"foo\": \"bar\"\n}")), params, "")
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), firstHash, secondHash, "semantically identical documents")
+
+	actual, err := srv.Read(testCtx, testTable, testKey)
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), `{"baz":[1,2],"foo":"bar"}`, string(actual.Body), "canonical document read from store")
+	assert.Equal(s.T(), hash(actual.Body), actual.Hash)
+}
+
+func (s *ServiceRWTestSuite) TestRehash() {
+	testKey := uuid.New().String()
+	testCtx := tid.TransactionAwareContext(context.Background(), "tid_testrehash")
+	testDocBody := "{\n  \"foo\": \"bar\",\n  \"baz\": 1\n}"
+
+	_, rawHash, err := s.service.Write(testCtx, testTable, testKey, NewDocument([]byte(testDocBody)), map[string]string{"id": testKey}, "")
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), hash([]byte(testDocBody)), rawHash)
+
+	srv := s.canonicalJSONService(false, WithReadCache(10, metrics.NewRegistry()))
+	cached, err := srv.Read(testCtx, testTable, testKey)
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), rawHash, cached.Hash)
+
+	scanned, updated, err := srv.Rehash(testCtx, testTable, 2)
+	require.NoError(s.T(), err)
+	assert.True(s.T(), scanned >= 1)
+	assert.True(s.T(), updated >= 1)
+
+	actual, err := srv.Read(testCtx, testTable, testKey)
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), testDocBody, string(actual.Body), "document is not rewritten unless it is stored canonical")
+	assert.Equal(s.T(), hash([]byte(`{"baz":1,"foo":"bar"}`)), actual.Hash, "rehashed documents are not read from the cache")
+
+	_, updated, err = srv.Rehash(testCtx, testTable, 2)
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), 0, updated, "rows are already hashed canonically")
+}
+
+func (s *ServiceRWTestSuite) TestWriteUnchanged() {
+	hook := logTest.NewGlobal()
+	testKey := uuid.New().String()
+	testLastModified := time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	testCtx := tid.TransactionAwareContext(context.Background(), "tid_testunchanged_1")
+	params := map[string]string{"id": testKey}
+
+	testDocBody := fmt.Sprintf(testDocTemplate, time.Now().String())
+	testDoc := NewDocument([]byte(testDocBody))
+	testDoc.Metadata.Set(timestampMetadata, testLastModified)
+	testDoc.Metadata.Set(strings.ToLower(tid.TransactionIDHeader), "tid_testunchanged_1")
+
+	status, docHash, err := s.service.Write(testCtx, testTableWithConflictDetection, testKey, testDoc, params, "")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), Created, status)
+
+	for _, previousDocHash := range []string{docHash, ""} {
+		testDoc = NewDocument([]byte(testDocBody))
+		testDoc.Metadata.Set(timestampMetadata, time.Now().Add(time.Minute).UTC().Format("2006-01-02T15:04:05.000Z"))
+		testDoc.Metadata.Set(strings.ToLower(tid.TransactionIDHeader), "tid_testunchanged_2")
+
+		status, unchangedHash, err := s.service.Write(testCtx, testTableWithConflictDetection, testKey, testDoc, params, previousDocHash)
+		require.NoError(s.T(), err)
+		assert.Equal(s.T(), Unchanged, status)
+		assert.Equal(s.T(), docHash, unchangedHash)
+	}
+	assert.False(s.T(), hasLogEntry(hook, conflictLogMessage))
+
+	expectedValuePerCol := map[string]string{
+		testDocColumn:      testDocBody,
+		lastModifiedColumn: testLastModified,
+		publishRefColumn:   "tid_testunchanged_1",
+		hashColumn:         docHash,
+	}
+	s.assertExpectedDataInDB(testKey, testKeyColumn, testTableWithConflictDetection, expectedValuePerCol)
+}
+
+func (s *ServiceRWTestSuite) TestWriteUnchangedUpdatesMetadataWhenEnabled() {
+	testKey := uuid.New().String()
+	testCtx := tid.TransactionAwareContext(context.Background(), "tid_testunchanged")
+	params := map[string]string{"id": testKey}
+
+	cfg := &config.Config{Paths: make(map[string]config.Mapping)}
+	for path, mapping := range s.rwConfig.Paths {
+		mapping.UpdateMetadataWhenUnchanged = true
+		cfg.Paths[path] = mapping
+	}
+	srv := NewService(s.dbConn, false, cfg)
+
+	testDocBody := fmt.Sprintf(testDocTemplate, time.Now().String())
+	testDoc := NewDocument([]byte(testDocBody))
+	testDoc.Metadata.Set(timestampMetadata, "2018-01-01T00:00:00.000Z")
+	testDoc.Metadata.Set(strings.ToLower(tid.TransactionIDHeader), "tid_testunchanged_1")
+	_, docHash, err := srv.Write(testCtx, testTable, testKey, testDoc, params, "")
+	require.NoError(s.T(), err)
+
+	testDoc = NewDocument([]byte(testDocBody))
+	testDoc.Metadata.Set(timestampMetadata, "2019-01-01T00:00:00.000Z")
+	testDoc.Metadata.Set(strings.ToLower(tid.TransactionIDHeader), "tid_testunchanged_2")
+	status, _, err := srv.Write(testCtx, testTable, testKey, testDoc, params, "")
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), Unchanged, status)
+
+	expectedValuePerCol := map[string]string{
+		testDocColumn:      testDocBody,
+		lastModifiedColumn: "2019-01-01T00:00:00.000Z",
+		publishRefColumn:   "tid_testunchanged_2",
+		hashColumn:         docHash,
+	}
+	s.assertExpectedDataInDB(testKey, testKeyColumn, testTable, expectedValuePerCol)
+}
+
+func (s *ServiceRWTestSuite) TestReadCache() {
+	testKey := uuid.New().String()
+	testCtx := tid.TransactionAwareContext(context.Background(), "tid_testcache")
+	params := map[string]string{"id": testKey}
+
+	cfg := &config.Config{Paths: make(map[string]config.Mapping)}
+	for path, mapping := range s.rwConfig.Paths {
+		mapping.CacheTTL = time.Minute
+		cfg.Paths[path] = mapping
+	}
+	registry := metrics.NewRegistry()
+	srv := NewService(s.dbConn, false, cfg, WithReadCache(10, registry))
+
+	_, firstHash, err := srv.Write(testCtx, testTable, testKey, NewDocument([]byte(fmt.Sprintf(testDocTemplate, "first"))), params, "")
+	require.NoError(s.T(), err)
+
+	for i := 0; i < 2; i++ {
+		actual, err := srv.Read(testCtx, testTable, testKey)
+		require.NoError(s.T(), err)
+		assert.Equal(s.T(), firstHash, actual.Hash)
+	}
+	assert.Equal(s.T(), int64(1), registry.Get(cacheHitsMetric).(metrics.Counter).Count())
+	assert.Equal(s.T(), int64(1), registry.Get(cacheMissesMetric).(metrics.Counter).Count())
+
+	_, secondHash, err := srv.Write(testCtx, testTable, testKey, NewDocument([]byte(fmt.Sprintf(testDocTemplate, "second"))), params, "")
+	require.NoError(s.T(), err)
+
+	actual, err := srv.Read(testCtx, testTable, testKey)
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), secondHash, actual.Hash, "a local write invalidates the cache")
+}
+
 func (s *ServiceRWTestSuite) TestWriteCreateWithoutConflictDetection() {
 	testKey := uuid.New().String()
 	testLastModified := time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
@@ -375,6 +738,15 @@ func (s *ServiceRWTestSuite) TestUpdateWithConflict() {
 	assert.Equal(s.T(), testTID2, hook.LastEntry().Data[tid.TransactionIDKey])
 }
 
+func hasLogEntry(hook *logTest.Hook, message string) bool {
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == message {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *ServiceRWTestSuite) assertExpectedDataInDB(key string, keyColumn string, table string, expectedValuePerCol map[string]string) {
 	var actualValues []interface{}
 	var expectedValues []string
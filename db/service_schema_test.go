@@ -1,11 +1,17 @@
 package db
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	goose "github.com/Financial-Times/cm-goose"
 	"github.com/Financial-Times/generic-rw-aurora/config"
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
@@ -51,7 +57,7 @@ func (s *ServiceSchemaTestSuite) SetupTest() {
 	j := strings.Index(s.dbAdminUrl, "/")
 	s.dbUrl = fmt.Sprintf("%s:%s@%s/%s", pacUser, pacPassword, s.dbAdminUrl[i+1:j], pacSchema)
 
-	conn, err = Connect(s.dbUrl, 5)
+	conn, err = Connect(s.dbUrl, PoolConfig{MaxOpenConnections: 5})
 	require.NoError(s.T(), err)
 	s.dbConn = conn
 }
@@ -164,7 +170,7 @@ func (s *ServiceSchemaTestSuite) TestSchemaCheckMigrateWhilstLocked() {
 	defer s.dbAdminConn.Exec("SELECT release_lock(?)", dbLockName)
 
 	// try to migrate but another connection has an exclusive lock
-	srv := NewService(s.dbConn, true, &config.Config{})
+	srv := NewService(s.dbConn, true, &config.Config{}, WithMigrationLockTimeout(time.Second))
 
 	msg, err := srv.SchemaCheck()
 	assert.EqualError(s.T(), err, fmt.Sprintf("migrating database from 0 to %d failed", requiredVersion))
@@ -178,3 +184,182 @@ func (s *ServiceSchemaTestSuite) TestSchemaMigrate() {
 	assert.NoError(s.T(), err)
 	assert.Equal(s.T(), fmt.Sprintf("Database schema is at version %d", requiredVersion), msg)
 }
+
+func (s *ServiceSchemaTestSuite) TestMigratorUpAndDown() {
+	m, err := NewMigrator(s.dbConn, time.Second, false, &bytes.Buffer{})
+	require.NoError(s.T(), err)
+
+	require.NoError(s.T(), m.Up(context.Background(), 3))
+	version, err := goose.GetDBVersion(s.dbConn)
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(3), version)
+
+	require.NoError(s.T(), m.Up(context.Background(), 0))
+	version, err = goose.GetDBVersion(s.dbConn)
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), requiredVersion, version)
+
+	require.NoError(s.T(), m.Down(context.Background(), 2))
+	version, err = goose.GetDBVersion(s.dbConn)
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(2), version)
+
+	_, err = s.dbConn.Exec("SELECT * FROM draft_content")
+	assert.Error(s.T(), err, "the table of a rolled back migration is dropped")
+
+	assert.EqualError(s.T(), m.Down(context.Background(), 3), "schema version 3 is newer than the current version 2, it requires a migration up")
+	assert.EqualError(s.T(), m.Up(context.Background(), 1), "schema version 1 is older than the current version 2, it requires a migration down")
+}
+
+func (s *ServiceSchemaTestSuite) TestMigratorRedo() {
+	m, err := NewMigrator(s.dbConn, time.Second, false, &bytes.Buffer{})
+	require.NoError(s.T(), err)
+
+	assert.EqualError(s.T(), m.Redo(context.Background()), "no migration has been applied")
+
+	require.NoError(s.T(), m.Up(context.Background(), 4))
+	require.NoError(s.T(), m.Redo(context.Background()))
+
+	version, err := goose.GetDBVersion(s.dbConn)
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(4), version)
+	_, err = s.dbConn.Exec("SELECT content_type FROM draft_content")
+	assert.NoError(s.T(), err)
+}
+
+func (s *ServiceSchemaTestSuite) TestMigratorDryRun() {
+	out := &bytes.Buffer{}
+	m, err := NewMigrator(s.dbConn, time.Second, true, out)
+	require.NoError(s.T(), err)
+
+	require.NoError(s.T(), m.Up(context.Background(), 1))
+	assert.Contains(s.T(), out.String(), "-- migrate from schema version 0 to 1\n-- apply 1 initial-annotations-tables\ncreate table draft_annotations (")
+
+	version, err := goose.GetDBVersion(s.dbConn)
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(0), version, "a dry run does not migrate")
+}
+
+func (s *ServiceSchemaTestSuite) TestMigratorWhilstLocked() {
+	var locked int
+	lock, err := s.dbAdminConn.Query("SELECT get_lock(?, 1)", dbLockName)
+	require.NoError(s.T(), err, "admin connection was unable to obtain a lock")
+	defer lock.Close()
+	lock.Next()
+	lock.Scan(&locked)
+	require.Equal(s.T(), 1, locked, "admin connection was unable to obtain a lock")
+	defer s.dbAdminConn.Exec("SELECT release_lock(?)", dbLockName)
+
+	m, err := NewMigrator(s.dbConn, time.Second, false, &bytes.Buffer{})
+	require.NoError(s.T(), err)
+	assert.EqualError(s.T(), m.Up(context.Background(), 0), ErrDbLockFailure)
+}
+
+func (s *ServiceSchemaTestSuite) TestSchemaMigrateReleasesLock() {
+	// the lock is released on the session that took it, whichever connection of the pool the release would otherwise use
+	srv := NewService(s.dbConn, true, &config.Config{})
+	_, err := srv.SchemaCheck()
+	require.NoError(s.T(), err)
+
+	var free int
+	require.NoError(s.T(), s.dbAdminConn.QueryRow("SELECT is_free_lock(?)", dbLockName).Scan(&free))
+	assert.Equal(s.T(), 1, free)
+}
+
+func (s *ServiceSchemaTestSuite) TestSchemaMigrateWaitsForLock() {
+	defer func(interval time.Duration) { lockRetryInterval = interval }(lockRetryInterval)
+	lockRetryInterval = 50 * time.Millisecond
+
+	admin, err := s.dbAdminConn.Conn(context.Background())
+	require.NoError(s.T(), err)
+	defer admin.Close()
+
+	var locked int
+	require.NoError(s.T(), admin.QueryRowContext(context.Background(), "SELECT get_lock(?, 1)", dbLockName).Scan(&locked))
+	require.Equal(s.T(), 1, locked, "admin connection was unable to obtain a lock")
+
+	// another instance migrates the database whilst it holds the lock
+	require.NoError(s.T(), registerMigrations(mysqlDialect{}))
+	require.NoError(s.T(), goose.UpTo(s.dbConn, ".", requiredVersion))
+	time.AfterFunc(500*time.Millisecond, func() {
+		admin.ExecContext(context.Background(), "SELECT release_lock(?)", dbLockName)
+	})
+
+	srv := NewService(s.dbConn, true, &config.Config{}, WithMigrationLockTimeout(10*time.Second))
+
+	msg, err := srv.SchemaCheck()
+	assert.NoError(s.T(), err, "the schema is checked again when the lock is released")
+	assert.Equal(s.T(), fmt.Sprintf("Database schema is at version %d", requiredVersion), msg)
+}
+
+func (s *ServiceSchemaTestSuite) TestMigratorGenerate() {
+	out := &bytes.Buffer{}
+	m, err := NewMigrator(s.dbConn, time.Second, false, out)
+	require.NoError(s.T(), err)
+
+	rwConfig, err := config.ReadConfig("../config.yml")
+	require.NoError(s.T(), err)
+	assert.EqualError(s.T(), m.Generate(context.Background(), rwConfig, s.T().TempDir(), "things"),
+		fmt.Sprintf("the database is at schema version 0, migrate it to version %d before generating a migration", requiredVersion))
+
+	require.NoError(s.T(), m.Up(context.Background(), 0))
+	require.NoError(s.T(), m.Generate(context.Background(), rwConfig, s.T().TempDir(), "things"))
+	assert.Equal(s.T(), "the database schema matches the configuration, no migration is required\n", out.String(), "the migrations create the configured tables")
+
+	rwConfig.Paths["/things/:id"] = config.Mapping{
+		Table:      "things",
+		Columns:    map[string]string{"id": ":id", "body": "$"},
+		PrimaryKey: "id",
+	}
+	dir := s.T().TempDir()
+	out.Reset()
+	require.NoError(s.T(), m.Generate(context.Background(), rwConfig, dir, "initial-things-table"))
+
+	up, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("%05d_initial-things-table.up.sql", requiredVersion+1)))
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), "create table things (\n\tid varchar(255) primary key,\n\tbody mediumtext not null,\n\thash varchar(56) not null\n);\n", string(up))
+
+	down, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("%05d_initial-things-table.down.sql", requiredVersion+1)))
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), "drop table things;\n", string(down))
+
+	_, err = s.dbConn.Exec(string(up))
+	assert.NoError(s.T(), err, "the generated migration applies to MySQL")
+}
+
+func (s *ServiceSchemaTestSuite) TestSchemaMigrateAutoCreatesTables() {
+	rwConfig := &config.Config{Paths: map[string]config.Mapping{
+		"/things/:id": {
+			Table:      "things",
+			Columns:    map[string]string{"id": ":id", "body": "$"},
+			PrimaryKey: "id",
+		},
+	}}
+
+	srv := NewService(s.dbConn, true, rwConfig, WithAutoCreateTables())
+	_, err := srv.SchemaCheck()
+	require.NoError(s.T(), err)
+
+	_, err = s.dbConn.Exec("SELECT id, body, hash FROM things")
+	assert.NoError(s.T(), err, "the missing table is created after the migrations")
+}
+
+func (s *ServiceSchemaTestSuite) TestTableCheckAfterMigrating() {
+	rwConfig, err := config.ReadConfig("../config.yml")
+	require.NoError(s.T(), err)
+
+	srv := NewService(s.dbConn, true, rwConfig)
+	_, err = srv.SchemaCheck()
+	require.NoError(s.T(), err)
+
+	for path, mapping := range rwConfig.Paths {
+		_, err := srv.TableCheck(path, mapping)
+		assert.NoError(s.T(), err, "the migrated tables match the configuration")
+	}
+
+	_, err = s.dbConn.Exec("ALTER TABLE draft_content DROP COLUMN origin_system")
+	require.NoError(s.T(), err)
+	srv.tableColumns.readAt = time.Time{}
+	_, err = srv.TableCheck("/drafts/content/:id", rwConfig.Paths["/drafts/content/:id"])
+	assert.EqualError(s.T(), err, "table draft_content of path /drafts/content/:id: column origin_system does not exist")
+}
@@ -0,0 +1,184 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// executor runs SQL statements for the service.
+type executor interface {
+	exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// statements prepares each SQL statement once per connection pool, and reuses it across requests.
+type statements struct {
+	sync.RWMutex
+	conn     *sql.DB
+	prepared map[string]*sql.Stmt
+}
+
+func newStatements(conn *sql.DB) *statements {
+	return &statements{conn: conn, prepared: make(map[string]*sql.Stmt)}
+}
+
+func (s *statements) prepare(ctx context.Context, query string) (*sql.Stmt, error) {
+	s.RLock()
+	stmt, found := s.prepared[query]
+	s.RUnlock()
+	if found {
+		return stmt, nil
+	}
+
+	// the statement is prepared without the lock, so that a slow prepare does not block the other statements
+	stmt, err := s.conn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if existing, found := s.prepared[query]; found {
+		// another request prepared it first
+		stmt.Close()
+		return existing, nil
+	}
+
+	s.prepared[query] = stmt
+	return stmt, nil
+}
+
+// close closes the prepared statements, when their connection pool is replaced.
+func (s *statements) close() {
+	s.Lock()
+	defer s.Unlock()
+	for query, stmt := range s.prepared {
+		stmt.Close()
+		delete(s.prepared, query)
+	}
+}
+
+// prepareAll prepares the given statements, ignoring any that are empty.
+func (s *statements) prepareAll(ctx context.Context, queries ...string) error {
+	for _, query := range queries {
+		if query == "" {
+			continue
+		}
+		if _, err := s.prepare(ctx, query); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *statements) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	stmt, err := s.prepare(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return stmt.ExecContext(ctx, args...)
+}
+
+func (s *statements) query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	stmt, err := s.prepare(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return stmt.QueryContext(ctx, args...)
+}
+
+// txStatements runs the prepared statements of a pool within a transaction.
+type txStatements struct {
+	tx    *sql.Tx
+	stmts *statements
+}
+
+func (s *txStatements) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	stmt, err := s.stmts.prepare(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.tx.StmtContext(ctx, stmt).ExecContext(ctx, args...)
+}
+
+func (s *txStatements) query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	stmt, err := s.stmts.prepare(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.tx.StmtContext(ctx, stmt).QueryContext(ctx, args...)
+}
+
+// orderColumns sorts the mapped columns of a table, with the hash last, and finds its metadata columns,
+// which are all of the columns except the document, the key and the hash.
+func (t *table) orderColumns() {
+	t.valueColumns = nil
+	for col := range t.columns {
+		if col != hashColumn {
+			t.valueColumns = append(t.valueColumns, col)
+		}
+	}
+	sort.Strings(t.valueColumns)
+	t.valueColumns = append(t.valueColumns, hashColumn)
+
+	docColumn := t.documentColumn()
+	t.metadataColumns = nil
+	for _, col := range t.valueColumns {
+		if col != docColumn && col != t.primaryKey && col != hashColumn {
+			t.metadataColumns = append(t.metadataColumns, col)
+		}
+	}
+}
+
+// compile precomputes the ordered columns and the SQL statements for a table, so that the SQL is identical for every request.
+func (t *table) compile(d dialect) {
+	t.orderColumns()
+	setStmt := strings.Join(t.valueColumns, "=?,") + "=?"
+
+	t.readHashSQL = d.rebind(fmt.Sprintf("SELECT %s FROM %s WHERE %s = ?", hashColumn, t.name, t.primaryKey))
+	t.lockRowSQL = d.rebind(fmt.Sprintf("SELECT %s FROM %s WHERE %s = ?%s", hashColumn, t.name, t.primaryKey, d.forUpdate()))
+	t.updateSQL = d.rebind(fmt.Sprintf("UPDATE %s SET %s WHERE %s = ? AND %s = ?", t.name, setStmt, t.primaryKey, hashColumn))
+	t.updateByKeySQL = d.rebind(fmt.Sprintf("UPDATE %s SET %s WHERE %s = ?", t.name, setStmt, t.primaryKey))
+	t.insertSQL = d.rebind(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", t.name, strings.Join(t.valueColumns, ","), placeholders(len(t.valueColumns))))
+	t.upsertSQL = d.upsertSQL(*t)
+
+	t.updateMetadataSQL = ""
+	if len(t.metadataColumns) > 0 {
+		t.updateMetadataSQL = d.rebind(fmt.Sprintf("UPDATE %s SET %s=? WHERE %s = ?", t.name, strings.Join(t.metadataColumns, "=?,"), t.primaryKey))
+	}
+
+	t.readSQL = ""
+	t.readHeaders = nil
+	if docColumn := t.documentColumn(); docColumn != "" {
+		readColumns := []string{docColumn, hashColumn}
+		for header := range t.responseHeaders {
+			t.readHeaders = append(t.readHeaders, header)
+		}
+		sort.Strings(t.readHeaders)
+		for _, header := range t.readHeaders {
+			readColumns = append(readColumns, t.responseHeaders[header])
+		}
+
+		t.readSQL = d.rebind(fmt.Sprintf("SELECT %s FROM %s WHERE %s = ?", strings.Join(readColumns, ","), t.name, t.primaryKey))
+	}
+
+	t.changeSeqSQL = ""
+	t.changesSQL = ""
+	if t.changeFeed {
+		t.changeSeqSQL = d.rebind(fmt.Sprintf("UPDATE %s SET %s = (SELECT seq FROM %s WHERE table_name = ?) WHERE %s = ?", t.name, changeSeqColumn, changeSequenceTable, t.primaryKey))
+		changesColumns := []string{t.primaryKey, hashColumn, changeSeqColumn}
+		for _, header := range t.readHeaders {
+			changesColumns = append(changesColumns, t.responseHeaders[header])
+		}
+		t.changesSQL = d.rebind(fmt.Sprintf("SELECT %s FROM %s WHERE %s > ? ORDER BY %s LIMIT ?", strings.Join(changesColumns, ", "), t.name, changeSeqColumn, changeSeqColumn))
+	}
+}
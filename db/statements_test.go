@@ -0,0 +1,232 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Financial-Times/generic-rw-aurora/config"
+	"github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testTableForCompile() table {
+	return table{
+		name:            "draft_content",
+		columns:         map[string]string{"uuid": ":id", "last_modified": "@._timestamp", "origin_system": "@.x-origin-system-id", "body": "$"},
+		primaryKey:      "uuid",
+		responseHeaders: map[string]string{"X-Origin-System-Id": "origin_system", "Last-Modified-RFC3339": "last_modified"},
+	}
+}
+
+func TestCompileTable(t *testing.T) {
+	tbl := testTableForCompile()
+	tbl.compile(mysqlDialect{})
+
+	assert.Equal(t, []string{"body", "last_modified", "origin_system", "uuid", "hash"}, tbl.valueColumns)
+	assert.Equal(t, []string{"last_modified", "origin_system"}, tbl.metadataColumns)
+	assert.Equal(t, "SELECT hash FROM draft_content WHERE uuid = ?", tbl.readHashSQL)
+	assert.Equal(t, "SELECT hash FROM draft_content WHERE uuid = ? FOR UPDATE", tbl.lockRowSQL)
+	assert.Equal(t, "INSERT INTO draft_content (body,last_modified,origin_system,uuid,hash) VALUES (?,?,?,?,?)", tbl.insertSQL)
+	assert.Equal(t, "UPDATE draft_content SET body=?,last_modified=?,origin_system=?,uuid=?,hash=? WHERE uuid = ? AND hash = ?", tbl.updateSQL)
+	assert.Equal(t, "UPDATE draft_content SET last_modified=?,origin_system=? WHERE uuid = ?", tbl.updateMetadataSQL)
+	assert.Equal(t, "INSERT INTO draft_content (body,last_modified,origin_system,uuid,hash) VALUES (?,?,?,?,?) ON DUPLICATE KEY UPDATE body=?,last_modified=?,origin_system=?,uuid=?,hash=?", tbl.upsertSQL)
+	assert.Equal(t, "SELECT body,hash,last_modified,origin_system FROM draft_content WHERE uuid = ?", tbl.readSQL)
+	assert.Equal(t, []string{"Last-Modified-RFC3339", "X-Origin-System-Id"}, tbl.readHeaders)
+}
+
+func TestCompileTableIsDeterministic(t *testing.T) {
+	expected := testTableForCompile()
+	expected.compile(mysqlDialect{})
+
+	for i := 0; i < 20; i++ {
+		actual := testTableForCompile()
+		actual.compile(mysqlDialect{})
+		assert.Equal(t, expected.upsertSQL, actual.upsertSQL)
+		assert.Equal(t, expected.updateSQL, actual.updateSQL)
+		assert.Equal(t, expected.readSQL, actual.readSQL)
+	}
+}
+
+func TestCompileTablePostgres(t *testing.T) {
+	tbl := testTableForCompile()
+	tbl.compile(postgresDialect{})
+
+	assert.Equal(t, "SELECT hash FROM draft_content WHERE uuid = $1 FOR UPDATE", tbl.lockRowSQL)
+	assert.Equal(t, "INSERT INTO draft_content (body,last_modified,origin_system,uuid,hash) VALUES ($1,$2,$3,$4,$5)", tbl.insertSQL)
+	assert.Equal(t, "UPDATE draft_content SET body=$1,last_modified=$2,origin_system=$3,uuid=$4,hash=$5 WHERE uuid = $6 AND hash = $7", tbl.updateSQL)
+	assert.Equal(t, "INSERT INTO draft_content (body,last_modified,origin_system,uuid,hash) VALUES ($1,$2,$3,$4,$5) ON CONFLICT (uuid) DO UPDATE SET body=EXCLUDED.body,last_modified=EXCLUDED.last_modified,origin_system=EXCLUDED.origin_system,uuid=EXCLUDED.uuid,hash=EXCLUDED.hash RETURNING (xmax = 0)", tbl.upsertSQL)
+	assert.Equal(t, "SELECT body,hash,last_modified,origin_system FROM draft_content WHERE uuid = $1", tbl.readSQL)
+}
+
+func TestCompileTableWithoutDocumentColumn(t *testing.T) {
+	tbl := table{name: "keys_only", columns: map[string]string{"uuid": ":id"}, primaryKey: "uuid"}
+	tbl.compile(mysqlDialect{})
+
+	assert.Empty(t, tbl.readSQL)
+	assert.Empty(t, tbl.metadataColumns)
+	assert.Empty(t, tbl.updateMetadataSQL)
+}
+
+// missingRowStatements reads every row as missing, as if it had been inserted by another request after it was read
+type missingRowStatements struct {
+	executor
+}
+
+func (s missingRowStatements) query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return s.executor.query(ctx, query+" AND 1 = 0", args...)
+}
+
+func TestWriteDocumentInsertedConcurrently(t *testing.T) {
+	service := newTestChangeFeedService(t)
+	_, _, err := service.Write(context.Background(), testTable, "1234", NewDocument([]byte(`{"foo":"bar"}`)), map[string]string{"id": "1234"}, "")
+	require.NoError(t, err)
+
+	tbl := service.rwConfig[testTable]
+	conn, stmts := service.writer.current()
+	ex := missingRowStatements{stmts}
+	doc := tbl.hashDocument(context.Background(), NewDocument([]byte(`{"foo":"baz"}`)))
+	_, err = service.writeChangedDocument(context.Background(), ex, tbl, "1234", doc, map[string]string{"id": "1234"}, "", false)
+	assert.True(t, service.dialect.isUniqueViolation(err), "the insert of a row that is missing fails if it has been inserted since")
+
+	var storedHash string
+	require.NoError(t, conn.QueryRow("SELECT hash FROM "+testTable+" WHERE uuid = '1234'").Scan(&storedHash))
+	assert.NotEqual(t, doc.Hash, storedHash)
+
+	status, docHash, err := service.Write(context.Background(), testTable, "1234", doc, map[string]string{"id": "1234"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, Updated, status, "the write of the existing row locks it")
+	assert.Equal(t, doc.Hash, docHash)
+}
+
+// countingDriver counts the statements prepared by the database. Its connections only implement driver.Conn,
+// so database/sql must prepare every statement that it is not given as a *sql.Stmt.
+type countingDriver struct {
+	driver.Driver
+	prepares *int64
+}
+
+func (d countingDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{conn, d.prepares}, nil
+}
+
+type countingConn struct {
+	driver.Conn
+	prepares *int64
+}
+
+func (c countingConn) Prepare(query string) (driver.Stmt, error) {
+	atomic.AddInt64(c.prepares, 1)
+	return c.Conn.Prepare(query)
+}
+
+var benchmarkPrepares int64
+
+func TestStatementsPrepareOnce(t *testing.T) {
+	conn, err := openTestSQLite(t)()
+	require.NoError(t, err)
+	defer conn.Close()
+	stmts := newStatements(conn)
+
+	prepared := make(chan *sql.Stmt, 10)
+	for i := 0; i < cap(prepared); i++ {
+		go func() {
+			stmt, err := stmts.prepare(context.Background(), "SELECT 1")
+			assert.NoError(t, err)
+			prepared <- stmt
+		}()
+	}
+	first := <-prepared
+	for i := 1; i < cap(prepared); i++ {
+		assert.Same(t, first, <-prepared, "concurrent requests share the statement")
+	}
+
+	stmts.close()
+	assert.Empty(t, stmts.prepared)
+	assert.Error(t, first.QueryRow().Scan(new(int)), "the statement is closed")
+}
+
+func init() {
+	sql.Register("sqlite3-counting", countingDriver{&sqlite3.SQLiteDriver{}, &benchmarkPrepares})
+}
+
+// unpreparedStatements executes every statement directly on the pool, as the service did before statements were prepared.
+type unpreparedStatements struct {
+	conn *sql.DB
+}
+
+func (s unpreparedStatements) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return s.conn.ExecContext(ctx, query, args...)
+}
+
+func (s unpreparedStatements) query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return s.conn.QueryContext(ctx, query, args...)
+}
+
+func newBenchmarkService(b *testing.B) *AuroraRWService {
+	conn, err := sql.Open("sqlite3-counting", filepath.Join(b.TempDir(), "rw.db"))
+	require.NoError(b, err)
+	conn.SetMaxOpenConns(1)
+	b.Cleanup(func() { conn.Close() })
+
+	cfg, err := config.ReadConfig("../config.yml")
+	require.NoError(b, err)
+
+	service := newService(conn, sqliteDialect{}, true, cfg)
+	_, err = service.SchemaCheck()
+	require.NoError(b, err)
+	return service
+}
+
+func benchmarkWrite(b *testing.B, service *AuroraRWService, ex executor) {
+	ctx := context.Background()
+	doc := NewDocument([]byte(fmt.Sprintf(testDocTemplate, "bar")))
+	doc.Metadata.Set(timestampMetadata, "2018-01-01T00:00:00.000Z")
+	params := map[string]string{"id": "1234"}
+	t := service.rwConfig[testTableWithMetadata]
+
+	atomic.StoreInt64(&benchmarkPrepares, 0)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		values := columnValues(ctx, t, "1234", doc, params)
+		if _, err := service.dialect.upsert(ctx, ex, t, "1234", values); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(atomic.LoadInt64(&benchmarkPrepares))/float64(b.N), "prepares/op")
+}
+
+func BenchmarkWritePrepared(b *testing.B) {
+	service := newBenchmarkService(b)
+	_, stmts := service.writer.current()
+	benchmarkWrite(b, service, stmts)
+}
+
+func BenchmarkWriteUnprepared(b *testing.B) {
+	service := newBenchmarkService(b)
+	benchmarkWrite(b, service, unpreparedStatements{service.writer.db()})
+}
+
+func BenchmarkColumnValues(b *testing.B) {
+	ctx := context.Background()
+	doc := NewDocument([]byte(fmt.Sprintf(testDocTemplate, "bar")))
+	params := map[string]string{"id": "1234"}
+	t := testTableForCompile()
+	t.compile(mysqlDialect{})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		columnValues(ctx, t, "1234", doc, params)
+	}
+}
@@ -0,0 +1,69 @@
+package db
+
+import (
+	"database/sql"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// PoolStats is a snapshot of the statistics of a connection pool.
+type PoolStats struct {
+	MaxOpenConnections int   `json:"maxOpenConnections"`
+	OpenConnections    int   `json:"openConnections"`
+	InUse              int   `json:"inUse"`
+	Idle               int   `json:"idle"`
+	WaitCount          int64 `json:"waitCount"`
+	WaitDurationMillis int64 `json:"waitDurationMillis"`
+	MaxIdleClosed      int64 `json:"maxIdleClosed"`
+	MaxIdleTimeClosed  int64 `json:"maxIdleTimeClosed"`
+	MaxLifetimeClosed  int64 `json:"maxLifetimeClosed"`
+}
+
+func NewPoolStats(stats sql.DBStats) PoolStats {
+	return PoolStats{
+		MaxOpenConnections: stats.MaxOpenConnections,
+		OpenConnections:    stats.OpenConnections,
+		InUse:              stats.InUse,
+		Idle:               stats.Idle,
+		WaitCount:          stats.WaitCount,
+		WaitDurationMillis: stats.WaitDuration.Milliseconds(),
+		MaxIdleClosed:      stats.MaxIdleClosed,
+		MaxIdleTimeClosed:  stats.MaxIdleTimeClosed,
+		MaxLifetimeClosed:  stats.MaxLifetimeClosed,
+	}
+}
+
+// PoolMonitor reports the live statistics of named connection pools.
+type PoolMonitor interface {
+	PoolStats() map[string]PoolStats
+}
+
+// PoolStats returns the statistics of the current writer connection pool, and of the reader pool if there is one.
+func (service *AuroraRWService) PoolStats() map[string]PoolStats {
+	stats := map[string]PoolStats{"writer": NewPoolStats(service.writer.db().Stats())}
+	if service.reader != nil {
+		stats["reader"] = NewPoolStats(service.reader.db().Stats())
+	}
+	return stats
+}
+
+// RegisterPoolMetrics adds gauges for the live statistics of the monitored connection pools to the metrics registry,
+// named db.pool.<name>.<statistic>.
+func RegisterPoolMetrics(monitor PoolMonitor, registry metrics.Registry) {
+	gauges := map[string]func(PoolStats) int64{
+		"open":             func(s PoolStats) int64 { return int64(s.OpenConnections) },
+		"in-use":           func(s PoolStats) int64 { return int64(s.InUse) },
+		"idle":             func(s PoolStats) int64 { return int64(s.Idle) },
+		"wait-count":       func(s PoolStats) int64 { return s.WaitCount },
+		"wait-duration-ms": func(s PoolStats) int64 { return s.WaitDurationMillis },
+	}
+
+	for name := range monitor.PoolStats() {
+		for stat, value := range gauges {
+			name, value := name, value
+			registry.GetOrRegister("db.pool."+name+"."+stat, metrics.NewFunctionalGauge(func() int64 {
+				return value(monitor.PoolStats()[name])
+			}))
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/Financial-Times/generic-rw-aurora/config"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterPoolMetrics(t *testing.T) {
+	conn, err := Connect("sqlite://"+filepath.Join(t.TempDir(), "rw.db"), PoolConfig{})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	registry := metrics.NewRegistry()
+	RegisterPoolMetrics(newService(conn, sqliteDialect{}, false, &config.Config{}), registry)
+
+	for _, stat := range []string{"open", "in-use", "idle", "wait-count", "wait-duration-ms"} {
+		assert.Implements(t, (*metrics.Gauge)(nil), registry.Get("db.pool.writer."+stat), stat)
+	}
+
+	assert.Equal(t, int64(1), registry.Get("db.pool.writer.open").(metrics.Gauge).Value())
+	assert.Equal(t, int64(1), registry.Get("db.pool.writer.idle").(metrics.Gauge).Value())
+
+	tx, err := conn.Begin()
+	require.NoError(t, err)
+	defer tx.Rollback()
+	assert.Equal(t, int64(1), registry.Get("db.pool.writer.in-use").(metrics.Gauge).Value())
+}
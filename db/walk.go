@@ -0,0 +1,66 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// walkTable reads the given columns of the rows of a table in primary key order, starting after the given key,
+// and calls fn with each batch of rows. The first value of each row is its primary key.
+// A batch is read completely before fn is called, so fn may write to the same table.
+func (service *AuroraRWService) walkTable(ctx context.Context, t table, columns []string, after string, batchSize int, fn func(rows [][]string) error) error {
+	if batchSize <= 0 {
+		return fmt.Errorf("invalid batch size %d", batchSize)
+	}
+
+	query := service.dialect.rebind(fmt.Sprintf("SELECT %s FROM %s WHERE %s > ? ORDER BY %s LIMIT %d",
+		strings.Join(append([]string{t.primaryKey}, columns...), ","), t.name, t.primaryKey, t.primaryKey, batchSize))
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		batch, err := readBatch(ctx, service.writer.db(), query, len(columns)+1, after)
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if err := fn(batch); err != nil {
+			return err
+		}
+
+		if len(batch) < batchSize {
+			return nil
+		}
+		after = batch[len(batch)-1][0]
+	}
+}
+
+func readBatch(ctx context.Context, conn *sql.DB, query string, width int, after string) ([][]string, error) {
+	rows, err := conn.QueryContext(ctx, query, after)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch [][]string
+	for rows.Next() {
+		row := make([]string, width)
+		vals := make([]interface{}, width)
+		for i := range row {
+			vals[i] = &row[i]
+		}
+		if err := rows.Scan(vals...); err != nil {
+			return nil, err
+		}
+		batch = append(batch, row)
+	}
+
+	return batch, rows.Err()
+}
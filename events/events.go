@@ -0,0 +1,29 @@
+// Package events describes the change events of the documents stored by the service, and the notifiers that publish them.
+package events
+
+import "context"
+
+// The types of change event. A document that is written unchanged does not have an event.
+const (
+	Created = "created"
+	Updated = "updated"
+)
+
+// Event is a change to a stored document, recorded in the outbox in the same transaction as the write.
+type Event struct {
+	ID            int64  `json:"id"`
+	Path          string `json:"path"`
+	Table         string `json:"table"`
+	Key           string `json:"key"`
+	OldHash       string `json:"oldHash,omitempty"`
+	NewHash       string `json:"newHash"`
+	Type          string `json:"type"`
+	TransactionID string `json:"transactionId,omitempty"`
+	Timestamp     string `json:"timestamp"`
+}
+
+// Notifier publishes change events to downstream systems. The events are removed from the outbox only if Notify
+// returns nil, otherwise they are published again, so delivery is at least once.
+type Notifier interface {
+	Notify(ctx context.Context, events []Event) error
+}
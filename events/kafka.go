@@ -0,0 +1,122 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	tid "github.com/Financial-Times/transactionid-utils-go"
+	"github.com/IBM/sarama"
+	log "github.com/sirupsen/logrus"
+)
+
+// transactionIDHeader is the message header with the transaction id of the write, as in the HTTP request
+const transactionIDHeader = "X-Request-Id"
+
+// KafkaNotifier produces each change event as a JSON message keyed by the document key,
+// to the topic configured for the path of the event.
+// A batch succeeds only when every message has been acknowledged by all in-sync replicas,
+// otherwise it is produced again, so delivery is at least once.
+type KafkaNotifier struct {
+	sync.Mutex
+	producer    sarama.SyncProducer
+	newProducer func() (sarama.SyncProducer, error)
+	topics      map[string]string
+}
+
+// NewKafkaNotifier produces to the brokers. topics maps the configured paths to their topics;
+// the events of a path without a topic are not produced.
+// The producer connects with the first batch, and a batch that cannot connect is produced again with the next batch,
+// so that the service starts while Kafka is unavailable.
+func NewKafkaNotifier(brokers []string, topics map[string]string) *KafkaNotifier {
+	return &KafkaNotifier{
+		newProducer: func() (sarama.SyncProducer, error) {
+			return sarama.NewSyncProducer(brokers, newKafkaConfig())
+		},
+		topics: topics,
+	}
+}
+
+func newKafkaConfig() *sarama.Config {
+	cfg := sarama.NewConfig()
+	cfg.Producer.RequiredAcks = sarama.WaitForAll
+	cfg.Producer.Return.Successes = true
+	// the events of a document are produced to one partition, so they are consumed in order
+	cfg.Producer.Partitioner = sarama.NewHashPartitioner
+	return cfg
+}
+
+func newKafkaNotifier(producer sarama.SyncProducer, topics map[string]string) *KafkaNotifier {
+	return &KafkaNotifier{producer: producer, topics: topics}
+}
+
+// connect returns the producer, which is connected to the brokers if it has not been yet
+func (n *KafkaNotifier) connect() (sarama.SyncProducer, error) {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.producer == nil {
+		producer, err := n.newProducer()
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to Kafka: %w", err)
+		}
+		n.producer = producer
+	}
+	return n.producer, nil
+}
+
+func (n *KafkaNotifier) Notify(ctx context.Context, events []Event) error {
+	var messages []*sarama.ProducerMessage
+	for _, e := range events {
+		topic, found := n.topics[e.Path]
+		if !found || topic == "" {
+			log.WithFields(log.Fields{"path": e.Path, "key": e.Key, tid.TransactionIDKey: e.TransactionID}).Debug("no topic is configured for the path, skipping change event")
+			continue
+		}
+
+		value, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+
+		messages = append(messages, &sarama.ProducerMessage{
+			Topic:   topic,
+			Key:     sarama.StringEncoder(e.Key),
+			Value:   sarama.ByteEncoder(value),
+			Headers: []sarama.RecordHeader{{Key: []byte(transactionIDHeader), Value: []byte(e.TransactionID)}},
+		})
+	}
+
+	if len(messages) == 0 {
+		return nil
+	}
+
+	// the producer cannot be cancelled, so the batch is abandoned at the deadline, and produced again with the next batch
+	sent := make(chan error, 1)
+	go func() {
+		producer, err := n.connect()
+		if err != nil {
+			sent <- err
+			return
+		}
+		sent <- producer.SendMessages(messages)
+	}()
+	select {
+	case err := <-sent:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close closes the producer, if it has connected.
+func (n *KafkaNotifier) Close() error {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.producer == nil {
+		return nil
+	}
+	return n.producer.Close()
+}
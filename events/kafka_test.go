@@ -0,0 +1,118 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/IBM/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testTopics = map[string]string{"/drafts/content/:id/annotations": "DraftAnnotationsChanged"}
+
+// checkMessage returns a checker that the message is the event, produced to the topic
+func checkMessage(t *testing.T, topic string, expected Event) mocks.MessageChecker {
+	return func(msg *sarama.ProducerMessage) error {
+		assert.Equal(t, topic, msg.Topic)
+
+		key, err := msg.Key.Encode()
+		require.NoError(t, err)
+		assert.Equal(t, expected.Key, string(key), "messages are keyed by document key")
+
+		require.Len(t, msg.Headers, 1)
+		assert.Equal(t, "X-Request-Id", string(msg.Headers[0].Key))
+		assert.Equal(t, expected.TransactionID, string(msg.Headers[0].Value))
+
+		value, err := msg.Value.Encode()
+		require.NoError(t, err)
+		var actual Event
+		require.NoError(t, json.Unmarshal(value, &actual))
+		assert.Equal(t, expected, actual)
+		return nil
+	}
+}
+
+func TestKafkaNotifier(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, newKafkaConfig())
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(checkMessage(t, "DraftAnnotationsChanged", testEvents[0]))
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(checkMessage(t, "DraftAnnotationsChanged", testEvents[1]))
+
+	notifier := newKafkaNotifier(producer, testTopics)
+	assert.NoError(t, notifier.Notify(context.Background(), testEvents))
+	assert.NoError(t, notifier.Close())
+}
+
+func TestKafkaNotifierSkipsPathWithoutTopic(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, newKafkaConfig())
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(checkMessage(t, "DraftAnnotationsChanged", testEvents[0]))
+
+	other := testEvents[1]
+	other.Path = "/published/content/:id/annotations"
+
+	notifier := newKafkaNotifier(producer, testTopics)
+	assert.NoError(t, notifier.Notify(context.Background(), []Event{testEvents[0], other}))
+	assert.NoError(t, notifier.Close())
+}
+
+func TestKafkaNotifierFailureRetriesBatch(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, newKafkaConfig())
+	producer.ExpectSendMessageAndSucceed()
+	producer.ExpectSendMessageAndFail(sarama.ErrNotEnoughReplicas)
+	// the failed batch is produced again in full, so the first event is delivered twice
+	producer.ExpectSendMessageAndSucceed()
+	producer.ExpectSendMessageAndSucceed()
+
+	notifier := newKafkaNotifier(producer, testTopics)
+	assert.Error(t, notifier.Notify(context.Background(), testEvents))
+
+	assert.NoError(t, notifier.Notify(context.Background(), testEvents))
+	assert.NoError(t, notifier.Close())
+}
+
+// blockingProducer does not send its messages until it is released
+type blockingProducer struct {
+	sarama.SyncProducer
+	release chan struct{}
+}
+
+func (p *blockingProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	<-p.release
+	return nil
+}
+
+func TestKafkaNotifierDeadline(t *testing.T) {
+	producer := &blockingProducer{release: make(chan struct{})}
+	defer close(producer.release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	notifier := newKafkaNotifier(producer, testTopics)
+	assert.Equal(t, context.DeadlineExceeded, notifier.Notify(ctx, testEvents), "the batch is abandoned at the deadline")
+}
+
+func TestKafkaNotifierConnectsWithFirstBatch(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, newKafkaConfig())
+	producer.ExpectSendMessageAndSucceed()
+	producer.ExpectSendMessageAndSucceed()
+
+	connects := 0
+	notifier := NewKafkaNotifier([]string{"localhost:9092"}, testTopics)
+	notifier.newProducer = func() (sarama.SyncProducer, error) {
+		connects++
+		if connects == 1 {
+			return nil, sarama.ErrOutOfBrokers
+		}
+		return producer, nil
+	}
+	assert.NoError(t, notifier.Close(), "the notifier is closed before it has connected")
+
+	assert.EqualError(t, notifier.Notify(context.Background(), testEvents), "unable to connect to Kafka: "+sarama.ErrOutOfBrokers.Error())
+	assert.NoError(t, notifier.Notify(context.Background(), testEvents), "the batch is produced once the producer connects")
+	assert.Equal(t, 2, connects)
+	assert.NoError(t, notifier.Close())
+}
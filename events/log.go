@@ -0,0 +1,32 @@
+package events
+
+import (
+	"context"
+
+	tid "github.com/Financial-Times/transactionid-utils-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// LogNotifier writes each change event to the log.
+type LogNotifier struct{}
+
+func NewLogNotifier() *LogNotifier {
+	return &LogNotifier{}
+}
+
+func (n *LogNotifier) Notify(ctx context.Context, events []Event) error {
+	for _, e := range events {
+		log.WithFields(log.Fields{
+			"eventId":            e.ID,
+			"path":               e.Path,
+			"table":              e.Table,
+			"key":                e.Key,
+			"oldHash":            e.OldHash,
+			"newHash":            e.NewHash,
+			"type":               e.Type,
+			tid.TransactionIDKey: e.TransactionID,
+			"timestamp":          e.Timestamp,
+		}).Info("document changed")
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package events
+
+import (
+	"context"
+	"testing"
+
+	tid "github.com/Financial-Times/transactionid-utils-go"
+	logTest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogNotifier(t *testing.T) {
+	hook := logTest.NewGlobal()
+
+	require.NoError(t, NewLogNotifier().Notify(context.Background(), testEvents))
+
+	require.Len(t, hook.AllEntries(), 2)
+	entry := hook.AllEntries()[1]
+	assert.Equal(t, "document changed", entry.Message)
+	assert.Equal(t, "1234", entry.Data["key"])
+	assert.Equal(t, "abc", entry.Data["oldHash"])
+	assert.Equal(t, "def", entry.Data["newHash"])
+	assert.Equal(t, Updated, entry.Data["type"])
+	assert.Equal(t, "tid_test", entry.Data[tid.TransactionIDKey])
+}
@@ -0,0 +1,53 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testEvents = []Event{
+	{ID: 1, Path: "/drafts/content/:id/annotations", Table: "draft_annotations", Key: "1234", NewHash: "abc", Type: Created, TransactionID: "tid_test", Timestamp: "2018-01-01T00:00:00.000Z"},
+	{ID: 2, Path: "/drafts/content/:id/annotations", Table: "draft_annotations", Key: "1234", OldHash: "abc", NewHash: "def", Type: Updated, TransactionID: "tid_test", Timestamp: "2018-01-01T00:00:01.000Z"},
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var received []Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	err := NewWebhookNotifier(server.URL, time.Second).Notify(context.Background(), testEvents)
+	require.NoError(t, err)
+	assert.Equal(t, testEvents, received)
+}
+
+func TestWebhookNotifierErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	err := NewWebhookNotifier(server.URL, time.Second).Notify(context.Background(), testEvents)
+	assert.EqualError(t, err, "webhook responded with status 503")
+}
+
+func TestWebhookNotifierTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	err := NewWebhookNotifier(server.URL, 50*time.Millisecond).Notify(context.Background(), testEvents)
+	assert.Error(t, err)
+}
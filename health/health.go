@@ -1,34 +1,66 @@
 package health
 
 import (
+	"fmt"
 	"net/http"
+	"regexp"
+	"sort"
+	"strings"
 
+	"github.com/Financial-Times/generic-rw-aurora/config"
 	"github.com/Financial-Times/generic-rw-aurora/db"
 	fthealth "github.com/Financial-Times/go-fthealth/v1_1"
 	"github.com/Financial-Times/service-status-go/gtg"
 	log "github.com/sirupsen/logrus"
 )
 
+// defaultTableCheckSeverity is the severity of a table check that is not configured, which does not fail the GTG
+const defaultTableCheckSeverity = 2
+
 type HealthService struct {
 	fthealth.HealthCheck
 	db db.RWMonitor
+	// criticalTableCheckers are the table checks that also fail the GTG
+	criticalTableCheckers []gtg.StatusChecker
 }
 
 func NewHealthService(appSystemCode string, appName string, appDescription string, rw db.RWMonitor) *HealthService {
 	h := &HealthService{
-		fthealth.HealthCheck{
-			appSystemCode,
-			appName,
-			appDescription,
-			[]fthealth.Check{},
+		HealthCheck: fthealth.HealthCheck{
+			SystemCode:  appSystemCode,
+			Name:        appName,
+			Description: appDescription,
+			Checks:      []fthealth.Check{},
 		},
-		rw,
+		db: rw,
 	}
-	h.Checks = append(h.Checks, h.dbPingCheck(), h.dbSchemaCheck())
+	h.Checks = append(h.Checks, h.dbPingCheck(), h.dbSchemaCheck(), h.dbWritableCheck())
 
 	return h
 }
 
+// AddTableChecks adds a check of the table of each configured path, if the database monitor can check tables.
+// The checks of the paths with a schemaCheckSeverity of 1 also fail the GTG.
+func (service *HealthService) AddTableChecks(rwConfig *config.Config) {
+	checker, ok := service.db.(db.TableChecker)
+	if !ok {
+		return
+	}
+
+	var paths []string
+	for path := range rwConfig.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		check := dbTableCheck(checker, path, rwConfig.Paths[path])
+		service.Checks = append(service.Checks, check)
+		if check.Severity == 1 {
+			service.criticalTableCheckers = append(service.criticalTableCheckers, tableStatusChecker(path, check))
+		}
+	}
+}
+
 // HealthCheckHandleFunc provides the http endpoint function
 func (service *HealthService) HealthCheckHandleFunc() func(w http.ResponseWriter, r *http.Request) {
 	return fthealth.Handler(service)
@@ -49,8 +81,9 @@ func (service *HealthService) GTG() gtg.Status {
 	}
 
 	checkers = append(checkers, dbPingCheck)
+	checkers = append(checkers, service.criticalTableCheckers...)
 
-	// switch to 'gtg.FailFastParallelCheck' if there are multiple checkers in the future.
+	// the table checks follow the connection check, so a lost connection is not reported as a broken table
 	return gtg.FailFastSequentialChecker(checkers)()
 }
 
@@ -77,3 +110,54 @@ func (service *HealthService) dbSchemaCheck() fthealth.Check {
 		Checker:          service.db.SchemaCheck,
 	}
 }
+
+func (service *HealthService) dbWritableCheck() fthealth.Check {
+	return fthealth.Check{
+		ID:               "check-db-writable",
+		BusinessImpact:   "Editorial cannot make changes to annotations for content.",
+		Name:             "Check database is writable",
+		PanicGuide:       "https://runbooks.in.ft.com/generic-rw-aurora",
+		Severity:         1,
+		TechnicalSummary: "Application is connected to a read-only database instance, e.g. after an Aurora failover. The connection pool is recreated automatically.",
+		Checker:          service.db.Writable,
+	}
+}
+
+// dbTableCheck verifies the columns of the table of a path, so that the health check reports which path is broken
+func dbTableCheck(checker db.TableChecker, path string, mapping config.Mapping) fthealth.Check {
+	severity := mapping.SchemaCheckSeverity
+	if severity == 0 {
+		severity = defaultTableCheckSeverity
+	}
+
+	return fthealth.Check{
+		ID:               "check-db-table-" + pathSlug(path),
+		BusinessImpact:   fmt.Sprintf("Editorial may not be able to read or write documents at %s.", path),
+		Name:             fmt.Sprintf("Check database table for %s", path),
+		PanicGuide:       "https://runbooks.in.ft.com/generic-rw-aurora",
+		Severity:         severity,
+		TechnicalSummary: fmt.Sprintf("The database table %s is missing, or is missing the primary key, mapped or hash columns of %s, or their types do not match the configuration.", mapping.Table, path),
+		Checker: func() (string, error) {
+			return checker.TableCheck(path, mapping)
+		},
+	}
+}
+
+// nonAlphanumeric matches the separators and parameter markers of a path
+var nonAlphanumeric = regexp.MustCompile("[^a-z0-9]+")
+
+// pathSlug identifies a path in a check ID, e.g. drafts-content-id for /drafts/content/:id,
+// so that the paths that share a table have their own checks
+func pathSlug(path string) string {
+	return strings.Trim(nonAlphanumeric.ReplaceAllString(strings.ToLower(path), "-"), "-")
+}
+
+func tableStatusChecker(path string, check fthealth.Check) gtg.StatusChecker {
+	return func() gtg.Status {
+		if _, err := check.Checker(); err != nil {
+			log.WithError(err).WithField("path", path).Info("database table does not match the configuration")
+			return gtg.Status{GoodToGo: false, Message: fmt.Sprintf("Database table for %s does not match the configuration", path)}
+		}
+		return gtg.Status{GoodToGo: true, Message: "OK"}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"testing"
 
+	"github.com/Financial-Times/generic-rw-aurora/config"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -22,6 +23,26 @@ func (m *mockRWMonitor) SchemaCheck() (string, error) {
 	return args.String(0), args.Error(1)
 }
 
+func (m *mockRWMonitor) Writable() (string, error) {
+	args := m.Called()
+	return args.String(0), args.Error(1)
+}
+
+// mockTableChecker is a monitor that also checks tables
+type mockTableChecker struct {
+	mockRWMonitor
+}
+
+func (m *mockTableChecker) TableCheck(path string, mapping config.Mapping) (string, error) {
+	args := m.Called(path, mapping)
+	return args.String(0), args.Error(1)
+}
+
+var testTableConfig = &config.Config{Paths: map[string]config.Mapping{
+	"/drafts/content/:id":             {Table: "draft_content", SchemaCheckSeverity: 1},
+	"/drafts/content/:id/annotations": {Table: "draft_annotations"},
+}}
+
 func TestGTG_OK(t *testing.T) {
 	rw := &mockRWMonitor{}
 	rw.On("Ping").Return("OK", nil)
@@ -51,6 +72,7 @@ func TestHealth_OK(t *testing.T) {
 	rw := &mockRWMonitor{}
 	rw.On("Ping").Return("OK", nil)
 	rw.On("SchemaCheck").Return("OK", nil)
+	rw.On("Writable").Return("OK", nil)
 	h := NewHealthService("test-systemCode", "test-appName", "test-appDescription", rw)
 
 	for _, c := range h.Checks {
@@ -66,6 +88,7 @@ func TestHealth_NotConnected(t *testing.T) {
 	err := errors.New("not connected")
 	rw.On("Ping").Return("Not OK", err)
 	rw.On("SchemaCheck").Return("Not OK", err)
+	rw.On("Writable").Return("Not OK", err)
 	h := NewHealthService("test-systemCode", "test-appName", "test-appDescription", rw)
 
 	for _, c := range h.Checks {
@@ -81,12 +104,13 @@ func TestHealth_SchemaMismatch(t *testing.T) {
 	rw.On("Ping").Return("OK", nil)
 	err := errors.New("schema mismatch")
 	rw.On("SchemaCheck").Return("Not OK", err)
+	rw.On("Writable").Return("OK", nil)
 	h := NewHealthService("test-systemCode", "test-appName", "test-appDescription", rw)
 
 	for _, c := range h.Checks {
 		_, actual := c.Checker()
 		if actual == nil {
-			assert.Equal(t, "check-db-connection", c.ID, "ID of healthy check")
+			assert.Contains(t, []string{"check-db-connection", "check-db-writable"}, c.ID, "ID of healthy check")
 		} else {
 			assert.Equal(t, "check-db-schema", c.ID, "ID of unhealthy check")
 			assert.EqualError(t, actual, err.Error())
@@ -95,3 +119,92 @@ func TestHealth_SchemaMismatch(t *testing.T) {
 
 	rw.AssertExpectations(t)
 }
+
+func TestHealth_ReadOnly(t *testing.T) {
+	rw := &mockRWMonitor{}
+	rw.On("Ping").Return("OK", nil)
+	rw.On("SchemaCheck").Return("OK", nil)
+	err := errors.New("database is read-only")
+	rw.On("Writable").Return("Database is read-only", err)
+	h := NewHealthService("test-systemCode", "test-appName", "test-appDescription", rw)
+
+	for _, c := range h.Checks {
+		_, actual := c.Checker()
+		if c.ID == "check-db-writable" {
+			assert.EqualError(t, actual, err.Error())
+		} else {
+			assert.NoError(t, actual, c.ID)
+		}
+	}
+
+	rw.AssertExpectations(t)
+}
+
+func TestHealth_TableChecks(t *testing.T) {
+	rw := &mockTableChecker{}
+	err := errors.New("table draft_annotations of path /drafts/content/:id/annotations: column hash does not exist")
+	rw.On("TableCheck", "/drafts/content/:id", testTableConfig.Paths["/drafts/content/:id"]).Return("OK", nil)
+	rw.On("TableCheck", "/drafts/content/:id/annotations", testTableConfig.Paths["/drafts/content/:id/annotations"]).Return("Not OK", err)
+	h := NewHealthService("test-systemCode", "test-appName", "test-appDescription", rw)
+	h.AddTableChecks(testTableConfig)
+
+	checks := make(map[string]uint8)
+	for _, c := range h.Checks {
+		if c.ID != "check-db-table-drafts-content-id" && c.ID != "check-db-table-drafts-content-id-annotations" {
+			continue
+		}
+		checks[c.ID] = c.Severity
+
+		_, actual := c.Checker()
+		if c.ID == "check-db-table-drafts-content-id-annotations" {
+			assert.EqualError(t, actual, err.Error(), "the check reports the broken path")
+			assert.Equal(t, "Check database table for /drafts/content/:id/annotations", c.Name)
+		} else {
+			assert.NoError(t, actual)
+		}
+	}
+	assert.Equal(t, map[string]uint8{"check-db-table-drafts-content-id": 1, "check-db-table-drafts-content-id-annotations": 2}, checks)
+
+	rw.AssertExpectations(t)
+}
+
+func TestGTG_TableCheckNotCritical(t *testing.T) {
+	rw := &mockTableChecker{}
+	rw.On("Ping").Return("OK", nil)
+	rw.On("TableCheck", "/drafts/content/:id", testTableConfig.Paths["/drafts/content/:id"]).Return("OK", nil)
+	h := NewHealthService("test-systemCode", "test-appName", "test-appDescription", rw)
+	h.AddTableChecks(testTableConfig)
+
+	gtg := h.GTG()
+	assert.True(t, gtg.GoodToGo, "GTG")
+
+	rw.AssertExpectations(t)
+	rw.AssertNotCalled(t, "TableCheck", "/drafts/content/:id/annotations", testTableConfig.Paths["/drafts/content/:id/annotations"])
+}
+
+func TestGTG_TableCheckCritical(t *testing.T) {
+	rw := &mockTableChecker{}
+	rw.On("Ping").Return("OK", nil)
+	rw.On("TableCheck", "/drafts/content/:id", testTableConfig.Paths["/drafts/content/:id"]).Return("Not OK", errors.New("table draft_content of path /drafts/content/:id: table does not exist"))
+	h := NewHealthService("test-systemCode", "test-appName", "test-appDescription", rw)
+	h.AddTableChecks(testTableConfig)
+
+	gtg := h.GTG()
+	assert.False(t, gtg.GoodToGo, "GTG")
+	assert.Equal(t, "Database table for /drafts/content/:id does not match the configuration", gtg.Message)
+
+	rw.AssertExpectations(t)
+}
+
+func TestHealth_NoTableChecker(t *testing.T) {
+	h := NewHealthService("test-systemCode", "test-appName", "test-appDescription", &mockRWMonitor{})
+	h.AddTableChecks(testTableConfig)
+
+	assert.Len(t, h.Checks, 3, "a monitor that cannot check tables has no table checks")
+}
+
+func TestPathSlug(t *testing.T) {
+	assert.Equal(t, "drafts-content-id", pathSlug("/drafts/content/:id"))
+	assert.Equal(t, "drafts-content-id-annotations", pathSlug("/drafts/content/:id/annotations"))
+	assert.Equal(t, "things", pathSlug("/Things/"))
+}
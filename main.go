@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	api "github.com/Financial-Times/api-endpoint"
 	"github.com/Financial-Times/generic-rw-aurora/config"
 	"github.com/Financial-Times/generic-rw-aurora/db"
+	"github.com/Financial-Times/generic-rw-aurora/events"
 	"github.com/Financial-Times/generic-rw-aurora/health"
 	"github.com/Financial-Times/generic-rw-aurora/resources"
 	"github.com/Financial-Times/http-handlers-go/httphandlers"
@@ -21,8 +25,6 @@ import (
 const (
 	systemCode     = "generic-rw-aurora"
 	appDescription = "Generic R/W for Aurora"
-	// db.t2.small allows a maximum of 45 connections, but there are likely 2 instances of this service in each of 2 regions
-	maxConnections = 10
 )
 
 func main() {
@@ -62,6 +64,112 @@ func main() {
 		EnvVar: "DB_CONNECTION_URL",
 	})
 
+	dbReaderURL := app.String(cli.StringOpt{
+		Name:   "db-reader-connection-url",
+		Value:  "",
+		Desc:   "Database reader (replica) connection URL, used for reads if set",
+		EnvVar: "DB_READER_CONNECTION_URL",
+	})
+
+	dbEngine := app.String(cli.StringOpt{
+		Name:   "db-engine",
+		Value:  db.EngineMySQL,
+		Desc:   "Database engine (mysql or postgres), used with db-password-file",
+		EnvVar: "DB_ENGINE",
+	})
+
+	dbHost := app.String(cli.StringOpt{
+		Name:   "db-host",
+		Value:  "",
+		Desc:   "Database host and port, used instead of the connection URL if db-password-file is set",
+		EnvVar: "DB_HOST",
+	})
+
+	dbReaderHost := app.String(cli.StringOpt{
+		Name:   "db-reader-host",
+		Value:  "",
+		Desc:   "Database reader (replica) host and port, used for reads if db-password-file is set",
+		EnvVar: "DB_READER_HOST",
+	})
+
+	dbUser := app.String(cli.StringOpt{
+		Name:   "db-user",
+		Value:  "",
+		Desc:   "Database user, used with db-password-file",
+		EnvVar: "DB_USER",
+	})
+
+	dbName := app.String(cli.StringOpt{
+		Name:   "db-name",
+		Value:  "pac",
+		Desc:   "Database name, used with db-password-file",
+		EnvVar: "DB_NAME",
+	})
+
+	dbPasswordFile := app.String(cli.StringOpt{
+		Name:   "db-password-file",
+		Value:  "",
+		Desc:   "File containing the database password. If set, the connection is built from the host, user and name options, and re-established when the file changes",
+		EnvVar: "DB_PASSWORD_FILE",
+	})
+
+	dbPasswordPollInterval := app.String(cli.StringOpt{
+		Name:   "db-password-poll-interval",
+		Value:  "1m",
+		Desc:   "How often to check the database password file for changes",
+		EnvVar: "DB_PASSWORD_POLL_INTERVAL",
+	})
+
+	dbMaxOpenConnections := app.Int(cli.IntOpt{
+		Name: "db-max-open-connections",
+		// db.t2.small allows a maximum of 45 connections, but there are likely 2 instances of this service in each of 2 regions
+		Value:  10,
+		Desc:   "Maximum number of open connections to the database",
+		EnvVar: "DB_MAX_OPEN_CONNECTIONS",
+	})
+
+	dbMaxIdleConnections := app.Int(cli.IntOpt{
+		Name:   "db-max-idle-connections",
+		Value:  2,
+		Desc:   "Maximum number of idle connections kept in the pool",
+		EnvVar: "DB_MAX_IDLE_CONNECTIONS",
+	})
+
+	dbConnMaxLifetime := app.String(cli.StringOpt{
+		Name:   "db-conn-max-lifetime",
+		Value:  "5m",
+		Desc:   "Maximum time a connection is reused for, so that connections to a failed over instance are replaced (0 for no limit)",
+		EnvVar: "DB_CONN_MAX_LIFETIME",
+	})
+
+	dbConnMaxIdleTime := app.String(cli.StringOpt{
+		Name:   "db-conn-max-idle-time",
+		Value:  "1m",
+		Desc:   "Maximum time a connection may be idle before it is closed (0 for no limit)",
+		EnvVar: "DB_CONN_MAX_IDLE_TIME",
+	})
+
+	dbDialTimeout := app.String(cli.StringOpt{
+		Name:   "db-dial-timeout",
+		Value:  "5s",
+		Desc:   "Timeout for establishing a database connection (0 for the driver default)",
+		EnvVar: "DB_DIAL_TIMEOUT",
+	})
+
+	dbReadTimeout := app.String(cli.StringOpt{
+		Name:   "db-read-timeout",
+		Value:  "30s",
+		Desc:   "I/O read timeout of a database connection, MySQL only (0 for no timeout)",
+		EnvVar: "DB_READ_TIMEOUT",
+	})
+
+	dbWriteTimeout := app.String(cli.StringOpt{
+		Name:   "db-write-timeout",
+		Value:  "30s",
+		Desc:   "I/O write timeout of a database connection, MySQL only (0 for no timeout)",
+		EnvVar: "DB_WRITE_TIMEOUT",
+	})
+
 	performSchemaMigrations := app.Bool(cli.BoolOpt{
 		Name:   "db-perform-schema-migrations",
 		Value:  false,
@@ -69,6 +177,83 @@ func main() {
 		EnvVar: "DB_PERFORM_SCHEMA_MIGRATIONS",
 	})
 
+	autoCreateTables := app.Bool(cli.BoolOpt{
+		Name:   "db-auto-create-tables",
+		Value:  false,
+		Desc:   "Whether to create the configured tables and columns that are missing from the database on startup, for development environments",
+		EnvVar: "DB_AUTO_CREATE_TABLES",
+	})
+
+	migrationsDir := app.String(cli.StringOpt{
+		Name:   "migrations-dir",
+		Value:  "",
+		Desc:   "Directory of NNNNN_name.up.sql and NNNNN_name.down.sql schema migration files, replacing the built-in migrations",
+		EnvVar: "MIGRATIONS_DIR",
+	})
+
+	dbMigrationLockTimeout := app.String(cli.StringOpt{
+		Name:   "db-migration-lock-timeout",
+		Value:  db.DefaultMigrationLockTimeout.String(),
+		Desc:   "How long to wait for another instance to finish migrating the database schema",
+		EnvVar: "DB_MIGRATION_LOCK_TIMEOUT",
+	})
+
+	readCacheSize := app.Int(cli.IntOpt{
+		Name:   "read-cache-size",
+		Value:  0,
+		Desc:   "Maximum number of documents to cache for the paths that have a cacheTTL, 0 disables the cache",
+		EnvVar: "READ_CACHE_SIZE",
+	})
+
+	outboxNotifier := app.String(cli.StringOpt{
+		Name:   "outbox-notifier",
+		Value:  "",
+		Desc:   "Where to publish the document change events recorded in the outbox: log, webhook or kafka (disabled if empty)",
+		EnvVar: "OUTBOX_NOTIFIER",
+	})
+
+	outboxWebhookURL := app.String(cli.StringOpt{
+		Name:   "outbox-webhook-url",
+		Value:  "",
+		Desc:   "URL the change events are posted to by the webhook notifier",
+		EnvVar: "OUTBOX_WEBHOOK_URL",
+	})
+
+	outboxWebhookTimeout := app.String(cli.StringOpt{
+		Name:   "outbox-webhook-timeout",
+		Value:  "10s",
+		Desc:   "Timeout of a webhook request",
+		EnvVar: "OUTBOX_WEBHOOK_TIMEOUT",
+	})
+
+	kafkaBrokers := app.String(cli.StringOpt{
+		Name:   "kafka-brokers",
+		Value:  "",
+		Desc:   "Comma-separated list of Kafka brokers the change events are produced to by the kafka notifier, on the topic of each path",
+		EnvVar: "KAFKA_BROKERS",
+	})
+
+	outboxPollInterval := app.String(cli.StringOpt{
+		Name:   "outbox-poll-interval",
+		Value:  "1s",
+		Desc:   "How often the outbox is checked for change events to publish",
+		EnvVar: "OUTBOX_POLL_INTERVAL",
+	})
+
+	outboxBatchSize := app.Int(cli.IntOpt{
+		Name:   "outbox-batch-size",
+		Value:  100,
+		Desc:   "Maximum number of change events to publish at a time",
+		EnvVar: "OUTBOX_BATCH_SIZE",
+	})
+
+	adminBackfillEnabled := app.Bool(cli.BoolOpt{
+		Name:   "admin-backfill-enabled",
+		Value:  false,
+		Desc:   "Whether to serve the admin endpoints that start a backfill of a table, /__backfill/<table>",
+		EnvVar: "ADMIN_BACKFILL_ENABLED",
+	})
+
 	rwYml := app.String(cli.StringOpt{
 		Name:   "rw-config",
 		Value:  "./config.yml",
@@ -87,6 +272,220 @@ func main() {
 	log.SetLevel(log.InfoLevel)
 	log.Infof("[Startup] %v is starting", *appSystemCode)
 
+	dbPoolConfig := func() db.PoolConfig {
+		pool := db.PoolConfig{MaxOpenConnections: *dbMaxOpenConnections, MaxIdleConnections: *dbMaxIdleConnections}
+		durations := map[string]struct {
+			value  string
+			target *time.Duration
+		}{
+			"db-conn-max-lifetime":  {*dbConnMaxLifetime, &pool.ConnMaxLifetime},
+			"db-conn-max-idle-time": {*dbConnMaxIdleTime, &pool.ConnMaxIdleTime},
+			"db-dial-timeout":       {*dbDialTimeout, &pool.DialTimeout},
+			"db-read-timeout":       {*dbReadTimeout, &pool.ReadTimeout},
+			"db-write-timeout":      {*dbWriteTimeout, &pool.WriteTimeout},
+		}
+		for name, d := range durations {
+			var err error
+			if *d.target, err = time.ParseDuration(d.value); err != nil {
+				log.WithError(err).WithField("option", name).Fatal("unable to parse database connection option")
+			}
+		}
+		return pool
+	}
+
+	app.Before = func() {
+		if *migrationsDir == "" {
+			return
+		}
+		if err := db.LoadMigrations(*migrationsDir); err != nil {
+			log.WithError(err).WithField("dir", *migrationsDir).Fatal("unable to load database migrations")
+		}
+	}
+
+	migrationLockTimeout := func() time.Duration {
+		timeout, err := time.ParseDuration(*dbMigrationLockTimeout)
+		if err != nil || timeout < 0 {
+			log.WithError(err).WithField("timeout", *dbMigrationLockTimeout).Fatal("invalid database migration lock timeout")
+		}
+		return timeout
+	}
+
+	// dbOpener connects to the connection URL or, if a password file is set, to the host with the current password
+	dbOpener := func(dbURL string, host string, pool db.PoolConfig) func() (*sql.DB, error) {
+		return func() (*sql.DB, error) {
+			if *dbPasswordFile == "" {
+				return db.Connect(dbURL, pool)
+			}
+
+			credentials := db.Credentials{Engine: *dbEngine, Host: host, User: *dbUser, Database: *dbName, PasswordFile: *dbPasswordFile}
+			credentialsURL, err := credentials.URL()
+			if err != nil {
+				return nil, err
+			}
+			return db.Connect(credentialsURL, pool)
+		}
+	}
+
+	app.Command("rehash", "Re-hash the stored documents of a table with its configured hash mode", func(cmd *cli.Cmd) {
+		cmd.Spec = "[--batch-size] TABLE"
+		tableName := cmd.StringArg("TABLE", "", "Table to re-hash")
+		batchSize := cmd.IntOpt("batch-size", 500, "Number of rows to read at a time")
+
+		cmd.Action = func() {
+			rwConfig, err := config.ReadConfig(*rwYml)
+			if err != nil {
+				log.WithError(err).Fatal("unable to read r/w YAML configuration")
+			}
+
+			conn, err := dbOpener(*dbURL, *dbHost, dbPoolConfig())()
+			if err != nil {
+				log.WithError(err).Fatal("unable to connect to database")
+			}
+
+			var options []db.Option
+			if *outboxNotifier != "" {
+				// the rehashed documents are recorded as changes, which the serving instances publish
+				options = append(options, db.WithOutbox(nil, 0, 1))
+			}
+			rw := db.NewService(conn, false, rwConfig, options...)
+			if _, err := rw.SchemaCheck(); err != nil {
+				log.WithError(err).Fatal("database schema is mismatched, not re-hashing")
+			}
+
+			scanned, updated, err := rw.Rehash(context.Background(), *tableName, *batchSize)
+			if err != nil {
+				log.WithError(err).WithFields(log.Fields{"table": *tableName, "scanned": scanned, "updated": updated}).Fatal("re-hashing failed")
+			}
+			log.WithFields(log.Fields{"table": *tableName, "scanned": scanned, "updated": updated}).Info("re-hashing complete")
+		}
+	})
+
+	app.Command("backfill", "Re-evaluate the JSONPath columns of the stored documents of a table, resuming an interrupted backfill", func(cmd *cli.Cmd) {
+		cmd.Spec = "[--batch-size] [--batch-delay] [--columns] [--restart] TABLE"
+		tableName := cmd.StringArg("TABLE", "", "Table to backfill")
+		batchSize := cmd.IntOpt("batch-size", 500, "Number of rows to read at a time")
+		batchDelay := cmd.StringOpt("batch-delay", "100ms", "Pause between batches, to leave capacity for live traffic")
+		columns := cmd.StringOpt("columns", "", "Comma-separated columns to backfill (defaults to every JSONPath column of the table)")
+		restart := cmd.BoolOpt("restart", false, "Discard the checkpoint of an interrupted backfill and start from the first row")
+
+		cmd.Action = func() {
+			rwConfig, err := config.ReadConfig(*rwYml)
+			if err != nil {
+				log.WithError(err).Fatal("unable to read r/w YAML configuration")
+			}
+
+			delay, err := time.ParseDuration(*batchDelay)
+			if err != nil || delay < 0 {
+				log.WithError(err).WithField("batchDelay", *batchDelay).Fatal("invalid backfill batch delay")
+			}
+			options := db.BackfillOptions{BatchSize: *batchSize, BatchDelay: delay, Restart: *restart}
+			if *columns != "" {
+				options.Columns = strings.Split(*columns, ",")
+			}
+
+			conn, err := dbOpener(*dbURL, *dbHost, dbPoolConfig())()
+			if err != nil {
+				log.WithError(err).Fatal("unable to connect to database")
+			}
+
+			rw := db.NewService(conn, false, rwConfig)
+			if _, err := rw.SchemaCheck(); err != nil {
+				log.WithError(err).Fatal("database schema is mismatched, not backfilling")
+			}
+
+			progress, err := rw.Backfill(context.Background(), *tableName, options)
+			if err != nil {
+				log.WithError(err).WithFields(log.Fields{"table": *tableName, "lastKey": progress.LastKey, "scanned": progress.Scanned, "updated": progress.Updated}).Fatal("backfill failed, it resumes from the last checkpoint when it is run again")
+			}
+			log.WithFields(log.Fields{"table": *tableName, "scanned": progress.Scanned, "updated": progress.Updated}).Info("backfill complete")
+		}
+	})
+
+	app.Command("migrate", "Show, apply or roll back the database schema migrations", func(cmd *cli.Cmd) {
+		// migrator connects to the database for the subcommand, which prints the status or SQL to stdout
+		migrator := func(dryRun bool) *db.Migrator {
+			conn, err := dbOpener(*dbURL, *dbHost, dbPoolConfig())()
+			if err != nil {
+				log.WithError(err).Fatal("unable to connect to database")
+			}
+
+			m, err := db.NewMigrator(conn, migrationLockTimeout(), dryRun, os.Stdout)
+			if err != nil {
+				log.WithError(err).Fatal("unable to manage database migrations")
+			}
+			return m
+		}
+
+		cmd.Command("status", "Show which migrations have been applied", func(sub *cli.Cmd) {
+			sub.Action = func() {
+				if err := migrator(false).Status(context.Background()); err != nil {
+					log.WithError(err).Fatal("unable to read migration status")
+				}
+			}
+		})
+
+		cmd.Command("up", "Apply the migrations up to a version, or the latest version", func(sub *cli.Cmd) {
+			sub.Spec = "[--to] [--dry-run]"
+			to := sub.IntOpt("to", 0, "Schema version to migrate up to (0 for the latest version)")
+			dryRun := sub.BoolOpt("dry-run", false, "Print the SQL of the migrations instead of applying them")
+
+			sub.Action = func() {
+				if err := migrator(*dryRun).Up(context.Background(), int64(*to)); err != nil {
+					log.WithError(err).Fatal("migrating database up failed")
+				}
+			}
+		})
+
+		cmd.Command("down", "Roll back the migrations after a version", func(sub *cli.Cmd) {
+			sub.Spec = "--to [--dry-run]"
+			to := sub.IntOpt("to", 0, "Schema version to roll back to")
+			dryRun := sub.BoolOpt("dry-run", false, "Print the SQL of the rollbacks instead of applying them")
+
+			sub.Action = func() {
+				if err := migrator(*dryRun).Down(context.Background(), int64(*to)); err != nil {
+					log.WithError(err).Fatal("migrating database down failed")
+				}
+			}
+		})
+
+		cmd.Command("redo", "Roll back the latest applied migration, then apply it again", func(sub *cli.Cmd) {
+			sub.Spec = "[--dry-run]"
+			dryRun := sub.BoolOpt("dry-run", false, "Print the SQL of the migration instead of applying it")
+
+			sub.Action = func() {
+				if err := migrator(*dryRun).Redo(context.Background()); err != nil {
+					log.WithError(err).Fatal("redoing database migration failed")
+				}
+			}
+		})
+
+		cmd.Command("generate", "Generate the migration that creates the configured tables and columns missing from the database", func(sub *cli.Cmd) {
+			sub.Spec = "[--name] [--dir] [--dry-run]"
+			name := sub.StringOpt("name", "generated-from-config", "Name of the migration")
+			dir := sub.StringOpt("dir", "", "Directory to write the migration files to (defaults to the migrations directory, or db/migrations)")
+			dryRun := sub.BoolOpt("dry-run", false, "Print the migration instead of writing the files")
+
+			sub.Action = func() {
+				rwConfig, err := config.ReadConfig(*rwYml)
+				if err != nil {
+					log.WithError(err).Fatal("unable to read r/w YAML configuration")
+				}
+
+				target := *dir
+				if target == "" {
+					target = *migrationsDir
+				}
+				if target == "" {
+					target = "db/migrations"
+				}
+
+				if err := migrator(*dryRun).Generate(context.Background(), rwConfig, target, *name); err != nil {
+					log.WithError(err).Fatal("generating database migration failed")
+				}
+			}
+		})
+	})
+
 	app.Action = func() {
 		log.Infof("System code: %s, App Name: %s, Port: %s", *appSystemCode, *appName, *port)
 
@@ -95,14 +494,50 @@ func main() {
 			log.WithError(err).Fatal("unable to read r/w YAML configuration")
 		}
 
-		conn, err := db.Connect(*dbURL, maxConnections)
+		pool := dbPoolConfig()
+		openWriter := dbOpener(*dbURL, *dbHost, pool)
+		conn, err := openWriter()
+		if conn == nil {
+			log.WithError(err).Fatal("invalid database connection settings")
+		}
 		if err != nil {
-			log.WithError(err).Error("unable to connect to database")
+			log.WithError(err).Error("unable to connect to database, it will be retried in the background")
 		}
 
-		rw := db.NewService(conn, *performSchemaMigrations, rwConfig)
+		options := []db.Option{db.WithReconnect(openWriter), db.WithMigrationLockTimeout(migrationLockTimeout())}
+		if (*dbPasswordFile == "" && *dbReaderURL != "") || (*dbPasswordFile != "" && *dbReaderHost != "") {
+			openReader := dbOpener(*dbReaderURL, *dbReaderHost, pool)
+			readConn, err := openReader()
+			if readConn == nil {
+				log.WithError(err).Fatal("invalid database reader connection settings")
+			}
+			if err != nil {
+				log.WithError(err).Error("unable to connect to database reader")
+			}
+			options = append(options, db.WithReader(readConn), db.WithReaderReconnect(openReader))
+		}
+		if *dbPasswordFile != "" {
+			interval, err := time.ParseDuration(*dbPasswordPollInterval)
+			if err != nil || interval <= 0 {
+				log.WithError(err).WithField("interval", *dbPasswordPollInterval).Fatal("invalid database password poll interval")
+			}
+			options = append(options, db.WithPasswordFile(*dbPasswordFile, interval))
+		}
+		if *outboxNotifier != "" {
+			options = append(options, outboxOption(*outboxNotifier, *outboxWebhookURL, *outboxWebhookTimeout, *kafkaBrokers, rwConfig, *outboxPollInterval, *outboxBatchSize))
+		}
+		if *autoCreateTables {
+			options = append(options, db.WithAutoCreateTables())
+		}
+		if *readCacheSize > 0 {
+			options = append(options, db.WithReadCache(*readCacheSize, metrics.DefaultRegistry))
+		}
+
+		rw := db.NewService(conn, *performSchemaMigrations, rwConfig, options...)
+		db.RegisterPoolMetrics(rw, metrics.DefaultRegistry)
 
 		healthService := health.NewHealthService(*appSystemCode, *appName, appDescription, rw)
+		healthService.AddTableChecks(rwConfig)
 
 		timeout, err := time.ParseDuration(*appTimeout)
 
@@ -110,7 +545,7 @@ func main() {
 			log.WithError(err).Error("unable to parse timeout")
 			return
 		}
-		serveEndpoints(*port, apiYml, rwConfig, rw, healthService, timeout)
+		serveEndpoints(*port, apiYml, rwConfig, rw, healthService, timeout, *adminBackfillEnabled)
 	}
 
 	err := app.Run(os.Args)
@@ -119,7 +554,44 @@ func main() {
 	}
 }
 
-func serveEndpoints(port string, apiYml *string, rw *config.Config, db db.RWService, healthService *health.HealthService, timeout time.Duration) {
+// outboxOption publishes the change events recorded in the outbox to the named notifier.
+func outboxOption(notifierName string, webhookURL string, webhookTimeout string, kafkaBrokers string, rwConfig *config.Config, pollInterval string, batchSize int) db.Option {
+	interval, err := time.ParseDuration(pollInterval)
+	if err != nil || interval <= 0 {
+		log.WithError(err).WithField("interval", pollInterval).Fatal("invalid outbox poll interval")
+	}
+
+	var notifier events.Notifier
+	switch notifierName {
+	case "log":
+		notifier = events.NewLogNotifier()
+	case "webhook":
+		timeout, err := time.ParseDuration(webhookTimeout)
+		if err != nil {
+			log.WithError(err).WithField("timeout", webhookTimeout).Fatal("invalid outbox webhook timeout")
+		}
+		if webhookURL == "" {
+			log.Fatal("outbox webhook URL is required for the webhook notifier")
+		}
+		notifier = events.NewWebhookNotifier(webhookURL, timeout)
+	case "kafka":
+		if kafkaBrokers == "" {
+			log.Fatal("Kafka brokers are required for the kafka notifier")
+		}
+		topics := make(map[string]string)
+		for path, mapping := range rwConfig.Paths {
+			topics[path] = mapping.Topic
+		}
+		notifier = events.NewKafkaNotifier(strings.Split(kafkaBrokers, ","), topics)
+	default:
+		log.WithField("notifier", notifierName).Fatal("unsupported outbox notifier")
+	}
+
+	log.WithField("notifier", notifierName).Info("publishing change events from the outbox")
+	return db.WithOutbox(notifier, interval, batchSize)
+}
+
+func serveEndpoints(port string, apiYml *string, rw *config.Config, db *db.AuroraRWService, healthService *health.HealthService, timeout time.Duration, backfillEnabled bool) {
 	r := vestigo.NewRouter()
 
 	var monitoringRouter http.Handler = r
@@ -129,11 +601,11 @@ func serveEndpoints(port string, apiYml *string, rw *config.Config, db db.RWServ
 	r.Get("/__health", healthService.HealthCheckHandleFunc())
 	r.Get(status.GTGPath, status.NewGoodToGoHandler(healthService.GTG))
 	r.Get(status.BuildInfoPath, status.BuildInfoHandler)
+	r.Get(resources.DBStatsPath, resources.DBStats(db))
 
-	for path, cfg := range rw.Paths {
-		r.Get(path, resources.Read(db, cfg.Table, timeout))
-		r.Put(path, resources.Write(db, cfg.Table, timeout))
-		log.WithField("path", path).WithField("table", cfg.Table).Info("added r/w endpoint")
+	resources.RegisterEndpoints(r, rw, db, timeout)
+	if backfillEnabled {
+		resources.RegisterBackfillEndpoints(r, rw, db, timeout)
 	}
 
 	http.Handle("/", monitoringRouter)
@@ -0,0 +1,141 @@
+package resources
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Financial-Times/generic-rw-aurora/config"
+	"github.com/Financial-Times/generic-rw-aurora/db"
+	"github.com/husobee/vestigo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	backfillPathSegment       = "__backfill"
+	defaultBackfillBatchSize  = 500
+	maxBackfillBatchSize      = 10000
+	defaultBackfillBatchDelay = 100 * time.Millisecond
+)
+
+// BackfillPath returns the admin path of the backfill of a table, e.g. /__backfill/draft_content.
+func BackfillPath(table string) string {
+	return "/" + backfillPathSegment + "/" + table
+}
+
+// RegisterBackfillEndpoints adds the admin endpoints that start and report the backfill of every table
+// with columns derived from the document to the router.
+func RegisterBackfillEndpoints(r *vestigo.Router, rwConfig *config.Config, backfiller db.Backfiller, timeout time.Duration) {
+	tables := make(map[string]bool)
+	for _, cfg := range rwConfig.Paths {
+		if hasJSONPathColumns(cfg) && !tables[cfg.Table] {
+			tables[cfg.Table] = true
+			r.Post(BackfillPath(cfg.Table), StartBackfill(backfiller, cfg.Table))
+			r.Get(BackfillPath(cfg.Table), BackfillStatus(backfiller, cfg.Table, timeout))
+			log.WithField("path", BackfillPath(cfg.Table)).WithField("table", cfg.Table).Info("added backfill endpoint")
+		}
+	}
+}
+
+// StartBackfill starts a backfill of the JSONPath columns of the table in the background and responds with 202 Accepted,
+// or 409 Conflict if a backfill of the table is already running, in this or another instance.
+func StartBackfill(backfiller db.Backfiller, table string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+
+		options, err := backfillParams(request)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(writer).Encode(map[string]string{"message": err.Error()})
+			return
+		}
+
+		if err := backfiller.StartBackfill(table, options); err != nil {
+			status := http.StatusBadRequest
+			switch {
+			case err == db.ErrBackfillRunning:
+				status = http.StatusConflict
+			case errors.Is(err, db.ErrBackfillCheckpoint):
+				log.WithError(err).WithField("table", table).Error("unable to start backfill")
+				status = http.StatusInternalServerError
+			}
+			writer.WriteHeader(status)
+			json.NewEncoder(writer).Encode(map[string]string{"message": err.Error()})
+			return
+		}
+
+		log.WithFields(log.Fields{"table": table, "columns": options.Columns, "batchSize": options.BatchSize, "batchDelay": options.BatchDelay}).Info("backfill started")
+		writer.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(writer).Encode(map[string]string{"message": "backfill started"})
+	}
+}
+
+// BackfillStatus responds with the progress of the backfill of the table.
+func BackfillStatus(backfiller db.Backfiller, table string, timeout time.Duration) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+
+		ctx, cancel := context.WithTimeout(request.Context(), timeout)
+		defer cancel()
+
+		progress, err := backfiller.BackfillProgress(ctx, table)
+		if err != nil {
+			log.WithError(err).WithField("table", table).Error("unable to read backfill progress")
+			writer.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(writer).Encode(map[string]string{"message": err.Error()})
+			return
+		}
+		json.NewEncoder(writer).Encode(progress)
+	}
+}
+
+// hasJSONPathColumns is true if the path has columns derived from the document, which can be backfilled
+func hasJSONPathColumns(cfg config.Mapping) bool {
+	for _, expr := range cfg.Columns {
+		if strings.HasPrefix(expr, "$") && expr != "$" {
+			return true
+		}
+	}
+	return false
+}
+
+func backfillParams(request *http.Request) (db.BackfillOptions, error) {
+	query := request.URL.Query()
+	options := db.BackfillOptions{BatchSize: defaultBackfillBatchSize, BatchDelay: defaultBackfillBatchDelay}
+
+	if s := query.Get("batchSize"); s != "" {
+		var err error
+		if options.BatchSize, err = strconv.Atoi(s); err != nil || options.BatchSize < 1 || options.BatchSize > maxBackfillBatchSize {
+			return options, fmt.Errorf("invalid batchSize %s, it must be between 1 and %d", s, maxBackfillBatchSize)
+		}
+	}
+
+	if d := query.Get("batchDelay"); d != "" {
+		var err error
+		if options.BatchDelay, err = time.ParseDuration(d); err != nil || options.BatchDelay < 0 {
+			return options, fmt.Errorf("invalid batchDelay %s, it must be a duration", d)
+		}
+	}
+
+	for _, columns := range query["columns"] {
+		for _, col := range strings.Split(columns, ",") {
+			if col = strings.TrimSpace(col); col != "" {
+				options.Columns = append(options.Columns, col)
+			}
+		}
+	}
+
+	if r := query.Get("restart"); r != "" {
+		var err error
+		if options.Restart, err = strconv.ParseBool(r); err != nil {
+			return options, fmt.Errorf("invalid restart %s, it must be true or false", r)
+		}
+	}
+
+	return options, nil
+}
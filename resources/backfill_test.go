@@ -0,0 +1,162 @@
+package resources
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Financial-Times/generic-rw-aurora/config"
+	"github.com/Financial-Times/generic-rw-aurora/db"
+	"github.com/husobee/vestigo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockBackfiller struct {
+	mock.Mock
+}
+
+func (m *mockBackfiller) StartBackfill(table string, options db.BackfillOptions) error {
+	args := m.Called(table, options)
+	return args.Error(0)
+}
+
+func (m *mockBackfiller) BackfillProgress(ctx context.Context, table string) (db.BackfillProgress, error) {
+	args := m.Called(ctx, table)
+	return args.Get(0).(db.BackfillProgress), args.Error(1)
+}
+
+func TestBackfillPath(t *testing.T) {
+	assert.Equal(t, "/__backfill/draft_content", BackfillPath("draft_content"))
+}
+
+func TestRegisterBackfillEndpoints(t *testing.T) {
+	backfiller := &mockBackfiller{}
+	backfiller.On("StartBackfill", "things", mock.Anything).Return(nil)
+
+	r := vestigo.NewRouter()
+	RegisterBackfillEndpoints(r, &config.Config{Paths: map[string]config.Mapping{
+		"/things/:id":    {Table: "things", Columns: map[string]string{"id": ":id", "body": "$", "title": "$.title"}},
+		"/documents/:id": {Table: "documents", Columns: map[string]string{"id": ":id", "body": "$"}},
+	}}, backfiller, testDefaultTimeout)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/__backfill/things", nil))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/__backfill/documents", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code, "a table without columns derived from the document has no backfill")
+	backfiller.AssertExpectations(t)
+}
+
+func TestStartBackfill(t *testing.T) {
+	backfiller := &mockBackfiller{}
+	backfiller.On("StartBackfill", testTable, db.BackfillOptions{Columns: []string{"title", "kind"}, BatchSize: 100, BatchDelay: time.Second, Restart: true}).Return(nil)
+
+	req := httptest.NewRequest("POST", "/__backfill/test?batchSize=100&batchDelay=1s&columns=title,kind&restart=true", nil)
+	w := httptest.NewRecorder()
+	StartBackfill(backfiller, testTable)(w, req)
+
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"message":"backfill started"}`, w.Body.String())
+	backfiller.AssertExpectations(t)
+}
+
+func TestStartBackfillDefaults(t *testing.T) {
+	backfiller := &mockBackfiller{}
+	backfiller.On("StartBackfill", testTable, db.BackfillOptions{BatchSize: defaultBackfillBatchSize, BatchDelay: defaultBackfillBatchDelay}).Return(nil)
+
+	req := httptest.NewRequest("POST", "/__backfill/test", nil)
+	w := httptest.NewRecorder()
+	StartBackfill(backfiller, testTable)(w, req)
+
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	backfiller.AssertExpectations(t)
+}
+
+func TestStartBackfillInvalidParams(t *testing.T) {
+	for query, msg := range map[string]string{
+		"batchSize=0":     "invalid batchSize 0, it must be between 1 and 10000",
+		"batchSize=x":     "invalid batchSize x, it must be between 1 and 10000",
+		"batchDelay=-1s":  "invalid batchDelay -1s, it must be a duration",
+		"restart=perhaps": "invalid restart perhaps, it must be true or false",
+	} {
+		backfiller := &mockBackfiller{}
+		req := httptest.NewRequest("POST", "/__backfill/test?"+query, nil)
+		w := httptest.NewRecorder()
+		StartBackfill(backfiller, testTable)(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+		assert.JSONEq(t, `{"message":"`+msg+`"}`, w.Body.String(), query)
+		backfiller.AssertNotCalled(t, "StartBackfill", mock.Anything, mock.Anything)
+	}
+}
+
+func TestStartBackfillRejected(t *testing.T) {
+	backfiller := &mockBackfiller{}
+	backfiller.On("StartBackfill", testTable, mock.Anything).Return(errors.New("column origin of table test is not derived from the document by a JSONPath expression"))
+
+	req := httptest.NewRequest("POST", "/__backfill/test?columns=origin", nil)
+	w := httptest.NewRecorder()
+	StartBackfill(backfiller, testTable)(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"message":"column origin of table test is not derived from the document by a JSONPath expression"}`, w.Body.String())
+}
+
+func TestStartBackfillAlreadyRunning(t *testing.T) {
+	backfiller := &mockBackfiller{}
+	backfiller.On("StartBackfill", testTable, mock.Anything).Return(db.ErrBackfillRunning)
+
+	req := httptest.NewRequest("POST", "/__backfill/test", nil)
+	w := httptest.NewRecorder()
+	StartBackfill(backfiller, testTable)(w, req)
+
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.JSONEq(t, `{"message":"a backfill of the table is already running"}`, w.Body.String())
+}
+
+func TestStartBackfillCheckpointError(t *testing.T) {
+	backfiller := &mockBackfiller{}
+	backfiller.On("StartBackfill", testTable, mock.Anything).Return(fmt.Errorf("%w of table test: database is unavailable", db.ErrBackfillCheckpoint))
+
+	req := httptest.NewRequest("POST", "/__backfill/test", nil)
+	w := httptest.NewRecorder()
+	StartBackfill(backfiller, testTable)(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.JSONEq(t, `{"message":"unable to claim the backfill checkpoint of table test: database is unavailable"}`, w.Body.String())
+}
+
+func TestBackfillStatus(t *testing.T) {
+	backfiller := &mockBackfiller{}
+	progress := db.BackfillProgress{Table: testTable, Columns: []string{"title"}, LastKey: "42", Scanned: 42, Updated: 7, Running: true}
+	backfiller.On("BackfillProgress", mock.AnythingOfType("*context.timerCtx"), testTable).Return(progress, nil)
+
+	req := httptest.NewRequest("GET", "/__backfill/test", nil)
+	w := httptest.NewRecorder()
+	BackfillStatus(backfiller, testTable, testDefaultTimeout)(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"table":"`+testTable+`","columns":["title"],"lastKey":"42","scanned":42,"updated":7,"running":true,"complete":false}`, w.Body.String())
+	backfiller.AssertExpectations(t)
+}
+
+func TestBackfillStatusError(t *testing.T) {
+	backfiller := &mockBackfiller{}
+	backfiller.On("BackfillProgress", mock.Anything, testTable).Return(db.BackfillProgress{}, errors.New("database is unavailable"))
+
+	req := httptest.NewRequest("GET", "/__backfill/test", nil)
+	w := httptest.NewRecorder()
+	BackfillStatus(backfiller, testTable, testDefaultTimeout)(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.JSONEq(t, `{"message":"database is unavailable"}`, w.Body.String())
+}
@@ -0,0 +1,116 @@
+package resources
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Financial-Times/generic-rw-aurora/db"
+	tidutils "github.com/Financial-Times/transactionid-utils-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	changesPathSegment  = "__changes"
+	defaultChangesLimit = 100
+	maxChangesLimit     = 1000
+	maxChangesWait      = time.Minute
+)
+
+type changesResponse struct {
+	Changes []db.Change `json:"changes"`
+	// Next is the cursor for the next request, which is the sequence number of the last change, or since if there were none
+	Next int64 `json:"next"`
+}
+
+// ChangesPath returns the path of the change feed of a configured path.
+func ChangesPath(path string) string {
+	return feedPath(path, changesPathSegment)
+}
+
+// feedPath returns a configured path without its parameters, followed by the segment,
+// e.g. /published/content/annotations/__changes for /published/content/:id/annotations and __changes.
+func feedPath(path string, segment string) string {
+	var segments []string
+	for _, s := range strings.Split(strings.Trim(path, "/"), "/") {
+		if !strings.HasPrefix(s, ":") {
+			segments = append(segments, s)
+		}
+	}
+	return "/" + strings.Join(append(segments, segment), "/")
+}
+
+// Changes responds with the keys and hashes of the documents that have changed after the since cursor.
+// If there are none, it waits for up to the wait duration for a change.
+func Changes(feed db.ChangeFeed, table string, timeout time.Duration) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+
+		since, limit, wait, err := changesParams(request)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(writer).Encode(map[string]string{"message": err.Error()})
+			return
+		}
+
+		txid := tidutils.GetTransactionIDFromRequest(request)
+		ctx, cancelFunc := context.WithTimeout(tidutils.TransactionAwareContext(request.Context(), txid), timeout+wait)
+		defer cancelFunc()
+
+		changesLog := log.WithFields(log.Fields{tidutils.TransactionIDKey: txid, "table": table, "since": since})
+
+		changes, err := feed.Changes(ctx, table, since, limit, wait)
+		if err != nil {
+			if ctx.Err() != nil {
+				changesLog.Error("Change feed request timed out")
+				writer.WriteHeader(http.StatusGatewayTimeout)
+				json.NewEncoder(writer).Encode(map[string]string{"message": "change feed request timed out"})
+				return
+			}
+			changesLog.WithError(err).Error("unable to read change feed")
+			writer.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(writer).Encode(map[string]string{"message": err.Error()})
+			return
+		}
+
+		next := since
+		if len(changes) > 0 {
+			next = changes[len(changes)-1].Seq
+		}
+		json.NewEncoder(writer).Encode(changesResponse{Changes: changes, Next: next})
+	}
+}
+
+func changesParams(request *http.Request) (int64, int, time.Duration, error) {
+	query := request.URL.Query()
+
+	var since int64
+	if s := query.Get("since"); s != "" {
+		var err error
+		if since, err = strconv.ParseInt(s, 10, 64); err != nil || since < 0 {
+			return 0, 0, 0, fmt.Errorf("invalid since cursor %s", s)
+		}
+	}
+
+	limit := defaultChangesLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > maxChangesLimit {
+			return 0, 0, 0, fmt.Errorf("invalid limit %s, it must be between 1 and %d", l, maxChangesLimit)
+		}
+	}
+
+	var wait time.Duration
+	if w := query.Get("wait"); w != "" {
+		var err error
+		if wait, err = time.ParseDuration(w); err != nil || wait < 0 || wait > maxChangesWait {
+			return 0, 0, 0, fmt.Errorf("invalid wait %s, it must be a duration of up to %s", w, maxChangesWait)
+		}
+	}
+
+	return since, limit, wait, nil
+}
@@ -0,0 +1,118 @@
+package resources
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Financial-Times/generic-rw-aurora/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockChangeFeed struct {
+	mock.Mock
+}
+
+func (m *mockChangeFeed) Changes(ctx context.Context, table string, since int64, limit int, wait time.Duration) ([]db.Change, error) {
+	args := m.Called(ctx, table, since, limit, wait)
+	changes, _ := args.Get(0).([]db.Change)
+	return changes, args.Error(1)
+}
+
+func (m *mockChangeFeed) ChangeSeq(ctx context.Context, table string) (int64, error) {
+	args := m.Called(ctx, table)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func TestChangesPath(t *testing.T) {
+	assert.Equal(t, "/published/content/annotations/__changes", ChangesPath("/published/content/:id/annotations"))
+	assert.Equal(t, "/drafts/content/__changes", ChangesPath("/drafts/content/:id"))
+	assert.Equal(t, "/things/__changes", ChangesPath("/things/"))
+}
+
+func TestChanges(t *testing.T) {
+	changes := []db.Change{{Key: "1", Hash: docHash, Seq: 11}, {Key: "2", Hash: prevDocHash, Seq: 12}}
+
+	feed := &mockChangeFeed{}
+	feed.On("Changes", mock.AnythingOfType("*context.timerCtx"), testTable, int64(10), 2, 5*time.Second).Return(changes, nil)
+
+	req := httptest.NewRequest("GET", "/test/__changes?since=10&limit=2&wait=5s", nil)
+	w := httptest.NewRecorder()
+	Changes(feed, testTable, testDefaultTimeout)(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"changes":[{"key":"1","hash":"`+docHash+`","seq":11},{"key":"2","hash":"`+prevDocHash+`","seq":12}],"next":12}`, w.Body.String())
+	feed.AssertExpectations(t)
+}
+
+func TestChangesDefaults(t *testing.T) {
+	feed := &mockChangeFeed{}
+	feed.On("Changes", mock.AnythingOfType("*context.timerCtx"), testTable, int64(0), defaultChangesLimit, time.Duration(0)).Return([]db.Change{}, nil)
+
+	req := httptest.NewRequest("GET", "/test/__changes", nil)
+	w := httptest.NewRecorder()
+	Changes(feed, testTable, testDefaultTimeout)(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"changes":[],"next":0}`, w.Body.String())
+	feed.AssertExpectations(t)
+}
+
+func TestChangesNoneKeepsCursor(t *testing.T) {
+	feed := &mockChangeFeed{}
+	feed.On("Changes", mock.AnythingOfType("*context.timerCtx"), testTable, int64(42), defaultChangesLimit, time.Duration(0)).Return([]db.Change{}, nil)
+
+	req := httptest.NewRequest("GET", "/test/__changes?since=42", nil)
+	w := httptest.NewRecorder()
+	Changes(feed, testTable, testDefaultTimeout)(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"changes":[],"next":42}`, w.Body.String())
+}
+
+func TestChangesInvalidParams(t *testing.T) {
+	for _, query := range []string{"since=abc", "since=-1", "limit=0", "limit=1001", "limit=x", "wait=forever", "wait=-1s", "wait=2m"} {
+		feed := &mockChangeFeed{}
+
+		req := httptest.NewRequest("GET", "/test/__changes?"+query, nil)
+		w := httptest.NewRecorder()
+		Changes(feed, testTable, testDefaultTimeout)(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+		assert.Contains(t, w.Body.String(), "invalid", query)
+		feed.AssertNotCalled(t, "Changes", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	}
+}
+
+func TestChangesError(t *testing.T) {
+	feed := &mockChangeFeed{}
+	feed.On("Changes", mock.AnythingOfType("*context.timerCtx"), testTable, int64(0), defaultChangesLimit, time.Duration(0)).Return(nil, errors.New("computer says no"))
+
+	req := httptest.NewRequest("GET", "/test/__changes", nil)
+	w := httptest.NewRecorder()
+	Changes(feed, testTable, testDefaultTimeout)(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.JSONEq(t, `{"message":"computer says no"}`, w.Body.String())
+}
+
+func TestChangesTimeout(t *testing.T) {
+	feed := &mockChangeFeed{}
+	feed.On("Changes", mock.AnythingOfType("*context.timerCtx"), testTable, int64(0), defaultChangesLimit, time.Duration(0)).
+		Return(nil, context.DeadlineExceeded).
+		Run(func(args mock.Arguments) {
+			<-args.Get(0).(context.Context).Done()
+		})
+
+	req := httptest.NewRequest("GET", "/test/__changes", nil)
+	w := httptest.NewRecorder()
+	Changes(feed, testTable, 10*time.Millisecond)(w, req)
+
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.JSONEq(t, `{"message":"change feed request timed out"}`, w.Body.String())
+}
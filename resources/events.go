@@ -0,0 +1,271 @@
+package resources
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Financial-Times/generic-rw-aurora/db"
+	tidutils "github.com/Financial-Times/transactionid-utils-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	eventsPathSegment = "__events"
+	lastEventIDHeader = "Last-Event-ID"
+	maxEventKeys      = 100
+)
+
+// heartbeatInterval is how often a comment is sent on an idle event stream, so that proxies and clients keep it open
+var heartbeatInterval = 15 * time.Second
+
+// EventsPath returns the path of the event stream of a configured path.
+func EventsPath(path string) string {
+	return feedPath(path, eventsPathSegment)
+}
+
+// eventBufferSize is the number of batches of changes that are kept for an event stream that is still writing
+// the previous ones. A stream that falls further behind is closed, and its client reconnects with the id of the
+// last event it received.
+const eventBufferSize = 16
+
+// Events streams the changes of the documents with the keys in the ids query parameter as Server-Sent Events,
+// until the client disconnects. The id of each event is the sequence number of the change, so that a client that
+// reconnects with a Last-Event-ID header resumes after it; otherwise the stream starts from the latest change.
+// The streams of a table share one poll of the change feed.
+func Events(feed db.ChangeFeed, table string) http.HandlerFunc {
+	return newEventHub(feed, table).stream
+}
+
+// eventHub polls the change feed of a table while it has event streams, and sends each batch of changes to all of them.
+type eventHub struct {
+	sync.Mutex
+	feed    db.ChangeFeed
+	table   string
+	running *eventPoll
+}
+
+// eventPoll is a poll of the change feed, which is cancelled when its last stream is closed
+type eventPoll struct {
+	cancel  context.CancelFunc
+	cursor  int64
+	streams map[chan []db.Change]bool
+}
+
+func newEventHub(feed db.ChangeFeed, table string) *eventHub {
+	return &eventHub{feed: feed, table: table}
+}
+
+// subscribe returns the channel of the batches of changes polled after the returned sequence number.
+// It starts a poll from cursor if there is none.
+func (hub *eventHub) subscribe(cursor int64) (chan []db.Change, int64) {
+	hub.Lock()
+	defer hub.Unlock()
+
+	if hub.running == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		hub.running = &eventPoll{cancel: cancel, cursor: cursor, streams: make(map[chan []db.Change]bool)}
+		go hub.poll(ctx, hub.running)
+	}
+
+	changes := make(chan []db.Change, eventBufferSize)
+	hub.running.streams[changes] = true
+	return changes, hub.running.cursor
+}
+
+func (hub *eventHub) unsubscribe(changes chan []db.Change) {
+	hub.Lock()
+	defer hub.Unlock()
+
+	if p := hub.running; p != nil && p.streams[changes] {
+		delete(p.streams, changes)
+		if len(p.streams) == 0 {
+			p.cancel()
+			hub.running = nil
+		}
+	}
+}
+
+func (hub *eventHub) poll(ctx context.Context, p *eventPoll) {
+	pollLog := log.WithField("table", hub.table)
+	cursor := p.cursor
+	for {
+		changes, err := hub.feed.Changes(ctx, hub.table, cursor, maxChangesLimit, heartbeatInterval)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			// the clients reconnect with the id of the last event they received
+			pollLog.WithError(err).Error("unable to read change feed, closing event streams")
+			hub.stop(p)
+			return
+		}
+		if len(changes) > 0 {
+			cursor = changes[len(changes)-1].Seq
+			hub.broadcast(p, changes, cursor)
+		}
+	}
+}
+
+func (hub *eventHub) broadcast(p *eventPoll, changes []db.Change, cursor int64) {
+	hub.Lock()
+	defer hub.Unlock()
+
+	p.cursor = cursor
+	for stream := range p.streams {
+		select {
+		case stream <- changes:
+		default:
+			log.WithField("table", hub.table).Warn("event stream is too far behind the change feed, closing it")
+			delete(p.streams, stream)
+			close(stream)
+		}
+	}
+}
+
+// stop closes the streams of a poll that has failed
+func (hub *eventHub) stop(p *eventPoll) {
+	hub.Lock()
+	defer hub.Unlock()
+
+	for stream := range p.streams {
+		delete(p.streams, stream)
+		close(stream)
+	}
+	p.cancel()
+	if hub.running == p {
+		hub.running = nil
+	}
+}
+
+func (hub *eventHub) stream(writer http.ResponseWriter, request *http.Request) {
+	txid := tidutils.GetTransactionIDFromRequest(request)
+	ctx := tidutils.TransactionAwareContext(request.Context(), txid)
+	eventsLog := log.WithFields(log.Fields{tidutils.TransactionIDKey: txid, "table": hub.table})
+
+	keys, err := eventKeys(request)
+	if err != nil {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(writer).Encode(map[string]string{"message": err.Error()})
+		return
+	}
+
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		eventsLog.Error("the response writer does not support streaming")
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(writer).Encode(map[string]string{"message": "event streams are not supported"})
+		return
+	}
+
+	var cursor int64
+	if lastEventID := request.Header.Get(lastEventIDHeader); lastEventID != "" {
+		if cursor, err = strconv.ParseInt(lastEventID, 10, 64); err != nil || cursor < 0 {
+			writer.Header().Set("Content-Type", "application/json")
+			writer.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(writer).Encode(map[string]string{"message": fmt.Sprintf("invalid %s %s", lastEventIDHeader, lastEventID)})
+			return
+		}
+	} else if cursor, err = hub.feed.ChangeSeq(ctx, hub.table); err != nil {
+		eventsLog.WithError(err).Error("unable to read change sequence")
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(writer).Encode(map[string]string{"message": err.Error()})
+		return
+	}
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	// disables response buffering in nginx based proxies
+	writer.Header().Set("X-Accel-Buffering", "no")
+	writer.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// the changes are written in sequence order, and the changes that the stream has already written are skipped
+	writeChanges := func(changes []db.Change) error {
+		for _, change := range changes {
+			if change.Seq <= cursor {
+				continue
+			}
+			cursor = change.Seq
+			if !keys[change.Key] {
+				continue
+			}
+			data, err := json.Marshal(change)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(writer, "id: %d\nevent: change\ndata: %s\n\n", change.Seq, data)
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	eventsLog.WithField("since", cursor).Info("event stream opened")
+	stream, polled := hub.subscribe(cursor)
+	defer hub.unsubscribe(stream)
+
+	// a stream that resumes before the changes that are being polled reads the changes up to them itself
+	for cursor < polled {
+		changes, err := hub.feed.Changes(ctx, hub.table, cursor, maxChangesLimit, 0)
+		if err != nil {
+			if ctx.Err() == nil {
+				eventsLog.WithError(err).Error("unable to read change feed, closing event stream")
+			}
+			return
+		}
+		if len(changes) == 0 {
+			break
+		}
+		if err := writeChanges(changes); err != nil {
+			eventsLog.WithError(err).Error("unable to encode change event")
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case changes, ok := <-stream:
+			if !ok {
+				return
+			}
+			if err := writeChanges(changes); err != nil {
+				eventsLog.WithError(err).Error("unable to encode change event")
+				return
+			}
+		case <-heartbeat.C:
+			fmt.Fprint(writer, ": heartbeat\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+func eventKeys(request *http.Request) (map[string]bool, error) {
+	keys := make(map[string]bool)
+	for _, ids := range request.URL.Query()["ids"] {
+		for _, id := range strings.Split(ids, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				keys[id] = true
+			}
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("the ids of the documents to watch are required")
+	}
+	if len(keys) > maxEventKeys {
+		return nil, fmt.Errorf("too many ids, up to %d documents can be watched", maxEventKeys)
+	}
+	return keys, nil
+}
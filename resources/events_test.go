@@ -0,0 +1,222 @@
+package resources
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Financial-Times/generic-rw-aurora/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// streamEvents runs the event stream handler until the feed has been read len(responses) times, then fails the feed,
+// which closes the stream
+func streamEvents(t *testing.T, feed *mockChangeFeed, since int64, url string, lastEventID string, responses ...[]db.Change) *httptest.ResponseRecorder {
+	cursor := since
+	for _, changes := range responses {
+		feed.On("Changes", mock.Anything, testTable, cursor, maxChangesLimit, heartbeatInterval).Return(changes, nil).Once()
+		if len(changes) > 0 {
+			cursor = changes[len(changes)-1].Seq
+		}
+	}
+	feed.On("Changes", mock.Anything, testTable, cursor, maxChangesLimit, heartbeatInterval).Return(nil, errors.New("computer says no")).Once()
+
+	req := httptest.NewRequest("GET", url, nil)
+	if lastEventID != "" {
+		req.Header.Set(lastEventIDHeader, lastEventID)
+	}
+	w := httptest.NewRecorder()
+	Events(feed, testTable)(w, req)
+	return w
+}
+
+func TestEventsPath(t *testing.T) {
+	assert.Equal(t, "/drafts/content/__events", EventsPath("/drafts/content/:id"))
+	assert.Equal(t, "/drafts/content/annotations/__events", EventsPath("/drafts/content/:id/annotations"))
+}
+
+func TestEvents(t *testing.T) {
+	feed := &mockChangeFeed{}
+	feed.On("ChangeSeq", mock.Anything, testTable).Return(int64(10), nil)
+
+	w := streamEvents(t, feed, 10, "/test/__events?ids=1,2", "",
+		[]db.Change{
+			{Key: "1", Hash: docHash, Seq: 11, Metadata: db.DocMetadata{"X-Origin-System-Id": testSystemId}},
+			{Key: "3", Hash: docHash, Seq: 12},
+		},
+		[]db.Change{{Key: "2", Hash: prevDocHash, Seq: 13}},
+	)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+	assert.True(t, w.Flushed)
+	assert.Equal(t, "id: 11\nevent: change\ndata: {\"key\":\"1\",\"hash\":\""+docHash+"\",\"seq\":11,\"metadata\":{\"X-Origin-System-Id\":\""+testSystemId+"\"}}\n\n"+
+		"id: 13\nevent: change\ndata: {\"key\":\"2\",\"hash\":\""+prevDocHash+"\",\"seq\":13}\n\n", w.Body.String(), "only the watched documents are streamed")
+	feed.AssertExpectations(t)
+}
+
+func TestEventsHeartbeat(t *testing.T) {
+	defer func(interval time.Duration) { heartbeatInterval = interval }(heartbeatInterval)
+	heartbeatInterval = 10 * time.Millisecond
+
+	feed := &mockChangeFeed{}
+	feed.On("ChangeSeq", mock.Anything, testTable).Return(int64(0), nil)
+	feed.On("Changes", mock.Anything, testTable, int64(0), maxChangesLimit, heartbeatInterval).Return([]db.Change{}, nil).After(50 * time.Millisecond).Once()
+	feed.On("Changes", mock.Anything, testTable, int64(0), maxChangesLimit, heartbeatInterval).Return(nil, errors.New("computer says no")).Once()
+
+	w := httptest.NewRecorder()
+	Events(feed, testTable)(w, httptest.NewRequest("GET", "/test/__events?ids=1", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.HasPrefix(w.Body.String(), ": heartbeat\n\n"), "heartbeats are sent while there are no changes")
+	feed.AssertExpectations(t)
+}
+
+func TestEventsResumeFromLastEventID(t *testing.T) {
+	feed := &mockChangeFeed{}
+
+	w := streamEvents(t, feed, 5, "/test/__events?ids=1&ids=2", "5", []db.Change{{Key: "2", Hash: docHash, Seq: 6}})
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "id: 6\nevent: change\ndata: {\"key\":\"2\",\"hash\":\""+docHash+"\",\"seq\":6}\n\n", w.Body.String())
+	feed.AssertExpectations(t)
+	feed.AssertNotCalled(t, "ChangeSeq", mock.Anything, mock.Anything)
+}
+
+// streamEventsAsync runs the event stream handler of the hub in the background
+func streamEventsAsync(hub *eventHub, wg *sync.WaitGroup, url string, lastEventID string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", url, nil)
+	req.Header.Set(lastEventIDHeader, lastEventID)
+	w := httptest.NewRecorder()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hub.stream(w, req)
+	}()
+	return w
+}
+
+func pollingStreams(hub *eventHub) int {
+	hub.Lock()
+	defer hub.Unlock()
+	if hub.running == nil {
+		return 0
+	}
+	return len(hub.running.streams)
+}
+
+func TestEventsSharePoll(t *testing.T) {
+	release := make(chan time.Time)
+	feed := &mockChangeFeed{}
+	feed.On("Changes", mock.Anything, testTable, int64(10), maxChangesLimit, heartbeatInterval).
+		WaitUntil(release).
+		Return([]db.Change{{Key: "1", Hash: docHash, Seq: 11}, {Key: "2", Hash: prevDocHash, Seq: 12}}, nil).
+		Once()
+	feed.On("Changes", mock.Anything, testTable, int64(12), maxChangesLimit, heartbeatInterval).Return(nil, errors.New("computer says no")).Once()
+
+	hub := newEventHub(feed, testTable)
+	var wg sync.WaitGroup
+	first := streamEventsAsync(hub, &wg, "/test/__events?ids=1", "10")
+	second := streamEventsAsync(hub, &wg, "/test/__events?ids=2", "10")
+	assert.Eventually(t, func() bool { return pollingStreams(hub) == 2 }, time.Second, time.Millisecond)
+
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, "id: 11\nevent: change\ndata: {\"key\":\"1\",\"hash\":\""+docHash+"\",\"seq\":11}\n\n", first.Body.String())
+	assert.Equal(t, "id: 12\nevent: change\ndata: {\"key\":\"2\",\"hash\":\""+prevDocHash+"\",\"seq\":12}\n\n", second.Body.String())
+	feed.AssertExpectations(t)
+	assert.Equal(t, 0, pollingStreams(hub), "the poll stops with its streams")
+}
+
+func TestEventsResumeBeforePoll(t *testing.T) {
+	release := make(chan time.Time)
+	feed := &mockChangeFeed{}
+	feed.On("Changes", mock.Anything, testTable, int64(10), maxChangesLimit, heartbeatInterval).
+		Return([]db.Change{{Key: "1", Hash: docHash, Seq: 11}, {Key: "2", Hash: docHash, Seq: 12}}, nil).
+		Once()
+	feed.On("Changes", mock.Anything, testTable, int64(12), maxChangesLimit, heartbeatInterval).
+		WaitUntil(release).
+		Return(nil, errors.New("computer says no")).
+		Once()
+	feed.On("Changes", mock.Anything, testTable, int64(5), maxChangesLimit, time.Duration(0)).
+		Return([]db.Change{{Key: "3", Hash: docHash, Seq: 7}, {Key: "1", Hash: docHash, Seq: 11}, {Key: "2", Hash: docHash, Seq: 12}}, nil).
+		Once()
+
+	hub := newEventHub(feed, testTable)
+	var wg sync.WaitGroup
+	streamEventsAsync(hub, &wg, "/test/__events?ids=1", "10")
+	assert.Eventually(t, func() bool {
+		hub.Lock()
+		defer hub.Unlock()
+		return hub.running != nil && hub.running.cursor == 12
+	}, time.Second, time.Millisecond)
+
+	resumed := streamEventsAsync(hub, &wg, "/test/__events?ids=2,3", "5")
+	assert.Eventually(t, func() bool { return pollingStreams(hub) == 2 }, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, "id: 7\nevent: change\ndata: {\"key\":\"3\",\"hash\":\""+docHash+"\",\"seq\":7}\n\n"+
+		"id: 12\nevent: change\ndata: {\"key\":\"2\",\"hash\":\""+docHash+"\",\"seq\":12}\n\n", resumed.Body.String(),
+		"the stream reads the changes before the poll itself")
+	feed.AssertExpectations(t)
+}
+
+func TestEventsFeedErrorClosesStream(t *testing.T) {
+	feed := &mockChangeFeed{}
+	feed.On("Changes", mock.Anything, testTable, int64(5), maxChangesLimit, heartbeatInterval).Return(nil, errors.New("computer says no"))
+
+	req := httptest.NewRequest("GET", "/test/__events?ids=1", nil)
+	req.Header.Set(lastEventIDHeader, "5")
+	w := httptest.NewRecorder()
+	Events(feed, testTable)(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Body.String())
+}
+
+func TestEventsBadRequest(t *testing.T) {
+	for _, test := range []struct {
+		url         string
+		lastEventID string
+		message     string
+	}{
+		{"/test/__events", "", "the ids of the documents to watch are required"},
+		{"/test/__events?ids=,", "", "the ids of the documents to watch are required"},
+		{"/test/__events?ids=1", "abc", "invalid Last-Event-ID abc"},
+		{"/test/__events?ids=1", "-1", "invalid Last-Event-ID -1"},
+	} {
+		feed := &mockChangeFeed{}
+
+		req := httptest.NewRequest("GET", test.url, nil)
+		if test.lastEventID != "" {
+			req.Header.Set(lastEventIDHeader, test.lastEventID)
+		}
+		w := httptest.NewRecorder()
+		Events(feed, testTable)(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, test.url)
+		assert.JSONEq(t, `{"message":"`+test.message+`"}`, w.Body.String(), test.url)
+		feed.AssertNotCalled(t, "Changes", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	}
+}
+
+func TestEventsChangeSeqError(t *testing.T) {
+	feed := &mockChangeFeed{}
+	feed.On("ChangeSeq", mock.Anything, testTable).Return(int64(0), errors.New("computer says no"))
+
+	req := httptest.NewRequest("GET", "/test/__events?ids=1", nil)
+	w := httptest.NewRecorder()
+	Events(feed, testTable)(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.JSONEq(t, `{"message":"computer says no"}`, w.Body.String())
+}
@@ -9,6 +9,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/Financial-Times/generic-rw-aurora/config"
 	"github.com/Financial-Times/generic-rw-aurora/db"
 	tidutils "github.com/Financial-Times/transactionid-utils-go"
 	"github.com/husobee/vestigo"
@@ -20,17 +21,40 @@ const (
 
 	documentHashHeader         = "Document-Hash"
 	previousDocumentHashHeader = "Previous-Document-Hash"
+	lastWrittenHashHeader      = "Last-Written-Document-Hash"
+	documentUnchangedHeader    = "X-Document-Unchanged"
 )
 
+// RegisterEndpoints adds the read and write endpoints for every configured path to the router.
+func RegisterEndpoints(r *vestigo.Router, rwConfig *config.Config, service db.RWService, timeout time.Duration) {
+	for path, cfg := range rwConfig.Paths {
+		r.Get(path, Read(service, cfg.Table, timeout))
+		r.Put(path, Write(service, cfg.Table, timeout))
+		log.WithField("path", path).WithField("table", cfg.Table).Info("added r/w endpoint")
+
+		if feed, ok := service.(db.ChangeFeed); ok && cfg.ChangeFeed {
+			r.Get(ChangesPath(path), Changes(feed, cfg.Table, timeout))
+			log.WithField("path", ChangesPath(path)).WithField("table", cfg.Table).Info("added change feed endpoint")
+			r.Get(EventsPath(path), Events(feed, cfg.Table))
+			log.WithField("path", EventsPath(path)).WithField("table", cfg.Table).Info("added event stream endpoint")
+		}
+	}
+}
+
 func Read(service db.RWService, table string, timeout time.Duration) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
 		txid := tidutils.GetTransactionIDFromRequest(request)
 
-		ctx, cancelFunc := context.WithTimeout(tidutils.TransactionAwareContext(context.Background(), txid), timeout)
+		ctx, cancelFunc := context.WithTimeout(tidutils.TransactionAwareContext(request.Context(), txid), timeout)
 		defer cancelFunc()
 
-		responseCh := make(chan db.Document)
-		errorCh := make(chan error)
+		if lastWrittenHash := request.Header.Get(lastWrittenHashHeader); lastWrittenHash != "" {
+			ctx = db.ContextWithLastWrittenHash(ctx, lastWrittenHash)
+		}
+
+		// the channels are buffered, so that the read can complete after the request has timed out
+		responseCh := make(chan db.Document, 1)
+		errorCh := make(chan error, 1)
 		id := vestigo.Param(request, "id")
 
 		go func(responseCh chan db.Document, errorCh chan error) {
@@ -100,11 +124,12 @@ func Write(service db.RWService, table string, timeout time.Duration) http.Handl
 		// start the endpoint timer after we consume the http body
 		// being fair to slow writers (ex: slow/bad network connection over vpn).
 		txid := tidutils.GetTransactionIDFromRequest(request)
-		ctx, cancelFunc := context.WithTimeout(tidutils.TransactionAwareContext(context.Background(), txid), timeout)
+		ctx, cancelFunc := context.WithTimeout(tidutils.TransactionAwareContext(request.Context(), txid), timeout)
 		defer cancelFunc()
 
-		responseCh := make(chan statusHashTuple)
-		errorCh := make(chan error)
+		// the channels are buffered, so that the write can complete after the request has timed out
+		responseCh := make(chan statusHashTuple, 1)
+		errorCh := make(chan error, 1)
 
 		go func(responseCh chan statusHashTuple, errorCh chan error) {
 			doc := db.NewDocument(docBody)
@@ -141,10 +166,15 @@ func Write(service db.RWService, table string, timeout time.Duration) http.Handl
 
 		case statusHashTuple := <-responseCh:
 			writer.Header().Set(documentHashHeader, statusHashTuple.hash)
-			if statusHashTuple.status == db.Created {
+			switch statusHashTuple.status {
+			case db.Created:
 				writer.WriteHeader(http.StatusCreated)
 				writeLog.Info("Document has been created")
-			} else {
+			case db.Unchanged:
+				writer.Header().Set(documentUnchangedHeader, "true")
+				writer.WriteHeader(http.StatusOK)
+				writeLog.Info("Document is unchanged")
+			default:
 				writer.WriteHeader(http.StatusOK)
 				writeLog.Info("Document has been updated")
 			}
@@ -153,6 +183,6 @@ func Write(service db.RWService, table string, timeout time.Duration) http.Handl
 }
 
 type statusHashTuple struct {
-	status bool
+	status db.WriteStatus
 	hash   string
 }
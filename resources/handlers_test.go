@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"runtime"
 	"strings"
 	"testing"
 	"time"
@@ -43,9 +44,9 @@ func (m *mockRW) Read(ctx context.Context, table string, key string) (db.Documen
 	return args.Get(0).(db.Document), args.Error(1)
 }
 
-func (m *mockRW) Write(ctx context.Context, table string, key string, doc db.Document, params map[string]string, previousDocumentHash string) (bool, string, error) {
+func (m *mockRW) Write(ctx context.Context, table string, key string, doc db.Document, params map[string]string, previousDocumentHash string) (db.WriteStatus, string, error) {
 	args := m.Called(ctx, table, key, doc, params, previousDocumentHash)
-	return args.Bool(0), args.String(1), args.Error(2)
+	return args.Get(0).(db.WriteStatus), args.String(1), args.Error(2)
 }
 
 type mockReader struct {
@@ -221,7 +222,7 @@ func TestWriteCreate(t *testing.T) {
 	))
 
 	rw := &mockRW{}
-	rw.On("Write", mock.AnythingOfType("*context.timerCtx"), testTable, testKey, docMatcher, map[string]string{"id": testKey}, "").Return(true, docHash, nil)
+	rw.On("Write", mock.AnythingOfType("*context.timerCtx"), testTable, testKey, docMatcher, map[string]string{"id": testKey}, "").Return(db.Created, docHash, nil)
 
 	router := vestigo.NewRouter()
 	router.Put(fmt.Sprintf("/%s/:id", testTable), Write(rw, testTable, testDefaultTimeout))
@@ -240,9 +241,29 @@ func TestWriteCreate(t *testing.T) {
 	rw.AssertExpectations(t)
 }
 
+func TestWriteUnchanged(t *testing.T) {
+	rw := &mockRW{}
+	rw.On("Write", mock.AnythingOfType("*context.timerCtx"), testTable, testKey, mock.AnythingOfType("db.Document"), map[string]string{"id": testKey}, "").Return(db.Unchanged, docHash, nil)
+
+	router := vestigo.NewRouter()
+	router.Put(fmt.Sprintf("/%s/:id", testTable), Write(rw, testTable, testDefaultTimeout))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", fmt.Sprintf("/%s/%s", testTable, testKey), strings.NewReader(docBody))
+
+	router.ServeHTTP(w, req)
+	actual := w.Result()
+
+	assert.Equal(t, http.StatusOK, actual.StatusCode, "HTTP status")
+	assert.Equal(t, docHash, actual.Header.Get(documentHashHeader))
+	assert.Equal(t, "true", actual.Header.Get(documentUnchangedHeader))
+
+	rw.AssertExpectations(t)
+}
+
 func TestWriteUpdate(t *testing.T) {
 	rw := &mockRW{}
-	rw.On("Write", mock.AnythingOfType("*context.timerCtx"), testTable, testKey, mock.AnythingOfType("db.Document"), map[string]string{"id": testKey}, prevDocHash).Return(false, docHash, nil)
+	rw.On("Write", mock.AnythingOfType("*context.timerCtx"), testTable, testKey, mock.AnythingOfType("db.Document"), map[string]string{"id": testKey}, prevDocHash).Return(db.Updated, docHash, nil)
 
 	router := vestigo.NewRouter()
 	router.Put(fmt.Sprintf("/%s/:id", testTable), Write(rw, testTable, testDefaultTimeout))
@@ -256,6 +277,7 @@ func TestWriteUpdate(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, actual.StatusCode, "HTTP status")
 	assert.Equal(t, docHash, actual.Header.Get(documentHashHeader))
+	assert.Empty(t, actual.Header.Get(documentUnchangedHeader))
 
 	rw.AssertExpectations(t)
 }
@@ -263,7 +285,7 @@ func TestWriteUpdate(t *testing.T) {
 func TestWriteError(t *testing.T) {
 	rw := &mockRW{}
 	msg := "Some unexpected error"
-	rw.On("Write", mock.AnythingOfType("*context.timerCtx"), testTable, testKey, mock.AnythingOfType("db.Document"), map[string]string{"id": testKey}, prevDocHash).Return(false, "", errors.New(msg))
+	rw.On("Write", mock.AnythingOfType("*context.timerCtx"), testTable, testKey, mock.AnythingOfType("db.Document"), map[string]string{"id": testKey}, prevDocHash).Return(db.Updated, "", errors.New(msg))
 
 	router := vestigo.NewRouter()
 	router.Put(fmt.Sprintf("/%s/:id", testTable), Write(rw, testTable, testDefaultTimeout))
@@ -326,7 +348,7 @@ func TestWriteTimeout(t *testing.T) {
 	rw := &mockRW{}
 	rw.On("Write", mock.AnythingOfType("*context.timerCtx"), testTable, testKey, docMatcher, map[string]string{"id": testKey}, "").Run(func(args mock.Arguments) {
 		time.Sleep(500 * time.Millisecond)
-	}).Return(true, docHash, nil)
+	}).Return(db.Created, docHash, nil)
 
 	router := vestigo.NewRouter()
 	router.Put(fmt.Sprintf("/%s/:id", testTable), Write(rw, testTable, 200*time.Millisecond))
@@ -346,3 +368,134 @@ func TestWriteTimeout(t *testing.T) {
 
 	rw.AssertExpectations(t)
 }
+
+// assertNoGoroutineLeak checks that the goroutines started since the count was taken have finished.
+// It polls in the test goroutine, as assert.Eventually runs its condition in a goroutine of its own.
+func assertNoGoroutineLeak(t *testing.T, before int) {
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before, "goroutines leaked")
+}
+
+// waitForCancel returns a mock run function that blocks like a slow query until its context is cancelled
+func waitForCancel(cancelled chan<- error) func(mock.Arguments) {
+	return func(args mock.Arguments) {
+		ctx := args.Get(0).(context.Context)
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+	}
+}
+
+func TestReadTimeoutCancelsQuery(t *testing.T) {
+	before := runtime.NumGoroutine()
+	cancelled := make(chan error, 1)
+
+	rw := &mockRW{}
+	rw.On("Read", mock.AnythingOfType("*context.timerCtx"), testTable, testKey).Run(waitForCancel(cancelled)).Return(db.Document{}, context.DeadlineExceeded)
+
+	router := vestigo.NewRouter()
+	router.Get(fmt.Sprintf("/%s/:id", testTable), Read(rw, testTable, 50*time.Millisecond))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/%s/%s", testTable, testKey), nil)
+
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusGatewayTimeout, w.Result().StatusCode, "HTTP status")
+	assert.Equal(t, context.DeadlineExceeded, <-cancelled, "the read is cancelled")
+	assertNoGoroutineLeak(t, before)
+}
+
+func TestWriteTimeoutCancelsQuery(t *testing.T) {
+	before := runtime.NumGoroutine()
+	cancelled := make(chan error, 1)
+
+	rw := &mockRW{}
+	rw.On("Write", mock.AnythingOfType("*context.timerCtx"), testTable, testKey, mock.AnythingOfType("db.Document"), map[string]string{"id": testKey}, "").Run(waitForCancel(cancelled)).Return(db.Updated, "", context.DeadlineExceeded)
+
+	router := vestigo.NewRouter()
+	router.Put(fmt.Sprintf("/%s/:id", testTable), Write(rw, testTable, 50*time.Millisecond))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", fmt.Sprintf("/%s/%s", testTable, testKey), strings.NewReader(docBody))
+
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusGatewayTimeout, w.Result().StatusCode, "HTTP status")
+	assert.Equal(t, context.DeadlineExceeded, <-cancelled, "the write is cancelled")
+	assertNoGoroutineLeak(t, before)
+}
+
+func TestReadCancelledByClient(t *testing.T) {
+	before := runtime.NumGoroutine()
+	cancelled := make(chan error, 1)
+
+	rw := &mockRW{}
+	rw.On("Read", mock.AnythingOfType("*context.timerCtx"), testTable, testKey).Run(waitForCancel(cancelled)).Return(db.Document{}, context.Canceled)
+
+	router := vestigo.NewRouter()
+	router.Get(fmt.Sprintf("/%s/:id", testTable), Read(rw, testTable, testDefaultTimeout))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("/%s/%s", testTable, testKey), nil)
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, context.Canceled, <-cancelled, "the read is cancelled when the client goes away")
+	assertNoGoroutineLeak(t, before)
+}
+
+func TestHandlersDoNotLeakGoroutines(t *testing.T) {
+	rw := &mockRW{}
+	rw.On("Read", mock.AnythingOfType("*context.timerCtx"), testTable, testKey).Run(func(args mock.Arguments) {
+		time.Sleep(20 * time.Millisecond)
+	}).Return(db.NewDocument([]byte(docBody)), nil)
+	rw.On("Write", mock.AnythingOfType("*context.timerCtx"), testTable, testKey, mock.AnythingOfType("db.Document"), map[string]string{"id": testKey}, "").Run(func(args mock.Arguments) {
+		time.Sleep(20 * time.Millisecond)
+	}).Return(db.Updated, docHash, nil)
+
+	router := vestigo.NewRouter()
+	router.Get(fmt.Sprintf("/%s/:id", testTable), Read(rw, testTable, 10*time.Millisecond))
+	router.Put(fmt.Sprintf("/%s/:id", testTable), Write(rw, testTable, 10*time.Millisecond))
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		readReq, _ := http.NewRequest("GET", fmt.Sprintf("/%s/%s", testTable, testKey), nil)
+		router.ServeHTTP(httptest.NewRecorder(), readReq)
+		writeReq, _ := http.NewRequest("PUT", fmt.Sprintf("/%s/%s", testTable, testKey), strings.NewReader(docBody))
+		router.ServeHTTP(httptest.NewRecorder(), writeReq)
+	}
+
+	// the reads and writes finish after their requests have timed out, and their goroutines must then exit
+	assertNoGoroutineLeak(t, before)
+}
+
+func TestReadWithLastWrittenHash(t *testing.T) {
+	doc := db.NewDocument([]byte(docBody))
+	doc.Hash = docHash
+
+	ctxMatcher := mock.MatchedBy(func(ctx context.Context) bool {
+		return db.LastWrittenHash(ctx) == docHash
+	})
+
+	rw := &mockRW{}
+	rw.On("Read", ctxMatcher, testTable, testKey).Return(doc, nil)
+
+	router := vestigo.NewRouter()
+	router.Get(fmt.Sprintf("/%s/:id", testTable), Read(rw, testTable, testDefaultTimeout))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/%s/%s", testTable, testKey), nil)
+	req.Header.Set(lastWrittenHashHeader, docHash)
+
+	router.ServeHTTP(w, req)
+	actual := w.Result()
+
+	assert.Equal(t, http.StatusOK, actual.StatusCode, "HTTP status")
+	assert.Equal(t, docHash, actual.Header.Get(documentHashHeader))
+
+	rw.AssertExpectations(t)
+}
@@ -0,0 +1,18 @@
+package resources
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Financial-Times/generic-rw-aurora/db"
+)
+
+const DBStatsPath = "/__db-stats"
+
+// DBStats responds with the live statistics of the database connection pools.
+func DBStats(monitor db.PoolMonitor) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(monitor.PoolStats())
+	}
+}
@@ -0,0 +1,35 @@
+package resources
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/Financial-Times/generic-rw-aurora/config"
+	"github.com/Financial-Times/generic-rw-aurora/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDBStats(t *testing.T) {
+	conn, err := db.Connect("sqlite://"+filepath.Join(t.TempDir(), "rw.db"), db.PoolConfig{})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", DBStatsPath, nil)
+	DBStats(db.NewService(conn, false, &config.Config{})).ServeHTTP(w, req)
+
+	actual := w.Result()
+	assert.Equal(t, http.StatusOK, actual.StatusCode)
+	assert.Equal(t, "application/json", actual.Header.Get("Content-Type"))
+
+	var stats map[string]db.PoolStats
+	require.NoError(t, json.NewDecoder(actual.Body).Decode(&stats))
+	require.Contains(t, stats, "writer")
+	assert.Equal(t, 1, stats["writer"].MaxOpenConnections)
+	assert.Equal(t, 1, stats["writer"].OpenConnections)
+	assert.Equal(t, 1, stats["writer"].Idle)
+}
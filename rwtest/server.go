@@ -0,0 +1,38 @@
+// Package rwtest runs a generic-rw-aurora service in-process, backed by an in-memory store,
+// for the integration tests of services that depend on it.
+package rwtest
+
+import (
+	"net/http/httptest"
+	"time"
+
+	"github.com/Financial-Times/generic-rw-aurora/config"
+	"github.com/Financial-Times/generic-rw-aurora/db"
+	"github.com/Financial-Times/generic-rw-aurora/health"
+	"github.com/Financial-Times/generic-rw-aurora/resources"
+	status "github.com/Financial-Times/service-status-go/httphandlers"
+	"github.com/husobee/vestigo"
+)
+
+const defaultTimeout = 8 * time.Second
+
+// Server is a started httptest.Server with the r/w, health and GTG endpoints for a configuration.
+// The documents are held in RW, which tests may also use directly.
+type Server struct {
+	*httptest.Server
+	RW *db.MemoryRWService
+}
+
+// NewServer starts a Server for the configuration. The caller should call Close when finished.
+func NewServer(rwConfig *config.Config) *Server {
+	rw := db.NewMemoryService(rwConfig)
+	healthService := health.NewHealthService("generic-rw-aurora", "generic-rw-aurora", "Generic R/W for Aurora (in-memory)", rw)
+	healthService.AddTableChecks(rwConfig)
+
+	r := vestigo.NewRouter()
+	r.Get("/__health", healthService.HealthCheckHandleFunc())
+	r.Get(status.GTGPath, status.NewGoodToGoHandler(healthService.GTG))
+	resources.RegisterEndpoints(r, rwConfig, rw, defaultTimeout)
+
+	return &Server{httptest.NewServer(r), rw}
+}
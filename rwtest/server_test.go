@@ -0,0 +1,46 @@
+package rwtest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Financial-Times/generic-rw-aurora/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	cfg, err := config.ReadConfig("../config.yml")
+	require.NoError(t, err)
+
+	server := NewServer(cfg)
+	defer server.Close()
+
+	docUrl := server.URL + "/drafts/content/1234/annotations"
+	req, _ := http.NewRequest("PUT", docUrl, strings.NewReader(`{"foo":"bar"}`))
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	docHash := resp.Header.Get("Document-Hash")
+	assert.NotEmpty(t, docHash)
+
+	resp, err = http.Get(docUrl)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `{"foo":"bar"}`, string(body))
+	assert.Equal(t, docHash, resp.Header.Get("Document-Hash"))
+
+	doc, err := server.RW.Read(req.Context(), "draft_annotations", "1234")
+	require.NoError(t, err)
+	assert.Equal(t, docHash, doc.Hash)
+
+	resp, err = http.Get(server.URL + "/__gtg")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}